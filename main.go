@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/ritsource/torrent-client/output"
@@ -11,250 +17,236 @@ import (
 )
 
 var torrFn string
+var magnetURI string
+var config src.Config
+var seedAfter bool
 
 func init() {
 	// reading teh command-line flags
 	devflag := flag.Bool("dev", false, "to print developer logs or not") // to determine in dev-mode or not
 	flflag := flag.String("file", "", "path to the `.torrent` file")     // `.torrent file path`
+	mgflag := flag.String("magnet", "", "magnet URI of the torrent")     // magnet link, instead of a `.torrent` file
+	dhtflag := flag.Bool("dht", true, "to use DHT or not")               // DHT peer discovery (BEP 5)
+	dnflag := flag.String("dht-nodes", ".dht_nodes", "file to persist the DHT node table in")
+	lsdflag := flag.Bool("lsd", true, "to find peers on the local network or not")
+	utpflag := flag.Bool("utp", true, "to connect to peers over uTP too, or only over TCP")
+	encflag := flag.String("encryption", "prefer", "encryption of the peer connections, prefer, require or disabled")
+	ptflag := flag.Uint("port", 6881, "port to listen on for incoming peer connections")
+	ipflag := flag.String("ip", "", "IP address to report to the trackers (optional)")
+	ip6flag := flag.String("ipv6", "", "IPv6 address to report to the trackers (optional)")
+	sdflag := flag.Bool("seed", false, "to keep seeding after the download completes")
+	rsflag := flag.Bool("fast-resume", true, "to use a fast-resume file or not")
+	pkflag := flag.String("picker", "rarest", "piece selection strategy, rarest, random or sequential")
+	slflag := flag.Uint("upload-slots", 4, "number of peers to upload to at once")
+	dirflag := flag.String("dir", "", "directory to download the files into")
 
 	flag.Parse()
 
+	config = src.Config{
+		Port:        uint16(*ptflag),
+		IP:          net.ParseIP(*ipflag),
+		IPv6:        net.ParseIP(*ip6flag),
+		DataDir:     *dirflag,
+		Picker:      *pkflag,
+		FastResume:  *rsflag,
+		DHT:         *dhtflag,
+		DHTNodes:    *dnflag,
+		LSD:         *lsdflag,
+		UTP:         *utpflag,
+		Encryption:  *encflag,
+		UploadSlots: int(*slflag),
+	}
+	seedAfter = *sdflag
+
 	torrFn = *flflag
+	magnetURI = *mgflag
 	output.DevMode = *devflag
 }
 
-// variables to store data about download stats .
-var (
-	TotalPieceCount      int
-	DownloadedPieceCount int
-	TotalDataSize        int
-	DownloadedDataSize   int
-	DownloadStarted      bool
-)
-
 func main() {
-	// if no `--file` value provided reading the `.torrent`
-	// file path as the 2nd command-line arguements
-	if torrFn == "" {
-		if len(os.Args) < 2 {
-			panic("no `.torrent` file provided")
+	// `scrape` subcommand, prints what the trackers know about the torrents
+	if flag.Arg(0) == "scrape" {
+		if flag.NArg() < 2 {
+			panic("no `.torrent` file or magnet link provided to scrape")
 		}
-		torrFn = os.Args[1]
-	}
-
-	// print stats (different goroutine)
-	iv := true
-	go PrintStats(&iv)
-
-	// reading the `.torrent` file
-	err := src.ReadFile(torrFn)
-	if err != nil {
-		panic(fmt.Errorf("unable to read data from `.torrent` file, %v", err))
+		scrape(flag.Args()[1:])
+		return
 	}
 
-	// set total piece count to what read on the `.torrent` file,
-	TotalPieceCount = len(src.Torr.Pieces)
-
-	ch1 := make(chan error) // holds tracker request error, when requested in a different goroutine
-	var peers []*src.Peer   // holds pointers to `src.Peer` corresponding to each peer
-
-	// retrieving information about peers from tracker server
-	go func(prs *[]*src.Peer, c chan error) {
-		*prs, err = src.GetPeers()
-		c <- err
-	}(&peers, ch1)
-
-	// generating `src.Block` for each peers
-	for _, piece := range src.Torr.Pieces {
-		piece.GenBlocks()
+	// if no `--file` or `--magnet` value provided reading the `.torrent`
+	// file path (or a magnet link) as the 2nd command-line arguements
+	if torrFn == "" && magnetURI == "" {
+		if flag.NArg() < 1 {
+			panic("no `.torrent` file or magnet link provided")
+		}
+		if strings.HasPrefix(flag.Arg(0), "magnet:") {
+			magnetURI = flag.Arg(0)
+		} else {
+			torrFn = flag.Arg(0)
+		}
 	}
 
-	// generating PFMap, mapping of piece and files, that determines
-	// in which file/files teh piece data needs to be written
-	src.Torr.GenPFMap()
+	// cancelled on SIGINT/SIGTERM, to stop downloading and leave the swarm
+	// cleanly, a second signal exits right away (without the cleanup)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Println("\nStopping..")
+		cancel()
+		<-sigs
+		os.Exit(1)
+	}()
+
+	// print stats (different goroutine), the torrent is handed over to
+	// it once the metadata has been read
+	iv := true
+	torrs := make(chan *src.Torrent, 1)
+	go PrintStats(ctx, torrs, &iv)
 
-	// handling tracker request response (if error)
-	err = <-ch1
+	// the client accepts connections from other peers, and
+	// runs a DHT node (if enabled) on the same port number
+	client, err := src.NewClient(config)
 	if err != nil {
-		panic(err)
-	}
-
-	// seeders holds the pointer to the peers from which data can be downloaded
-	seeders := AllSeeders{}
-	seeders.Find(peers)
-
-	// wait as long as there's no peeris ready/available to share files
-	for seeders.Len() < 1 {
-		time.Sleep(1 * time.Second)
+		panic(fmt.Errorf("unable to start the client, %v", err))
 	}
 
-	// DownloadStarted indicates file download has started or not
-	DownloadStarted = true
-
-	// `AllSeeders.Download` efficiently downloads pieces
-	// of data from all the seeders concurrently
-	seeders.Download(src.Torr)
+	// stopping the client saves the resume state, and sends the `stopped` announces
+	defer client.Close()
 
-	fmt.Println("\nDownload Complete!")
-
-}
+	var t *src.Torrent
 
-// PrintStats peints and updates stats about download process
-// it requires a boolean as arguemnt for not so necessary reasons
-func PrintStats(iv *bool) {
-	ticker := time.Tick(time.Second)
-	for {
-		<-ticker
-		perc := float64(DownloadedPieceCount) / float64(TotalPieceCount) * 100
-		var status string
-		if DownloadStarted {
-			status = "Downloading.."
-		} else {
-			status = "Getting info.."
+	if magnetURI != "" {
+		// reading the magnet link, and downloading the metadata from the peers
+		t, err = client.AddMagnet(ctx, magnetURI)
+		if err == context.Canceled {
+			return
 		}
-
-		if *iv == true {
-			*iv = false
-			status += "."
-		} else {
-			status += " "
-			*iv = true
+		if err != nil {
+			panic(fmt.Errorf("unable to read metadata from the magnet link, %v", err))
+		}
+	} else {
+		// reading the `.torrent` file
+		t, err = client.AddTorrent(torrFn)
+		if err != nil {
+			panic(fmt.Errorf("unable to read data from `.torrent` file, %v", err))
 		}
-
-		fmt.Printf("\rDownloaded %.2f%%\tPieces %d/%d\t%v\t", float64(perc), DownloadedPieceCount, TotalPieceCount, status)
 	}
-}
-
-// AllSeeders is a slice of pointers to peers from which pieces
-// of data can be downloaded (peers that has unchoked the client)
-type AllSeeders []*src.Peer
+	torrs <- t
+
+	// downloading all the pieces, that aren't on disk already
+	if err := t.Download(ctx); err == context.Canceled {
+		return
+	} else if err != nil {
+		fmt.Printf("\n%v\n", err)
+		client.Close()
+		os.Exit(1)
+	}
 
-// Len returns the length of `Seeders`
-func (as *AllSeeders) Len() int {
-	return len(*as)
-}
+	fmt.Println("\nDownload Complete!")
 
-// Active checks and returns the number of
-// seeders where peer connection is alive
-func (as *AllSeeders) Active() int {
-	x := 0
-	for _, s := range *as {
-		if s.IsAlive() {
-			x++
-		}
+	// with `--seed`, keep uploading to the other peers until stopped
+	if seedAfter {
+		fmt.Println("Seeding..")
+		<-ctx.Done()
 	}
-	return x
 }
 
-/*
-Find is gonna disconnect with all the peers
-and reestablish connection with all of them again
-*/
-func (as *AllSeeders) Find(peers []*src.Peer) {
-	for _, p := range peers {
-		go func(p *src.Peer) {
-			err := p.Ping()
-			if err == nil {
-				(*as) = append(*as, p)
+// scrape asks the trackers of each torrent (`.torrent` file or magnet link) for the
+// number of seeders and leechers it has, and prints them, a line for each tracker
+func scrape(args []string) {
+	for _, arg := range args {
+		var infohash []byte
+		trackers := []*url.URL{}
+
+		if strings.HasPrefix(arg, "magnet:") {
+			m, err := src.ParseMagnet(arg)
+			if err != nil {
+				fmt.Printf("%v, %v\n", arg, err)
+				continue
 			}
-		}(p)
-	}
-}
-
-// Download downloads each of `src.Torr.Pieces` from the seeder
-func (as *AllSeeders) Download(torr *src.Torrent) {
-	var done bool
-
-	go func(done *bool) {
-		for {
-			time.Sleep(1 * time.Second)
-
-			// if all the pieces are downloaded then break the loop
-			dn, comp := isDownComplete(torr.Pieces)
-
-			// print how many pieces has been downloaded yet, and reset `pidx = 0`
-			output.DevInfof("[%v] out of [%v] pieces has been downloaded", dn, len(torr.Pieces))
-			DownloadedPieceCount = dn
-
-			if comp == true {
-				output.DevInfof("all [%v] pieces has been downloaded **[DONE]**", dn)
-				*done = true
-				break
+			infohash, trackers = m.InfoHash, m.Trackers
+		} else {
+			t := &src.Torrent{}
+			if err := t.ReadFile(arg); err != nil {
+				fmt.Printf("%v, %v\n", arg, err)
+				continue
+			}
+			infohash = t.InfoHash
+			for _, tier := range t.AnnounceList {
+				trackers = append(trackers, tier...)
 			}
 		}
-	}(&done)
 
-	pidx := 0 // current piece index
-	sidx := 0 // current seeder/peer index
+		fmt.Printf("%x\n", infohash)
 
-	for !done {
-		time.Sleep(100 * time.Millisecond)
+		for _, tr := range trackers {
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			res, err := src.Scrape(ctx, tr, [][]byte{infohash})
+			cancel()
 
-		// when all the pieces are covered, reseting the `pidx = 0`
-		if pidx >= len(torr.Pieces) {
-			pidx = 0
+			switch sr, ok := res[string(infohash)]; {
+			case err != nil:
+				fmt.Printf("  %v\t%v\n", tr, err)
+			case !ok:
+				fmt.Printf("  %v\tunknown torrent\n", tr)
+			default:
+				fmt.Printf("  %v\tseeders %v\tleechers %v\tdownloaded %v\n", tr, sr.Complete, sr.Incomplete, sr.Downloaded)
+			}
 		}
+	}
+}
 
-		// if all the seeder's are covered onc more time, reset `sidx = 0`
-		if sidx >= len(*as) {
-			sidx = 0
-		}
+// PrintStats peints and updates stats about download process, of the torrent received
+// on the channel, until the context gets cancelled. It requires a boolean as arguemnt
+// for not so necessary reasons
+func PrintStats(ctx context.Context, torrs <-chan *src.Torrent, iv *bool) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-		// pointer to the piece that has to be downloaded
-		piece := src.Torr.Pieces[pidx]
+	// the torrent being downloaded, nil until the metadata has been read
+	var t *src.Torrent
 
-		// if piece is currently downloading or has alreay been downloaded, then go to the next piece
-		if piece.Status == src.PieceStatusDownloaded || piece.Status == src.PieceStatusRequested {
-			pidx++
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t = <-torrs:
 			continue
+		case <-ticker.C:
 		}
 
-		// pointer to the peer
-		seeder := (*as)[sidx]
-
-		// if peer is available for download and has the piece, then request the piece from it
-		if seeder.IsFree() && seeder.HasPiece(pidx) {
-			output.DevInfof("requesting piece of index %v | to %v:%v\n", piece.Index, seeder.IP, seeder.Port)
-
-			// downloading teh piece in a different goroutine
-			go func(s *src.Peer, p *src.Piece) {
-				_, err := s.DownloadPiece(p)
-				switch err {
-				case nil:
-					// pass
-				case src.ErrPeerDisconnected:
-					go s.Ping()
-				default:
-					output.DevErrorf("%v\n", err)
-				}
-			}(seeder, piece)
-
-			// to go to the next-piece
-			pidx++
-
-		} else if !seeder.IsAlive() {
-			// if peer connection is closed, then reestablish the connection
-			go seeder.Ping()
+		// number of pieces downloaded, and the total number of pieces
+		dn, tot := 0, 0
+		started := false
+		if t != nil {
+			dn, tot = t.Downloaded(), len(t.Pieces)
+			started = t.Started()
 		}
 
-		// next-seeder
-		sidx++
-	}
-}
+		perc := float64(0)
+		if tot > 0 {
+			perc = float64(dn) / float64(tot) * 100
+		}
 
-// isDownComplete checks if all the pieces are downloaded
-func isDownComplete(pieces []*src.Piece) (int, bool) {
-	boo := true // boo == true, all pieces are downloaded (none left)
-	dn := 0     // number of pieces to be downloaded
+		var status string
+		if started {
+			status = "Downloading.."
+		} else {
+			status = "Getting info.."
+		}
 
-	for _, p := range pieces {
-		if p.Status == src.PieceStatusDownloaded {
-			dn++
+		if *iv == true {
+			*iv = false
+			status += "."
 		} else {
-			// if any piece is yet to be downloaded, set `boo = false`
-			boo = false
+			status += " "
+			*iv = true
 		}
-	}
 
-	return dn, boo
+		fmt.Printf("\rDownloaded %.2f%%\tPieces %d/%d\t%v\t", float64(perc), dn, tot, status)
+	}
 }
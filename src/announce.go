@@ -0,0 +1,134 @@
+package src
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+/*
+startAnnouncing starts the announce loop of the torrent, that keeps announcing
+to the trackers for as long as we are in the swarm (see `announce`). The peers
+that the trackers send back are handed over to the seeders. The error of the
+first round (see `GetPeers`) is sent on the returned channel, nil if any of
+the trackers (or the DHT) responded
+*/
+func (t *Torrent) startAnnouncing(ctx context.Context, ss *seeders) <-chan error {
+	ctx, cancel := context.WithCancel(ctx)
+	t.annStop, t.annDone = cancel, make(chan struct{})
+
+	first := make(chan error, 1)
+	go t.announce(ctx, ss, first)
+	return first
+}
+
+// stopAnnouncing stops the announce loop, and waits for it to return
+func (t *Torrent) stopAnnouncing() {
+	if t.annStop == nil {
+		return
+	}
+	t.annStop()
+	<-t.annDone
+}
+
+/*
+announce sends the `started` announce to all the trackers (and looks up the DHT) first,
+then the regular announces to each tracker, once it's `interval` has passed since the
+last one. When the download completes, the `completed` event is sent to all the trackers
+right away. The trackers that haven't responded to the `started` announce yet get that
+instead. The trackers that are due are announced to at once, and the peers each of them
+sends back are handed over to the seeders as soon as it responds. Each round is capped
+at `AnnounceTimeout`. It returns once the context is cancelled, the `stopped` event is
+sent by `Torrent.Stop`
+*/
+func (t *Torrent) announce(ctx context.Context, ss *seeders, first chan<- error) {
+	defer close(t.annDone)
+
+	// the first round, the seeders connect to the peers while it's still going on
+	_, err := t.GetPeers(ctx, EventStarted, func(prs []*Peer) { ss.find(ctx, prs) })
+	if ctx.Err() != nil {
+		return
+	}
+	first <- err
+
+	// saving the DHT nodes, for the next run to skip bootstrapping
+	t.client.saveDHTNodes()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// the `completed` event is only sent if the download completes while
+	// we're in the swarm, not if the files were complete to begin with
+	completed := t.Complete()
+
+	type result struct {
+		tier  []*url.URL
+		tr    *url.URL
+		event string
+		peers []*Peer
+		err   error
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		event := EventNone
+		if !completed && t.Complete() {
+			completed = true
+			event = EventCompleted
+		}
+
+		rctx, cancel := context.WithTimeout(ctx, AnnounceTimeout)
+		ch := make(chan result)
+		n := 0
+
+		for _, tier := range t.AnnounceList {
+			for _, tr := range tier {
+				st := t.tracker(tr.String())
+				t.mu.Lock()
+				due, ev := time.Now().After(st.next), event
+				if !st.started {
+					ev = EventStarted
+				}
+				t.mu.Unlock()
+
+				if event == EventNone && !due {
+					continue
+				}
+
+				n++
+				go func(tier []*url.URL, tr *url.URL, ev string) {
+					prs, err := t.GetPeersFrom(rctx, tr, ev)
+					ch <- result{tier, tr, ev, prs, err}
+				}(tier, tr, ev)
+			}
+		}
+
+		// the tiers only get reordered here, once all the requests are sent
+		for ; n > 0; n-- {
+			r := <-ch
+			if ctx.Err() != nil {
+				continue
+			}
+			if r.err != nil {
+				output.DevWarnf("tracker request failed, %v | %v\n", r.err, r.tr)
+				continue
+			}
+			promoteTracker(r.tier, r.tr)
+
+			output.DevInfof("announced (%v), %v peers | %v\n", r.event, len(r.peers), r.tr)
+
+			// new peers are only of use, as long as there's something to download
+			if !t.Complete() {
+				ss.find(ctx, r.peers)
+			}
+		}
+		cancel()
+	}
+}
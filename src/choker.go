@@ -0,0 +1,246 @@
+package src
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+// ChokeInterval is how often the upload slots are given out again
+var ChokeInterval = 10 * time.Second
+
+// OptimisticInterval is how often the optimistic unchoke moves on to another peer
+var OptimisticInterval = 30 * time.Second
+
+// SnubTimeout is how long a peer can go without sending us a block (while
+// we are interested in it), before it counts as snubbing us
+var SnubTimeout = time.Minute
+
+// NewPeerTime is how long a peer counts as newly connected, the new peers are three times
+// as likely to get the optimistic unchoke, as they have no pieces to trade with yet
+var NewPeerTime = time.Minute
+
+/*
+Choker decides which peers we upload to, with the tit-for-tat algorithm of BitTorrent.
+Every `ChokeInterval` the interested peers that have sent us the most data since the
+last round get the upload slots, and everyone else gets choked. Once we are seeding
+there's nothing to download, so it's the peers that we have sent the most to (the
+ones that can take it the fastest).
+
+One of the slots is the optimistic unchoke, a random choked peer that it moves to
+every `OptimisticInterval`. It gives the new peers their first pieces, and lets us
+find peers that are better to trade with than the ones we have. The peers that are
+snubbing us (see `SnubTimeout`) don't get a regular slot, only the optimistic one
+*/
+type Choker struct {
+	Slots int // number of peers unchoked at once, the optimistic unchoke included
+
+	t          *Torrent
+	mu         sync.Mutex
+	stats      map[*Peer]*chokeStats // of the connected peers, as of the last round
+	optimistic *Peer                 // the peer with the optimistic unchoke, nil if none
+	rotated    time.Time             // when the optimistic unchoke moved last
+	last       time.Time             // when the last round was
+}
+
+// chokeStats are the byte counters of a peer as they were at the last round,
+// the rate since the round before it, and when the peer sent us a block last
+type chokeStats struct {
+	downloaded int64
+	uploaded   int64
+	rate       float64   // bytes per second, downloaded from the peer (uploaded to it when seeding)
+	progress   time.Time // when we got a block from the peer last, or weren't interested in it
+}
+
+// NewChoker creates the choker of the torrent, with the number of upload slots
+func NewChoker(t *Torrent, slots int) *Choker {
+	return &Choker{
+		Slots: slots,
+		t:     t,
+		stats: make(map[*Peer]*chokeStats),
+		last:  time.Now(),
+	}
+}
+
+// Run does a round every `ChokeInterval`, until the context gets cancelled
+func (c *Choker) Run(ctx context.Context) {
+	tk := time.NewTicker(ChokeInterval)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tk.C:
+		}
+
+		c.Rechoke()
+	}
+}
+
+/*
+Rechoke does a round of choking. The rates are measured from the byte counters
+of the peers (`Downloaded` and `Uploaded`) since the last round, the interested
+peers are sorted by them and the fastest ones (that aren't snubbing us) get the
+regular slots. Then the optimistic unchoke is moved (if it's due), and the
+rest of the peers get choked
+*/
+func (c *Choker) Rechoke() {
+	c.mu.Lock()
+
+	now := time.Now()
+	el := now.Sub(c.last).Seconds()
+	c.last = now
+	seeding := c.t.Complete()
+
+	peers := c.t.Peers()
+	stats := make(map[*Peer]*chokeStats, len(peers))
+	candidates := []*Peer{}
+
+	for _, p := range peers {
+		if !p.IsAlive() {
+			continue
+		}
+
+		down := atomic.LoadInt64(&p.Downloaded)
+		up := atomic.LoadInt64(&p.Uploaded)
+
+		st := c.stats[p]
+		if st == nil {
+			// a new peer, with no rate yet
+			st = &chokeStats{downloaded: down, uploaded: up, progress: now}
+		} else {
+			if seeding {
+				st.rate = float64(up-st.uploaded) / el
+			} else {
+				st.rate = float64(down-st.downloaded) / el
+			}
+			if down > st.downloaded || !p.AmInterested() {
+				st.progress = now
+			}
+			st.downloaded, st.uploaded = down, up
+		}
+		stats[p] = st
+
+		if p.PeerInterested() {
+			candidates = append(candidates, p)
+		}
+	}
+
+	// the disconnected peers drop out
+	c.stats = stats
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return stats[candidates[i]].rate > stats[candidates[j]].rate
+	})
+
+	// the regular slots, snubbing doesn't matter once we are seeding
+	unchoke := make(map[*Peer]bool)
+	for _, p := range candidates {
+		if len(unchoke) >= c.Slots-1 {
+			break
+		}
+		if !seeding && p.AmInterested() && now.Sub(stats[p].progress) > SnubTimeout {
+			output.DevInfof("peer is snubbing us | %v:%v\n", p.IP, p.Port)
+			continue
+		}
+		unchoke[p] = true
+	}
+
+	// the optimistic unchoke stays with it's peer for `OptimisticInterval`, unless
+	// the peer goes away, isn't interested anymore or has earned a regular slot
+	if c.optimistic != nil && (stats[c.optimistic] == nil || !c.optimistic.PeerInterested() || unchoke[c.optimistic]) {
+		c.optimistic = nil
+	}
+	if c.optimistic == nil || now.Sub(c.rotated) >= OptimisticInterval {
+		c.optimistic = c.pickOptimistic(candidates, unchoke, now)
+		c.rotated = now
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	// the slots change while the lock is held (so `Interested` counts them right),
+	// the messages are sent after, a slow peer shouldn't hold up the choker
+	changed := []*Peer{}
+	for _, p := range peers {
+		if p.setChoking(!unchoke[p]) {
+			changed = append(changed, p)
+		}
+	}
+
+	c.mu.Unlock()
+
+	for _, p := range changed {
+		if err := p.sendChoking(!unchoke[p]); err != nil {
+			output.DevWarnf("couldn't send choke/unchoke, %v | %v:%v\n", err, p.IP, p.Port)
+		}
+	}
+}
+
+// pickOptimistic picks a random interested peer that didn't get a regular slot, for the
+// optimistic unchoke. The peers connected within `NewPeerTime` count three times
+func (c *Choker) pickOptimistic(candidates []*Peer, unchoke map[*Peer]bool, now time.Time) *Peer {
+	weights := make([]int, len(candidates))
+	total := 0
+	for i, p := range candidates {
+		if unchoke[p] {
+			continue
+		}
+		weights[i] = 1
+		p.mu.Lock()
+		connectedAt := p.connectedAt
+		p.mu.Unlock()
+		if now.Sub(connectedAt) < NewPeerTime {
+			weights[i] = 3
+		}
+		total += weights[i]
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Intn(total)
+	for i, w := range weights {
+		if n < w {
+			return candidates[i]
+		}
+		n -= w
+	}
+	return nil
+}
+
+// Interested gives a peer that has just become interested an upload slot right
+// away if there's a free one, rather than having it wait for the next round. The
+// slot is taken before the lock is released, so two peers can't both get the last one
+func (c *Choker) Interested(p *Peer) error {
+	c.mu.Lock()
+	n := 0
+	for _, q := range c.t.Peers() {
+		if q != p && q.PeerInterested() && !q.Choking() {
+			n++
+		}
+	}
+
+	if n >= c.Slots || !p.setChoking(false) {
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+
+	return p.sendChoking(false)
+}
+
+// startChoking starts the choker of the torrent, it runs until `Stop` gets called
+func (t *Torrent) startChoking() {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.chokeStop = cancel
+
+	go t.choker.Run(ctx)
+}
@@ -0,0 +1,229 @@
+package src
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chokerTorrent creates a torrent with a single piece, downloaded if it's seeding
+func chokerTorrent(seeding bool) *Torrent {
+	tr := &Torrent{peers: make(map[*Peer]bool)}
+	pc := &Piece{Index: 0, Length: 16384, t: tr}
+	if seeding {
+		pc.status = PieceStatusDownloaded
+	}
+	tr.Pieces = []*Piece{pc}
+	return tr
+}
+
+// chokerPeer connects a fake peer to the torrent, that we are interested in, the
+// messages sent to it are discarded
+func chokerPeer(t *testing.T, tr *Torrent, interested bool) *Peer {
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	go io.Copy(io.Discard, b)
+
+	p := &Peer{Torrent: tr, IP: net.IPv4(127, 0, 0, 1), Port: uint16(len(tr.peers) + 1)}
+	p.open(a)
+	p.amInterested, p.peerInterested = true, interested
+	tr.peers[p] = true
+	return p
+}
+
+// unchoked returns the peers that we aren't choking
+func unchoked(tr *Torrent) map[*Peer]bool {
+	m := make(map[*Peer]bool)
+	for _, p := range tr.Peers() {
+		if !p.Choking() {
+			m[p] = true
+		}
+	}
+	return m
+}
+
+// rechokeAfter does a round to get the byte counters, adds the bytes to the peers (downloaded
+// and uploaded) and does another round, so the rates of the second one are of those bytes
+func rechokeAfter(c *Choker, bytes map[*Peer][2]int64) {
+	c.Rechoke()
+	time.Sleep(20 * time.Millisecond)
+	for p, b := range bytes {
+		atomic.AddInt64(&p.Downloaded, b[0])
+		atomic.AddInt64(&p.Uploaded, b[1])
+	}
+	c.Rechoke()
+}
+
+func TestChokerSlots(t *testing.T) {
+	interval := OptimisticInterval
+	defer func() { OptimisticInterval = interval }()
+	OptimisticInterval = 0 // the optimistic unchoke moves every round
+
+	tr := chokerTorrent(false)
+	c := NewChoker(tr, 4)
+
+	// six interested peers, the faster the later, and one that isn't interested
+	bytes := make(map[*Peer][2]int64)
+	peers := []*Peer{}
+	for i := 1; i <= 6; i++ {
+		p := chokerPeer(t, tr, true)
+		peers = append(peers, p)
+		bytes[p] = [2]int64{int64(i) * 1000, 0}
+	}
+	bored := chokerPeer(t, tr, false)
+	bytes[bored] = [2]int64{100000, 0}
+
+	rechokeAfter(c, bytes)
+
+	un := unchoked(tr)
+	if len(un) != c.Slots {
+		t.Fatalf("%v peers unchoked, want %v", len(un), c.Slots)
+	}
+	for _, p := range peers[3:] {
+		if !un[p] || p == c.optimistic {
+			t.Fatalf("peer %v didn't get a regular slot", p.Port)
+		}
+	}
+	if c.optimistic == nil || !un[c.optimistic] || bytes[c.optimistic][0] > 3000 {
+		t.Fatal("the optimistic unchoke isn't one of the slower peers")
+	}
+	if un[bored] {
+		t.Fatal("a peer that isn't interested got unchoked")
+	}
+}
+
+func TestChokerSnubbed(t *testing.T) {
+	snub, interval := SnubTimeout, OptimisticInterval
+	defer func() { SnubTimeout, OptimisticInterval = snub, interval }()
+	SnubTimeout = 10 * time.Millisecond
+	OptimisticInterval = time.Hour
+
+	tests := []struct {
+		name       string
+		seeding    bool
+		interested bool // if we are interested in the peer that doesn't send us anything
+		regular    bool // if the peer gets a regular slot anyway
+	}{
+		{"snubbing us", false, true, false},
+		{"not interested in it", false, false, true},
+		{"seeding", true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := chokerTorrent(tt.seeding)
+			c := NewChoker(tr, 3)
+
+			// the peer that sends us nothing, and one that does
+			idle, fast := chokerPeer(t, tr, true), chokerPeer(t, tr, true)
+			idle.amInterested = tt.interested
+
+			rechokeAfter(c, map[*Peer][2]int64{fast: {1000, 0}})
+
+			// there's a regular slot to spare, the optimistic unchoke doesn't count
+			regular := unchoked(tr)[idle] && c.optimistic != idle
+			if regular != tt.regular {
+				t.Fatalf("regular slot %v, want %v", regular, tt.regular)
+			}
+			if !unchoked(tr)[fast] {
+				t.Fatal("the peer that sends us blocks got choked")
+			}
+		})
+	}
+}
+
+func TestChokerRates(t *testing.T) {
+	interval := OptimisticInterval
+	defer func() { OptimisticInterval = interval }()
+	OptimisticInterval = time.Hour
+
+	tests := []struct {
+		name    string
+		seeding bool
+		want    int // index of the peer that gets the regular slot
+	}{
+		// downloading, the peer that sends us the most
+		{"downloading", false, 1},
+		// seeding, the peer that we send the most to
+		{"seeding", true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := chokerTorrent(tt.seeding)
+			c := NewChoker(tr, 2)
+
+			peers := []*Peer{chokerPeer(t, tr, true), chokerPeer(t, tr, true), chokerPeer(t, tr, true)}
+			rechokeAfter(c, map[*Peer][2]int64{
+				peers[0]: {0, 5000},
+				peers[1]: {5000, 1000},
+				peers[2]: {1000, 0},
+			})
+
+			for i, p := range peers {
+				regular := unchoked(tr)[p] && c.optimistic != p
+				if regular != (i == tt.want) {
+					t.Fatalf("peer %v has a regular slot %v", i, regular)
+				}
+			}
+		})
+	}
+}
+
+func TestPickOptimistic(t *testing.T) {
+	tr := chokerTorrent(false)
+	c := NewChoker(tr, 4)
+
+	// a new peer, one that has been connected for long, and one with a regular slot
+	fresh, old, busy := chokerPeer(t, tr, true), chokerPeer(t, tr, true), chokerPeer(t, tr, true)
+	old.connectedAt = time.Now().Add(-2 * NewPeerTime)
+	candidates := []*Peer{fresh, old, busy}
+	unchoke := map[*Peer]bool{busy: true}
+
+	// the new peer is three times as likely to get picked, 3 in 4
+	n := 4000
+	picks := make(map[*Peer]int)
+	for i := 0; i < n; i++ {
+		picks[c.pickOptimistic(candidates, unchoke, time.Now())]++
+	}
+
+	if picks[busy] != 0 || picks[nil] != 0 {
+		t.Fatalf("picked the peer with a regular slot %v times, none %v times", picks[busy], picks[nil])
+	}
+	if share := float64(picks[fresh]) / float64(n); share < 0.7 || share > 0.8 {
+		t.Fatalf("the new peer got %.2f of the picks, want 0.75", share)
+	}
+
+	// nobody to pick
+	if p := c.pickOptimistic([]*Peer{busy}, unchoke, time.Now()); p != nil {
+		t.Fatal("picked a peer with a regular slot")
+	}
+}
+
+func TestChokerInterested(t *testing.T) {
+	tr := chokerTorrent(false)
+	c := NewChoker(tr, 2)
+
+	// the peers become interested all at once, only two of them can get a slot
+	peers := []*Peer{}
+	for i := 0; i < 8; i++ {
+		peers = append(peers, chokerPeer(t, tr, true))
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *Peer) {
+			defer wg.Done()
+			c.Interested(p)
+		}(p)
+	}
+	wg.Wait()
+
+	if n := len(unchoked(tr)); n != c.Slots {
+		t.Fatalf("%v peers unchoked, want %v", n, c.Slots)
+	}
+}
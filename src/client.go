@@ -1,45 +1,340 @@
 package src
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/ritsource/torrent-client/output"
 )
 
-// Something ...
-var (
-	PeerID        string
-	ClientIP      net.IP
-	ClientPort    uint32
-	TransactionID uint32
-)
+// Config holds the settings of a `Client`, the zero values are replaced with the defaults
+type Config struct {
+	PeerID      string // 20-byte peer id, generated if empty
+	Port        uint16 // port to listen on for incoming peers (and for the DHT), 6881 by default
+	IP          net.IP // IP address to report to the trackers (optional)
+	IPv6        net.IP // IPv6 address to report to the trackers, if we have one (optional)
+	NumWant     int    // number of peers to ask each tracker for, 40 by default
+	DataDir     string // directory where the downloaded files are written, the working directory by default
+	Picker      string // piece selection strategy, "rarest" (default), "random" or "sequential"
+	FastResume  bool   // to save (and load) a fast-resume file for each torrent, in `DataDir`
+	DHT         bool   // to find peers in the DHT or not
+	DHTNodes    string // file to persist the DHT node table in (optional)
+	LSD         bool   // to find peers on the local network or not (BEP 14)
+	UTP         bool   // to connect to (and accept) peers over uTP too, not only TCP (BEP 29)
+	NoListen    bool   // not to accept incoming peer connections
+	Encryption  string // encryption policy of the peer connections (MSE), "prefer" (default), "require" or "disabled"
+	UploadSlots int    // number of peers we upload to at once (see `Choker`), 4 by default
+}
+
+// StopTimeout is how long `Client.Close` waits on the trackers, for the `stopped` announces
+var StopTimeout = 5 * time.Second
+
+/*
+Client is a BitTorrent client, that downloads (and seeds) any number of torrents at
+once. All the torrents share the peer id, the listening port and the DHT node. The
+incoming peer connections are handed to the torrent matching the handshake's infohash
+*/
+type Client struct {
+	Config Config
+	PeerID string // 20-byte peer id
+	DHT    *DHT   // DHT node for peer discovery, nil if disabled
+	LSD    *LSD   // local service discovery, nil if disabled
+	UTP    *UTP   // uTP socket, on the DHT's UDP port, nil if disabled
+
+	listeners []net.Listener // over IPv4, and IPv6 (if available)
+	mu        sync.Mutex
+	torrents  map[string]*Torrent // by infohash
+}
+
+/*
+NewClient creates a client with the config. It starts accepting peer connections
+on the port (over both IPv4 and IPv6), and starts the DHT node and the uTP socket
+(sharing the same port, over UDP) if enabled
+*/
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.PeerID == "" {
+		cfg.PeerID = GenPeerID()
+	}
+	if len(cfg.PeerID) != 20 {
+		return nil, fmt.Errorf("peer id has to be 20 bytes long, %q", cfg.PeerID)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 6881
+	}
+	if cfg.NumWant == 0 {
+		cfg.NumWant = 40
+	}
+	if cfg.UploadSlots <= 0 {
+		cfg.UploadSlots = 4
+	}
+	if cfg.Picker == "" {
+		cfg.Picker = "rarest"
+	}
+	if _, err := NewPicker(cfg.Picker); err != nil {
+		return nil, err
+	}
+	switch cfg.Encryption {
+	case "":
+		cfg.Encryption = EncryptionPrefer
+	case EncryptionPrefer, EncryptionRequire, EncryptionDisabled:
+	default:
+		return nil, fmt.Errorf("unknown encryption policy, %v", cfg.Encryption)
+	}
+
+	c := &Client{
+		Config:   cfg,
+		PeerID:   cfg.PeerID,
+		torrents: make(map[string]*Torrent),
+	}
+
+	addr := ":" + strconv.Itoa(int(cfg.Port))
+
+	// accepting connections from other peers, on the port that gets announced
+	// to the trackers, for them to download from us. IPv6 is optional, as the
+	// machine might not have an IPv6 address at all
+	if !cfg.NoListen {
+		for _, network := range []string{"tcp4", "tcp6"} {
+			ln, err := net.Listen(network, addr)
+			if err != nil && network == "tcp4" {
+				return nil, err
+			}
+			if err != nil {
+				output.DevWarnf("couldn't listen for IPv6 peers, %v\n", err)
+				continue
+			}
+			c.listeners = append(c.listeners, ln)
+			go c.accept(ln)
+		}
+	}
 
-func init() {
-	var err error
+	// starting a DHT node, with the nodes saved in the last run
+	if cfg.DHT {
+		d, err := NewDHT(addr)
+		if err != nil {
+			output.DevWarnf("couldn't start the dht node, %v\n", err)
+		} else {
+			if cfg.DHTNodes != "" {
+				if err := d.LoadNodes(cfg.DHTNodes); err != nil {
+					output.DevInfof("no saved dht nodes, %v\n", err)
+				}
+			}
+			c.DHT = d
+		}
+	}
 
-	// random seed
-	rand.Seed(time.Now().UnixNano())
+	// uTP shares the UDP socket with the DHT (a KRPC message is a bencoded
+	// dictionary, so it starts with a 'd', a uTP packet never does), or gets
+	// a socket of it's own if the DHT is disabled
+	if cfg.UTP {
+		if c.DHT != nil {
+			c.UTP = NewUTP(c.DHT.Conn, !cfg.NoListen)
+			c.DHT.Fallback = c.UTP.Handle
+		} else if u, err := ListenUTP(addr, !cfg.NoListen); err != nil {
+			output.DevWarnf("couldn't start the utp socket, %v\n", err)
+		} else {
+			go u.Serve()
+			c.UTP = u
+		}
 
-	// new peer id, to be generated once for every download
-	PeerID = GenPeerID()
+		if c.UTP != nil && !cfg.NoListen {
+			go c.accept(c.UTP)
+		}
+	}
 
-	// the client's IP-address
-	ClientIP, err = GetClientIP()
-	if err != nil {
-		panic(fmt.Errorf("%v", err))
+	if c.DHT != nil {
+		go c.DHT.Serve()
 	}
 
-	// in this application, we are not gonna focused
-	// handling requests from other clients. So, just
-	// a static port to be used in the tracker-request
-	ClientPort = 6881
+	// announcing our torrents on the local network, the peers there
+	// have the same data much closer to us than the rest of the swarm
+	if cfg.LSD {
+		l, err := NewLSD(cfg.Port, c.infohashes, c.localPeer)
+		if err != nil {
+			output.DevWarnf("couldn't start local service discovery, %v\n", err)
+		} else {
+			go l.Serve()
+			c.LSD = l
+		}
+	}
 
-	// fmt.Printf("%s\n", PeerID)
+	return c, nil
+}
 
-	TransactionID = uint32(time.Now().Unix())
+// AddTorrent adds the torrent of a `.torrent` file to the client
+func (c *Client) AddTorrent(fn string) (*Torrent, error) {
+	t := c.newTorrent()
+	if err := t.ReadFile(fn); err != nil {
+		return nil, err
+	}
+	return t, c.add(t)
+}
+
+/*
+AddMagnet adds the torrent of a magnet link to the client. The metadata is
+downloaded from the peers first, so it can take a while to return (or until
+the context gets cancelled)
+*/
+func (c *Client) AddMagnet(ctx context.Context, uri string) (*Torrent, error) {
+	t := c.newTorrent()
+	if err := t.ReadMagnet(ctx, uri); err != nil {
+		return nil, err
+	}
+	return t, c.add(t)
+}
+
+// Torrents returns all the torrents added to the client
+func (c *Client) Torrents() []*Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ts := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+/*
+Close stops accepting peer connections and stops all the torrents (see
+`Torrent.Stop`), concurrently, waiting at most `StopTimeout` for the
+trackers. Then it stops the DHT node (the node table gets saved)
+*/
+func (c *Client) Close() error {
+	for _, ln := range c.listeners {
+		ln.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), StopTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, t := range c.Torrents() {
+		wg.Add(1)
+		go func(t *Torrent) {
+			defer wg.Done()
+			t.Stop(ctx)
+		}(t)
+	}
+	wg.Wait()
+
+	if c.LSD != nil {
+		c.LSD.Close()
+	}
+
+	if c.UTP != nil {
+		c.UTP.Close()
+	}
+
+	if c.DHT != nil {
+		c.saveDHTNodes()
+		return c.DHT.Close()
+	}
+	return nil
+}
+
+// saveDHTNodes saves the DHT node table, for the next run to skip bootstrapping
+func (c *Client) saveDHTNodes() {
+	if c.DHT == nil || c.Config.DHTNodes == "" {
+		return
+	}
+	if err := c.DHT.SaveNodes(c.Config.DHTNodes); err != nil {
+		output.DevWarnf("couldn't save dht nodes, %v\n", err)
+	}
+}
+
+// newTorrent creates an empty torrent, that belongs to the client
+func (c *Client) newTorrent() *Torrent {
+	t := &Torrent{client: c, peers: make(map[*Peer]bool)}
+	t.avail = &Availability{t: t}
+	t.Picker, _ = NewPicker(c.Config.Picker)
+	t.choker = NewChoker(t, c.Config.UploadSlots)
+	return t
+}
+
+/*
+add prepares a torrent that has been read for downloading, and adds it to the
+client. The pieces that are already on disk (from an earlier run) are marked
+as downloaded, so only the rest gets downloaded. The torrent is registered with
+the client only once it's prepared, so the peers (and the local announces) never
+find a torrent without it's blocks or it's piece-file map
+*/
+func (c *Client) add(t *Torrent) error {
+	// not preparing a duplicate for nothing, it's checked again when registering
+	if c.torrent(t.InfoHash) != nil {
+		return fmt.Errorf("torrent has already been added, %x", t.InfoHash)
+	}
+
+	// the files are written in the data directory
+	for _, f := range t.Files {
+		f.Path = filepath.Join(c.Config.DataDir, f.Path)
+	}
+
+	// generating `Block` for each piece
+	for _, piece := range t.Pieces {
+		piece.GenBlocks()
+	}
+
+	// generating PFMap, mapping of piece and files, that determines
+	// in which file/files teh piece data needs to be written
+	t.GenPFMap()
+	if err := t.CreateEmptyFiles(); err != nil {
+		output.DevWarnf("couldn't create the empty files, %v\n", err)
+	}
+
+	// picking up where the last run left off
+	if c.Config.FastResume {
+		t.ResumeFile = filepath.Join(c.Config.DataDir, fmt.Sprintf(".%x.resume", t.InfoHash))
+	}
+	t.Resume(t.ResumeFile)
+
+	// registering the torrent, unless the same torrent has been added in the meantime
+	c.mu.Lock()
+	if _, ok := c.torrents[string(t.InfoHash)]; ok {
+		c.mu.Unlock()
+		return fmt.Errorf("torrent has already been added, %x", t.InfoHash)
+	}
+	c.torrents[string(t.InfoHash)] = t
+	c.mu.Unlock()
+
+	// uploading to the peers, for as long as the torrent is in the client
+	t.startChoking()
+
+	return nil
+}
+
+// infohashes returns the infohashes of all the torrents, for announcing on the local network
+func (c *Client) infohashes() [][]byte {
+	ihs := [][]byte{}
+	for _, t := range c.Torrents() {
+		ihs = append(ihs, t.InfoHash)
+	}
+	return ihs
+}
+
+// localPeer adds a peer found on the local network to the torrent with the infohash,
+// the local peers are connected to (and downloaded from) before the rest
+func (c *Client) localPeer(infohash []byte, p *Peer) {
+	t := c.torrent(infohash)
+	if t == nil {
+		return
+	}
+
+	p.Local = true
+	t.addPeers([]*Peer{p})
+}
+
+// torrent returns the torrent with the infohash, nil if there's no such torrent
+func (c *Client) torrent(infohash []byte) *Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.torrents[string(infohash)]
 }
 
 // GenPeerID generates a psudorandom peer-ID
@@ -56,15 +351,3 @@ func GenPeerID() string {
 	// "-TC0001-" is client's unique id and version information
 	return "-TC0001-" + string(b)
 }
-
-// GetClientIP retrives the host machine's IP-address
-func GetClientIP() (net.IP, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		output.DevErrorf("couldn't read client's IP-address, %v\n", err)
-		return nil, err
-	}
-	defer conn.Close()
-
-	return conn.LocalAddr().(*net.UDPAddr).IP, nil
-}
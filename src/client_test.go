@@ -0,0 +1,88 @@
+package src
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/marksamman/bencode"
+)
+
+func TestClientAdd(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewClient(Config{NoListen: true, DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the data is on disk already (from an earlier run), so
+	// the torrent is only prepared once all of it is rechecked
+	data := make([]byte, 1024*16384)
+	rand.Read(data)
+	if err := os.WriteFile(filepath.Join(dir, "a"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hashes := []byte{}
+	for i := 0; i < len(data); i += 16384 {
+		h := sha1.Sum(data[i : i+16384])
+		hashes = append(hashes, h[:]...)
+	}
+
+	fn := filepath.Join(dir, "a.torrent")
+	dict := metainfo("files", 16384, []string{"a"}, []int{len(data)})
+	dict["info"].(map[string]interface{})["pieces"] = string(hashes)
+	if err := os.WriteFile(fn, bencode.Encode(dict), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// adding the same torrent at once, watching for it to
+	// show up in the client (it has to be prepared by then)
+	tr := &Torrent{}
+	if err := tr.ReadFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	unprepared := make(chan bool, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				unprepared <- false
+				return
+			default:
+			}
+			if t := c.torrent(tr.InfoHash); t != nil && !t.Complete() {
+				unprepared <- true
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added := 0
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.AddTorrent(fn); err == nil {
+				mu.Lock()
+				added++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+
+	if <-unprepared {
+		t.Fatal("the torrent was in the client before it was prepared")
+	}
+	if added != 1 || len(c.Torrents()) != 1 {
+		t.Fatalf("added %v times, %v torrents in the client", added, len(c.Torrents()))
+	}
+}
@@ -0,0 +1,745 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marksamman/bencode"
+	"github.com/ritsource/torrent-client/output"
+)
+
+// DHTBootstrapNodes are the well known nodes used to join the DHT network
+var DHTBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+// DHTQueryTimeout is how long to wait for a node to respond to a query
+var DHTQueryTimeout = 3 * time.Second
+
+// dhtAlpha is the number of concurrent queries during an iterative lookup
+const dhtAlpha = 3
+
+// dhtPeerExpiry is how long the peers announced to us are stored
+var dhtPeerExpiry = 30 * time.Minute
+
+// dhtSecretRotation is the interval after which the token secret changes, the
+// tokens generated with the previous secret are still accepted until next rotation
+var dhtSecretRotation = 5 * time.Minute
+
+// errDHTTimeout is returned when a node doesn't respond to a query in time
+var errDHTTimeout = errors.New("dht query timed out")
+
+// KRPC error codes
+const (
+	krpcGenericError  = 201
+	krpcProtocolError = 203
+	krpcMethodUnknown = 204
+)
+
+/*
+DHT is a node of the mainline DHT (BEP 5), a Kademlia based distributed hash
+table that stores peer addresses for infohashes. Every node has a 160-bit id,
+and the peers for an infohash are stored on the nodes closest to the infohash.
+Nodes talk to each other with KRPC, bencoded dictionaries sent over UDP
+*/
+type DHT struct {
+	ID    []byte        // 20-byte node id
+	Conn  *net.UDPConn  // the UDP socket the node listens on
+	Table *RoutingTable // the nodes we know about
+
+	// Fallback gets the datagrams that aren't KRPC messages, when
+	// the socket is shared (with uTP), it's set before `Serve`
+	Fallback func(b []byte, addr *net.UDPAddr)
+
+	mu      sync.Mutex
+	tid     uint16                                 // last transaction id
+	pending map[string]chan map[string]interface{} // "transaction-id/address" -> response channel
+	store   map[string]map[string]time.Time        // infohash -> compact peer address -> announce time
+	secrets [2][]byte                              // current and previous token secret
+	rotated time.Time                              // when was the secret rotated
+	closed  bool
+}
+
+// NewDHT creates a DHT node with a random id, listening on the given UDP address
+func NewDHT(addr string) (*DHT, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 20)
+	rand.Read(id)
+
+	d := &DHT{
+		ID:      id,
+		Conn:    conn,
+		Table:   NewRoutingTable(id),
+		pending: make(map[string]chan map[string]interface{}),
+		store:   make(map[string]map[string]time.Time),
+	}
+	d.rotateSecret()
+	d.rotateSecret()
+
+	return d, nil
+}
+
+// Close stops the DHT node
+func (d *DHT) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	return d.Conn.Close()
+}
+
+// Addr returns the UDP address the node is listening on
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.Conn.LocalAddr().(*net.UDPAddr)
+}
+
+/*
+Serve reads KRPC messages from the UDP socket, answers the queries
+and hands over the responses to the goroutines waiting for them. It
+blocks until the node is closed
+*/
+func (d *DHT) Serve() error {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := d.Conn.ReadFromUDP(buf)
+		if err != nil {
+			d.mu.Lock()
+			closed := d.closed
+			d.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		// KRPC messages are bencoded dictionaries
+		if n > 0 && buf[0] != 'd' {
+			if d.Fallback != nil {
+				d.Fallback(buf[:n], addr)
+			}
+			continue
+		}
+
+		msg, err := bencode.Decode(bytes.NewReader(buf[:n]))
+		if err != nil {
+			continue
+		}
+
+		t, _ := msg["t"].(string)
+		y, _ := msg["y"].(string)
+
+		switch y {
+		case "q":
+			d.handleQuery(t, msg, addr)
+		case "r", "e":
+			d.mu.Lock()
+			ch, ok := d.pending[t+"/"+addr.String()]
+			d.mu.Unlock()
+			if ok {
+				select {
+				case ch <- msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+/*
+Bootstrap joins the DHT network through the given nodes. It asks them
+for the nodes closest to our own id and then does an iterative lookup
+of our own id, which fills up the routing table. It fails if none of
+the bootstrap nodes respond (the nodes already in the table don't count,
+they might all be stale). Cancelling the context abandons the bootstrap
+*/
+func (d *DHT) Bootstrap(ctx context.Context, addrs []string) error {
+	var wg sync.WaitGroup
+	var responded int32
+	for _, a := range addrs {
+		addr, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			output.DevWarnf("couldn't resolve dht bootstrap node, %v\n", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			if _, err := d.FindNode(ctx, addr, d.ID); err == nil {
+				atomic.AddInt32(&responded, 1)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if responded == 0 {
+		return fmt.Errorf("couldn't reach any of the dht bootstrap nodes")
+	}
+
+	d.lookup(ctx, d.ID, false)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	output.DevInfof("dht bootstrapped, %v nodes in the routing table\n", d.Table.Len())
+	return nil
+}
+
+// Ping sends a `ping` query to a node
+func (d *DHT) Ping(ctx context.Context, addr *net.UDPAddr) error {
+	_, err := d.query(ctx, addr, "ping", map[string]interface{}{})
+	return err
+}
+
+// FindNode sends a `find_node` query to a node, and returns the nodes it responded with
+func (d *DHT) FindNode(ctx context.Context, addr *net.UDPAddr, target []byte) ([]*DHTNode, error) {
+	r, err := d.query(ctx, addr, "find_node", map[string]interface{}{"target": string(target)})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, _ := r["nodes"].(string)
+	return d.addNodes(parseCompactNodes([]byte(nodes))), nil
+}
+
+/*
+GetPeers finds the peers for an infohash, with an iterative `get_peers` lookup
+towards the infohash. If the port is not 0, we also announce ourselves (on that
+port) to the closest nodes that responded, so other peers can find us. The
+lookup (and the bootstrap, if there's one) stops early if the context gets cancelled.
+
+The routing table might be loaded from an earlier run (see `LoadNodes`), if none of
+it's nodes respond to the lookup they have all gone stale, so the node bootstraps
+again (through `DHTBootstrapNodes`) and does the lookup once more
+*/
+func (d *DHT) GetPeers(ctx context.Context, infohash []byte, port uint16) ([]*Peer, error) {
+	bootstrapped := false
+	if d.Table.Len() == 0 {
+		if err := d.Bootstrap(ctx, DHTBootstrapNodes); err != nil {
+			return nil, err
+		}
+		bootstrapped = true
+	}
+
+	nodes, peers := d.lookup(ctx, infohash, true)
+	if ctx.Err() != nil {
+		return peers, ctx.Err()
+	}
+
+	if len(nodes) == 0 && !bootstrapped {
+		output.DevInfof("none of the dht nodes in the table responded, bootstrapping again\n")
+		if err := d.Bootstrap(ctx, DHTBootstrapNodes); err != nil {
+			return peers, err
+		}
+
+		nodes, peers = d.lookup(ctx, infohash, true)
+		if ctx.Err() != nil {
+			return peers, ctx.Err()
+		}
+	}
+
+	// the announces aren't waited for, they go on after the lookup's context is done
+	// with (they don't take longer than `DHTQueryTimeout` though)
+	if port != 0 {
+		for _, ln := range nodes {
+			if ln.token == "" {
+				continue
+			}
+			go d.query(context.Background(), ln.node.Addr, "announce_peer", map[string]interface{}{
+				"info_hash":    string(infohash),
+				"port":         int(port),
+				"token":        ln.token,
+				"implied_port": 0,
+			})
+		}
+	}
+
+	output.DevInfof("found %v peers in the dht\n", len(peers))
+	return peers, nil
+}
+
+// lookupNode is a node in the shortlist of an iterative lookup
+type lookupNode struct {
+	node    *DHTNode
+	token   string // token from `get_peers` response, needed to announce
+	queried bool
+	failed  bool
+}
+
+/*
+lookup does an iterative lookup towards the target. It starts with the closest
+nodes from the routing table and keeps querying (`dhtAlpha` at a time) the closest
+nodes it hasn't queried yet, until the K closest nodes have all been queried. With
+`getPeers` it sends `get_peers` queries and collects the peers, else `find_node`.
+It returns the closest nodes that responded, and the peers found (so far, if
+the context gets cancelled)
+*/
+func (d *DHT) lookup(ctx context.Context, target []byte, getPeers bool) ([]*lookupNode, []*Peer) {
+	shortlist := []*lookupNode{}
+	seen := make(map[string]bool)
+
+	add := func(nodes []*DHTNode) {
+		for _, n := range nodes {
+			if seen[string(n.ID)] || bytes.Equal(n.ID, d.ID) {
+				continue
+			}
+			seen[string(n.ID)] = true
+			shortlist = append(shortlist, &lookupNode{node: n})
+		}
+	}
+	add(d.Table.Closest(target, DHTBucketSize))
+
+	peers := []*Peer{}
+	peerset := make(map[string]bool)
+
+	type result struct {
+		ln    *lookupNode
+		nodes []*DHTNode
+		peers []*Peer
+		token string
+		err   error
+	}
+
+	for round := 0; round < 32 && ctx.Err() == nil; round++ {
+
+		// the K closest nodes, that haven't failed
+		sortLookupNodes(shortlist, target)
+		closest := []*lookupNode{}
+		for _, ln := range shortlist {
+			if !ln.failed {
+				closest = append(closest, ln)
+			}
+			if len(closest) == DHTBucketSize {
+				break
+			}
+		}
+
+		// picking `dhtAlpha` of them to query
+		batch := []*lookupNode{}
+		for _, ln := range closest {
+			if !ln.queried {
+				ln.queried = true
+				batch = append(batch, ln)
+			}
+			if len(batch) == dhtAlpha {
+				break
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		ch := make(chan result, len(batch))
+		for _, ln := range batch {
+			go func(ln *lookupNode) {
+				res := result{ln: ln}
+				if getPeers {
+					var r map[string]interface{}
+					r, res.err = d.query(ctx, ln.node.Addr, "get_peers", map[string]interface{}{"info_hash": string(target)})
+					if res.err == nil {
+						nodes, _ := r["nodes"].(string)
+						res.nodes = d.addNodes(parseCompactNodes([]byte(nodes)))
+						res.token, _ = r["token"].(string)
+						vals, _ := r["values"].([]interface{})
+						for _, v := range vals {
+							if s, ok := v.(string); ok && len(s) == 18 {
+								res.peers = append(res.peers, parseCompactPeers6([]byte(s))...)
+							} else if ok {
+								res.peers = append(res.peers, parseCompactPeers([]byte(s))...)
+							}
+						}
+					}
+				} else {
+					res.nodes, res.err = d.FindNode(ctx, ln.node.Addr, target)
+				}
+				ch <- res
+			}(ln)
+		}
+
+		for range batch {
+			res := <-ch
+			if res.err != nil {
+				res.ln.failed = true
+				continue
+			}
+			res.ln.token = res.token
+			add(res.nodes)
+			for _, p := range res.peers {
+				key := net.JoinHostPort(p.IP.String(), fmt.Sprint(p.Port))
+				if !peerset[key] {
+					peerset[key] = true
+					peers = append(peers, p)
+				}
+			}
+		}
+	}
+
+	// the closest nodes that responded
+	sortLookupNodes(shortlist, target)
+	responded := []*lookupNode{}
+	for _, ln := range shortlist {
+		if ln.queried && !ln.failed {
+			responded = append(responded, ln)
+		}
+		if len(responded) == DHTBucketSize {
+			break
+		}
+	}
+
+	return responded, peers
+}
+
+// sortLookupNodes sorts the lookup shortlist by distance to the target
+func sortLookupNodes(lns []*lookupNode, target []byte) {
+	nodes := make([]*DHTNode, len(lns))
+	idx := make(map[*DHTNode]*lookupNode, len(lns))
+	for i, ln := range lns {
+		nodes[i] = ln.node
+		idx[ln.node] = ln
+	}
+	sortByDistance(nodes, target)
+	for i, n := range nodes {
+		lns[i] = idx[n]
+	}
+}
+
+/*
+query sends a KRPC query to a node and waits for the response. If the node
+responds, it gets added to (or refreshed in) the routing table. Returns the
+`r` dictionary of the response. It gives up waiting if the context gets cancelled
+*/
+func (d *DHT) query(ctx context.Context, addr *net.UDPAddr, q string, args map[string]interface{}) (map[string]interface{}, error) {
+	d.mu.Lock()
+	d.tid++
+	t := string([]byte{byte(d.tid >> 8), byte(d.tid)})
+	key := t + "/" + addr.String()
+	ch := make(chan map[string]interface{}, 1)
+	d.pending[key] = ch
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, key)
+		d.mu.Unlock()
+	}()
+
+	args["id"] = string(d.ID)
+	err := d.send(addr, map[string]interface{}{"t": t, "y": "q", "q": q, "a": args})
+	if err != nil {
+		return nil, err
+	}
+
+	var msg map[string]interface{}
+	select {
+	case msg = <-ch:
+	case <-time.After(DHTQueryTimeout):
+		for _, n := range d.Table.Nodes() {
+			if n.Addr.String() == addr.String() {
+				d.Table.Failed(n.ID)
+			}
+		}
+		return nil, errDHTTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if msg["y"] == "e" {
+		return nil, fmt.Errorf("dht error response, %v", msg["e"])
+	}
+
+	r, ok := msg["r"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid dht response")
+	}
+	id, _ := r["id"].(string)
+	if len(id) != 20 {
+		return nil, fmt.Errorf("invalid node id in dht response")
+	}
+
+	d.Table.Insert(&DHTNode{ID: []byte(id), Addr: addr, LastSeen: time.Now()})
+	return r, nil
+}
+
+// handleQuery answers a KRPC query from another node
+func (d *DHT) handleQuery(t string, msg map[string]interface{}, addr *net.UDPAddr) {
+	q, _ := msg["q"].(string)
+	a, ok := msg["a"].(map[string]interface{})
+	if !ok {
+		d.sendError(addr, t, krpcProtocolError, "missing arguments")
+		return
+	}
+	id, _ := a["id"].(string)
+	if len(id) != 20 {
+		d.sendError(addr, t, krpcProtocolError, "invalid node id")
+		return
+	}
+
+	r := map[string]interface{}{"id": string(d.ID)}
+
+	switch q {
+	case "ping":
+		// pass
+
+	case "find_node":
+		target, _ := a["target"].(string)
+		if len(target) != 20 {
+			d.sendError(addr, t, krpcProtocolError, "invalid target")
+			return
+		}
+		r["nodes"] = string(compactNodes(d.Table.Closest([]byte(target), DHTBucketSize)))
+
+	case "get_peers":
+		ih, _ := a["info_hash"].(string)
+		if len(ih) != 20 {
+			d.sendError(addr, t, krpcProtocolError, "invalid info_hash")
+			return
+		}
+		r["token"] = string(d.token(addr.IP, 0))
+
+		if vals := d.storedPeers(ih, addr.IP); len(vals) > 0 {
+			r["values"] = vals
+		} else {
+			r["nodes"] = string(compactNodes(d.Table.Closest([]byte(ih), DHTBucketSize)))
+		}
+
+	case "announce_peer":
+		ih, _ := a["info_hash"].(string)
+		token, _ := a["token"].(string)
+		port, _ := a["port"].(int64)
+		implied, _ := a["implied_port"].(int64)
+		if len(ih) != 20 {
+			d.sendError(addr, t, krpcProtocolError, "invalid info_hash")
+			return
+		}
+		if !d.validToken(addr.IP, token) {
+			d.sendError(addr, t, krpcProtocolError, "invalid token")
+			return
+		}
+		if implied != 0 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(addr, t, krpcProtocolError, "invalid port")
+			return
+		}
+		d.storePeer(ih, addr.IP, uint16(port))
+
+	default:
+		d.sendError(addr, t, krpcMethodUnknown, "method unknown")
+		return
+	}
+
+	d.Table.Insert(&DHTNode{ID: []byte(id), Addr: addr, LastSeen: time.Now()})
+	d.send(addr, map[string]interface{}{"t": t, "y": "r", "r": r})
+}
+
+// send writes a bencoded KRPC message to a node
+func (d *DHT) send(addr *net.UDPAddr, msg map[string]interface{}) error {
+	_, err := d.Conn.WriteToUDP(bencode.Encode(msg), addr)
+	return err
+}
+
+// sendError sends a KRPC error message
+func (d *DHT) sendError(addr *net.UDPAddr, t string, code int, s string) {
+	d.send(addr, map[string]interface{}{"t": t, "y": "e", "e": []interface{}{code, s}})
+}
+
+// addNodes adds the nodes to the routing table (unverified nodes get in only
+// if there's space), returns the nodes as is for the lookup to query them
+func (d *DHT) addNodes(nodes []*DHTNode) []*DHTNode {
+	for _, n := range nodes {
+		d.Table.Insert(&DHTNode{ID: n.ID, Addr: n.Addr, LastSeen: time.Now().Add(-DHTNodeExpiry)})
+	}
+	return nodes
+}
+
+// rotateSecret changes the token secret, keeping the previous one
+func (d *DHT) rotateSecret() {
+	s := make([]byte, 20)
+	rand.Read(s)
+	d.secrets[1] = d.secrets[0]
+	d.secrets[0] = s
+	d.rotated = time.Now()
+}
+
+// token generates the token for an IP address, the SHA1 hash of the IP and a secret
+func (d *DHT) token(ip net.IP, i int) []byte {
+	d.mu.Lock()
+	if time.Since(d.rotated) > dhtSecretRotation {
+		d.rotateSecret()
+	}
+	secret := d.secrets[i]
+	d.mu.Unlock()
+
+	h, _ := GetSHA1(append([]byte(ip.String()), secret...))
+	return h
+}
+
+// validToken checks if the token was given to the IP address, with the current or previous secret
+func (d *DHT) validToken(ip net.IP, token string) bool {
+	return token == string(d.token(ip, 0)) || token == string(d.token(ip, 1))
+}
+
+// storePeer saves a peer announced for an infohash, in compact form (6
+// bytes for an IPv4 address, 18 for an IPv6 one, same as the `values`)
+func (d *DHT) storePeer(ih string, ip net.IP, port uint16) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	cp := make([]byte, len(ip)+2)
+	copy(cp, ip)
+	binary.BigEndian.PutUint16(cp[len(ip):], port)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.store[ih] == nil {
+		d.store[ih] = make(map[string]time.Time)
+	}
+	d.store[ih][string(cp)] = time.Now()
+}
+
+/*
+storedPeers returns the (non-expired) peers announced for an infohash, in compact
+form. Only the peers of the same address family as the node asking are returned
+(BEP 32), an IPv4 node can't connect to an IPv6 peer anyway
+*/
+func (d *DHT) storedPeers(ih string, ip net.IP) []interface{} {
+	size := 18
+	if ip.To4() != nil {
+		size = 6
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vals := []interface{}{}
+	for cp, t := range d.store[ih] {
+		if time.Since(t) > dhtPeerExpiry {
+			delete(d.store[ih], cp)
+			continue
+		}
+		if len(cp) == size {
+			vals = append(vals, cp)
+		}
+	}
+	return vals
+}
+
+/*
+SaveNodes writes our node id and the nodes in the routing table to a file, so
+the next run can use the same id and skip bootstrapping. The file holds a bencoded
+dictionary with `id` and `nodes` (compact node info, same as in KRPC responses)
+*/
+func (d *DHT) SaveNodes(fn string) error {
+	data := bencode.Encode(map[string]interface{}{
+		"id":    string(d.ID),
+		"nodes": string(compactNodes(d.Table.Nodes())),
+	})
+	return ioutil.WriteFile(fn, data, 0644)
+}
+
+// LoadNodes reads the node id and the nodes saved by `SaveNodes`,
+// it has to be called before `Serve` as it changes the node id
+func (d *DHT) LoadNodes(fn string) error {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	dict, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	id, _ := dict["id"].(string)
+	if len(id) != 20 {
+		return fmt.Errorf("invalid node id in %v", fn)
+	}
+	d.ID = []byte(id)
+	d.Table = NewRoutingTable(d.ID)
+
+	nodes, _ := dict["nodes"].(string)
+	for _, n := range parseCompactNodes([]byte(nodes)) {
+		d.Table.Insert(n)
+	}
+
+	output.DevInfof("loaded %v dht nodes from %v\n", d.Table.Len(), fn)
+	return nil
+}
+
+// compactNodes encodes the nodes in compact node info format, 26 bytes
+// for each node, 20-byte node id + 4-byte IP address + 2-byte port
+func compactNodes(nodes []*DHTNode) []byte {
+	buf := new(bytes.Buffer)
+	for _, n := range nodes {
+		ip4 := n.Addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		buf.Write(n.ID)
+		buf.Write(ip4)
+		binary.Write(buf, binary.BigEndian, uint16(n.Addr.Port))
+	}
+	return buf.Bytes()
+}
+
+// parseCompactNodes decodes compact node info
+func parseCompactNodes(b []byte) []*DHTNode {
+	nodes := []*DHTNode{}
+	for i := 0; i+26 <= len(b); i += 26 {
+		nodes = append(nodes, &DHTNode{
+			ID:   append([]byte{}, b[i:i+20]...),
+			Addr: &net.UDPAddr{IP: net.IP(append([]byte{}, b[i+20:i+24]...)), Port: int(binary.BigEndian.Uint16(b[i+24 : i+26]))},
+		})
+	}
+	return nodes
+}
+
+// parseCompactPeers decodes compact peer info, 6 bytes for each
+// peer, 4-byte IP address + 2-byte port
+func parseCompactPeers(b []byte) []*Peer {
+	return parseCompact(b, net.IPv4len)
+}
+
+// parseCompactPeers6 decodes compact IPv6 peer info (BEP 7), 18 bytes
+// for each peer, 16-byte IP address + 2-byte port
+func parseCompactPeers6(b []byte) []*Peer {
+	return parseCompact(b, net.IPv6len)
+}
+
+// parseCompact decodes compact peer info, with IP addresses of the length
+func parseCompact(b []byte, iplen int) []*Peer {
+	peers := []*Peer{}
+	for i := 0; i+iplen+2 <= len(b); i += iplen + 2 {
+		peers = append(peers, &Peer{
+			IP:   net.IP(append([]byte{}, b[i:i+iplen]...)),
+			Port: binary.BigEndian.Uint16(b[i+iplen : i+iplen+2]),
+		})
+	}
+	return peers
+}
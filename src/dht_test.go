@@ -0,0 +1,213 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestDHT starts a DHT node on loopback, it gets closed when the test ends
+func newTestDHT(t *testing.T) *DHT {
+	d, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve()
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// hasPeer checks if the peer with the port is among the peers
+func hasPeer(peers []*Peer, port uint16) bool {
+	for _, p := range peers {
+		if p.IP.Equal(net.IPv4(127, 0, 0, 1)) && p.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// waitPeer does `get_peers` lookups until the peer with the port is found (the
+// announces are sent in the background), or a second has passed
+func waitPeer(t *testing.T, d *DHT, ih []byte, port uint16) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		peers, err := d.GetPeers(context.Background(), ih, 0)
+		if err == nil && hasPeer(peers, port) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer not found, %v peers, %v", len(peers), err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDHTPing(t *testing.T) {
+	a, b := newTestDHT(t), newTestDHT(t)
+
+	if err := a.Ping(context.Background(), b.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// both sides know each other now
+	if a.Table.Len() != 1 || b.Table.Len() != 1 {
+		t.Fatalf("table sizes %v, %v", a.Table.Len(), b.Table.Len())
+	}
+}
+
+func TestDHTFindNode(t *testing.T) {
+	a, b, c := newTestDHT(t), newTestDHT(t), newTestDHT(t)
+
+	// b learns about c
+	if err := c.Ping(context.Background(), b.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := a.FindNode(context.Background(), b.Addr(), c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, n := range nodes {
+		found = found || (bytes.Equal(n.ID, c.ID) && n.Addr.Port == c.Addr().Port)
+	}
+	if !found {
+		t.Fatalf("c not in the find_node response, %v nodes", len(nodes))
+	}
+}
+
+func TestDHTGetPeersAnnounce(t *testing.T) {
+	router := newTestDHT(t)
+	nodes := []*DHT{}
+	for i := 0; i < 5; i++ {
+		d := newTestDHT(t)
+		if err := d.Ping(context.Background(), router.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, d)
+	}
+
+	ih := make([]byte, 20)
+	rand.Read(ih)
+
+	// nobody has announced yet
+	peers, err := nodes[0].GetPeers(context.Background(), ih, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("%v peers before any announce", len(peers))
+	}
+
+	// announcing port 6881, through the closest nodes that responded
+	if _, err := nodes[1].GetPeers(context.Background(), ih, 6881); err != nil {
+		t.Fatal(err)
+	}
+
+	waitPeer(t, nodes[2], ih, 6881)
+}
+
+func TestDHTStaleTable(t *testing.T) {
+	timeout, bootstrap := DHTQueryTimeout, DHTBootstrapNodes
+	defer func() { DHTQueryTimeout, DHTBootstrapNodes = timeout, bootstrap }()
+	DHTQueryTimeout = 200 * time.Millisecond
+
+	router, other := newTestDHT(t), newTestDHT(t)
+	if err := other.Ping(context.Background(), router.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	DHTBootstrapNodes = []string{router.Addr().String()}
+
+	ih := make([]byte, 20)
+	rand.Read(ih)
+	if _, err := other.GetPeers(context.Background(), ih, 7000); err != nil {
+		t.Fatal(err)
+	}
+	waitPeer(t, other, ih, 7000)
+
+	// a node with a table of nodes that are all gone (as if loaded from a
+	// `.dht_nodes` file of an old run), nothing listens on the port anymore
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+
+	d := newTestDHT(t)
+	id := make([]byte, 20)
+	rand.Read(id)
+	d.Table.Insert(&DHTNode{ID: id, Addr: dead, LastSeen: time.Now()})
+
+	// a single lookup has to get through, by bootstrapping again
+	peers, err := d.GetPeers(context.Background(), ih, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasPeer(peers, 7000) {
+		t.Fatalf("peer not found with a stale table, %v peers", len(peers))
+	}
+}
+
+func TestDHTCancel(t *testing.T) {
+	timeout, bootstrap := DHTQueryTimeout, DHTBootstrapNodes
+	defer func() { DHTQueryTimeout, DHTBootstrapNodes = timeout, bootstrap }()
+	DHTQueryTimeout = time.Minute
+
+	// a bootstrap node that never responds
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	DHTBootstrapNodes = []string{silent.LocalAddr().String()}
+
+	// the lookup has to give up once the context is cancelled, not after the query timeout
+	d := newTestDHT(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = d.GetPeers(ctx, make([]byte, 20), 0)
+	if el := time.Since(start); el > 2*time.Second {
+		t.Fatalf("lookup took %v after the context was cancelled", el)
+	}
+	if err == nil {
+		t.Fatal("no error, with the context cancelled")
+	}
+}
+
+func TestDHTStoreIPv6(t *testing.T) {
+	d := newTestDHT(t)
+	ih := string(make([]byte, 20))
+	d.storePeer(ih, net.IPv4(127, 0, 0, 1), 7000)
+	d.storePeer(ih, net.ParseIP("2001:db8::1"), 7001)
+
+	// each node gets the peers of it's own address family only
+	tests := []struct {
+		ip    net.IP
+		peers []*Peer
+	}{
+		{net.IPv4(10, 0, 0, 1), parseCompactPeers([]byte{127, 0, 0, 1, 0x1b, 0x58})},
+		{net.ParseIP("2001:db8::2"), parseCompactPeers6(append(net.ParseIP("2001:db8::1"), 0x1b, 0x59))},
+	}
+	for _, tt := range tests {
+		vals := d.storedPeers(ih, tt.ip)
+		if len(vals) != 1 {
+			t.Fatalf("%v values for %v, want 1", len(vals), tt.ip)
+		}
+		s := vals[0].(string)
+		peers := parseCompactPeers([]byte(s))
+		if len(s) == 18 {
+			peers = parseCompactPeers6([]byte(s))
+		}
+		if len(peers) != 1 || !peers[0].IP.Equal(tt.peers[0].IP) || peers[0].Port != tt.peers[0].Port {
+			t.Fatalf("values %x for %v", s, tt.ip)
+		}
+	}
+}
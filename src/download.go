@@ -0,0 +1,341 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+/*
+Download downloads all the pieces of the torrent that aren't on disk yet. It gets
+peers from the trackers (and the DHT), connects to them, and downloads pieces from
+all the peers that unchoke us concurrently, until every piece is downloaded. The
+fast-resume file gets saved once the download completes.
+
+When the context gets cancelled, the pieces being downloaded are abandoned (the
+ones being written to the files are finished first) and the context's error is
+returned. `Stop` is to be called after that, to leave the swarm cleanly
+*/
+func (t *Torrent) Download(ctx context.Context) error {
+	// nothing to download, if all the pieces were already on disk
+	if t.Complete() {
+		return nil
+	}
+
+	// seeders holds the pointer to the peers from which data can be downloaded,
+	// the peers found through PEX and on the local network are added to it too
+	ss := &seeders{ctx: ctx}
+
+	t.mu.Lock()
+	t.ss = ss
+	t.mu.Unlock()
+
+	// the local peers get connected to while the trackers are being asked
+	if t.client.LSD != nil {
+		t.client.LSD.Announce(t.InfoHash)
+	}
+
+	// the peers from the magnet link (`x.pe`) are connected to right away
+	ss.find(ctx, t.xpeers)
+
+	// announcing to the trackers (and looking up the DHT), from now on until `Stop`
+	// is called. The peers are added to the seeders as each tracker responds, so a
+	// slow tracker doesn't hold up the download. The error is only returned when
+	// none of the trackers could be reached (and there's no chance of finding
+	// peers on the local network either)
+	first := t.startAnnouncing(ctx, ss)
+
+	// wait as long as there's no peer ready/available to share files
+	for ss.len() < 1 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-first:
+			if err != nil && len(t.xpeers) == 0 && t.client.LSD == nil {
+				return fmt.Errorf("couldn't get peers from any of the trackers, %v", err)
+			}
+		case <-time.After(1 * time.Second):
+		}
+	}
+
+	atomic.StoreInt32(&t.started, 1)
+
+	// downloads pieces of data from all the seeders concurrently
+	if err := ss.download(ctx, t); err != nil {
+		return err
+	}
+
+	output.DevInfof("all [%v] pieces has been downloaded **[DONE]**", len(t.Pieces))
+
+	// saving the fast-resume file, so the next run doesn't have to rehash everything
+	if t.ResumeFile != "" {
+		if err := t.SaveResume(t.ResumeFile); err != nil {
+			output.DevWarnf("couldn't save the fast-resume file, %v\n", err)
+		}
+	}
+
+	return nil
+}
+
+/*
+Stop leaves the swarm. It stops the choker, disconnects all the peers, waits for the pieces that
+are being written to the files, saves the fast-resume file and lets the trackers
+know that we are leaving (the `stopped` event). The context limits how long the
+announces can take. It's meant to be called once `Download` has returned
+*/
+func (t *Torrent) Stop(ctx context.Context) {
+	t.stopAnnouncing()
+	if t.chokeStop != nil {
+		t.chokeStop()
+	}
+
+	for _, p := range t.Peers() {
+		p.Disconnect()
+	}
+
+	// the downloads return as soon as their peers are disconnected,
+	// unless the piece is being written, then it gets written first
+	t.wg.Wait()
+
+	if t.ResumeFile != "" {
+		if err := t.SaveResume(t.ResumeFile); err != nil {
+			output.DevWarnf("couldn't save the fast-resume file, %v\n", err)
+		}
+	}
+
+	t.AnnounceStopped(ctx)
+}
+
+// Downloaded returns the number of pieces downloaded yet
+func (t *Torrent) Downloaded() int {
+	n := 0
+	for _, piece := range t.Pieces {
+		if piece.Status() == PieceStatusDownloaded {
+			n++
+		}
+	}
+	return n
+}
+
+// LeftUnknown is what `Left` returns before the metadata of a magnet link has arrived,
+// the size isn't known yet, but a `left` of 0 would make us a seeder to the trackers
+var LeftUnknown int64 = 16384
+
+// Left returns the number of bytes yet to be downloaded
+func (t *Torrent) Left() int64 {
+	// `PieceLen` is set once the metadata is read
+	if t.PieceLen == 0 {
+		return LeftUnknown
+	}
+
+	left := int64(0)
+	for i, piece := range t.Pieces {
+		if piece.Status() != PieceStatusDownloaded {
+			left += int64(t.PieceLength(i))
+		}
+	}
+	return left
+}
+
+// Complete checks if all the pieces are downloaded
+func (t *Torrent) Complete() bool {
+	return t.Downloaded() == len(t.Pieces)
+}
+
+// Started checks if the download has started, that is if
+// any of the peers is ready to share pieces with us
+func (t *Torrent) Started() bool {
+	return atomic.LoadInt32(&t.started) == 1
+}
+
+// seeders holds the pointers to the peers from which pieces
+// of data can be downloaded (peers that has unchoked us)
+type seeders struct {
+	ctx   context.Context // the context of the download
+	mu    sync.Mutex
+	peers []*Peer
+	known map[string]bool // "ip:port" of the peers that are being connected to, or are seeders
+}
+
+// len returns the number of seeders
+func (ss *seeders) len() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return len(ss.peers)
+}
+
+// get returns the seeder at the index
+func (ss *seeders) get(i int) *Peer {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.peers[i]
+}
+
+// local returns a local seeder that is free to download from, nil if there's none
+func (ss *seeders) local() *Peer {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for _, p := range ss.peers {
+		if !p.Local {
+			break
+		}
+		if p.IsFree() && p.IsReady() {
+			return p
+		}
+	}
+	return nil
+}
+
+// find connects with all the peers (concurrently), the ones that unchoke us are
+// added to the seeders. The peers that are already known are skipped
+func (ss *seeders) find(ctx context.Context, peers []*Peer) {
+	for _, p := range peers {
+		addr := net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+
+		ss.mu.Lock()
+		if ss.known == nil {
+			ss.known = make(map[string]bool)
+		}
+		if ss.known[addr] {
+			ss.mu.Unlock()
+			continue
+		}
+		ss.known[addr] = true
+		ss.mu.Unlock()
+
+		go func(p *Peer) {
+			err := p.Ping(ctx)
+
+			ss.mu.Lock()
+			if err == nil && p.Local {
+				// the local peers go first
+				ss.peers = append([]*Peer{p}, ss.peers...)
+			} else if err == nil {
+				ss.peers = append(ss.peers, p)
+			} else {
+				// the peer can be tried again, if a tracker sends it again
+				delete(ss.known, addr)
+			}
+			ss.mu.Unlock()
+		}(p)
+	}
+}
+
+/*
+download goes over the seeders one by one, and requests the piece that the piece
+picker chooses from each free seeder, until all the pieces are downloaded. If the
+context gets cancelled, it waits for the downloads in progress to return, and
+returns the context's error
+*/
+func (ss *seeders) download(ctx context.Context, t *Torrent) error {
+	sidx := 0          // current seeder/peer index
+	localTurn := false // if the last turn was given to a local seeder
+
+	// waiting for the downloads that are still in progress, when
+	// cancelled (so the pieces don't get left half-written)
+	defer t.wg.Wait()
+
+	for !t.Complete() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// the seeders on the local network are a lot faster than the rest, a free
+		// one gets every other turn, the rest of the seeders take turns in between
+		var seeder *Peer
+		if !localTurn {
+			seeder = ss.local()
+		}
+		localTurn = seeder != nil
+		if seeder == nil {
+			// if all the seeder's are covered onc more time, reset `sidx = 0`
+			if sidx >= ss.len() {
+				sidx = 0
+			}
+
+			// pointer to the peer
+			seeder = ss.get(sidx)
+			sidx++
+		}
+
+		// if peer is available for download, then request the piece that the picker chooses
+		if seeder.IsFree() && seeder.IsReady() {
+			t.startDownload(ctx, seeder)
+		} else if !seeder.IsAlive() {
+			// if peer connection is closed, then reestablish the connection
+			go seeder.Ping(ctx)
+		}
+	}
+
+	return nil
+}
+
+/*
+startDownload hands the peer the next piece to download, if it's free. The pieces that
+the peer suggested come first (BEP 6), then the picker's, and in endgame mode one that
+is being downloaded from the other peers. It's called by the download loop, and by
+`DownloadPiece` once all the blocks of it's piece are requested, so the next piece's
+requests go out while the current one's are still in flight. It returns false if the
+peer didn't get a piece
+*/
+func (t *Torrent) startDownload(ctx context.Context, seeder *Peer) bool {
+	// the downloads pick concurrently, two of them shouldn't get the same piece
+	t.pickMu.Lock()
+	defer t.pickMu.Unlock()
+
+	if !seeder.IsReady() || !seeder.reserve() {
+		return false
+	}
+
+	// the pieces that the peer suggested come first (BEP 6), then the picker's
+	piece := suggestedPiece(seeder)
+	if piece == nil {
+		piece = t.Picker.Pick(seeder)
+	}
+
+	// in endgame mode, the pieces that are being downloaded from
+	// the other peers get requested from this peer too
+	if piece == nil && t.InEndgame() {
+		piece = t.EndgamePick(seeder)
+	}
+
+	if piece == nil || seeder.download(piece.Index) != nil {
+		seeder.release()
+		return false
+	}
+
+	output.DevInfof("requesting piece of index %v | to %v:%v\n", piece.Index, seeder.IP, seeder.Port)
+
+	// marking the piece as busy right away, so the next pick doesn't get it again
+	// (the peer stays reserved until the download of the piece registers)
+	piece.SetStatus(PieceStatusRequested)
+
+	// downloading teh piece in a different goroutine
+	t.wg.Add(1)
+	go func(s *Peer, p *Piece) {
+		defer t.wg.Done()
+
+		_, err := s.DownloadPiece(ctx, p)
+		switch err {
+		case nil, context.Canceled:
+			// pass
+		case ErrPeerDisconnected:
+			go s.Ping(ctx)
+		default:
+			output.DevErrorf("%v\n", err)
+		}
+	}(seeder, piece)
+
+	return true
+}
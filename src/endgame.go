@@ -0,0 +1,222 @@
+package src
+
+import "sync"
+
+/*
+pieceDownload is the state of a piece that's being downloaded, shared by all
+the peers downloading it. Normally a piece is downloaded from a single peer,
+but in endgame mode the same piece is requested from multiple peers, and the
+block that arrives first is the one that's kept
+*/
+type pieceDownload struct {
+	mu        sync.Mutex
+	data      []byte                    // the data of the piece, put together from the blocks
+	got       map[uint32]bool           // blocks that has been received, by `Begin` offset
+	requested map[*Peer]map[uint32]bool // blocks requested from each peer, that hasn't arrived yet
+	peers     map[*Peer]bool            // peers downloading the piece
+	done      chan struct{}             // closed once all the blocks has been received
+}
+
+// join adds the peer to the download of the piece,
+// the download state is created if it doesn't exist yet
+func (pc *Piece) join(p *Peer) *pieceDownload {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.dl == nil {
+		pc.dl = &pieceDownload{
+			data:      make([]byte, pc.Length),
+			got:       make(map[uint32]bool),
+			requested: make(map[*Peer]map[uint32]bool),
+			peers:     make(map[*Peer]bool),
+			done:      make(chan struct{}),
+		}
+	}
+	pc.status = PieceStatusRequested
+
+	pc.dl.mu.Lock()
+	pc.dl.peers[p] = true
+	pc.dl.mu.Unlock()
+
+	return pc.dl
+}
+
+/*
+leave removes the peer from the download of the piece. When the last peer
+leaves without the piece being downloaded, it's marked as failed (so it gets
+picked again). The blocks received so far are kept, for the next download
+*/
+func (pc *Piece) leave(p *Peer, dl *pieceDownload) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	dl.mu.Lock()
+	delete(dl.peers, p)
+	delete(dl.requested, p)
+	n := len(dl.peers)
+	dl.mu.Unlock()
+
+	if n == 0 && pc.status != PieceStatusDownloaded {
+		pc.status = PieceStatusFailed
+	}
+}
+
+// reset drops the download state of the piece, the blocks received
+// so far are discarded (when the hash of the data doesn't match)
+func (pc *Piece) reset(dl *pieceDownload) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.dl == dl {
+		pc.dl = nil
+	}
+}
+
+// downloaders returns the number of peers downloading the piece,
+// and if the peer is one of them
+func (pc *Piece) downloaders(p *Peer) (int, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.dl == nil {
+		return 0, false
+	}
+
+	pc.dl.mu.Lock()
+	defer pc.dl.mu.Unlock()
+
+	return len(pc.dl.peers), pc.dl.peers[p]
+}
+
+// unrequested checks if any block of the piece is neither received nor requested from
+// one of the peers, a piece that isn't being downloaded yet counts as unrequested
+func (pc *Piece) unrequested() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.dl == nil {
+		return true
+	}
+
+	pc.dl.mu.Lock()
+	defer pc.dl.mu.Unlock()
+
+	for _, b := range pc.Blocks {
+		if pc.dl.got[b.Begin] {
+			continue
+		}
+		requested := false
+		for _, reqs := range pc.dl.requested {
+			if reqs[b.Begin] {
+				requested = true
+				break
+			}
+		}
+		if !requested {
+			return true
+		}
+	}
+	return false
+}
+
+// setRequested sets the blocks that are requested from the peer, and hasn't arrived yet
+func (dl *pieceDownload) setRequested(p *Peer, pending map[uint32]*Block) {
+	reqs := make(map[uint32]bool, len(pending))
+	for beg := range pending {
+		reqs[beg] = true
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	dl.requested[p] = reqs
+}
+
+// has checks if the block at the offset has been received
+func (dl *pieceDownload) has(begin uint32) bool {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	return dl.got[begin]
+}
+
+/*
+put stores a block of the piece. It returns if the block is new (not received
+from an other peer already), the other peers downloading the piece (to cancel
+their requests for the block), and if it was the last block of the piece
+*/
+func (dl *pieceDownload) put(begin uint32, block []byte, p *Peer, nblocks int) (bool, []*Peer, bool) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.got[begin] {
+		return false, nil, false
+	}
+
+	copy(dl.data[begin:], block)
+	dl.got[begin] = true
+
+	others := []*Peer{}
+	for o := range dl.peers {
+		if o != p {
+			others = append(others, o)
+		}
+	}
+
+	last := len(dl.got) == nblocks
+	if last {
+		close(dl.done)
+	}
+
+	return true, others, last
+}
+
+/*
+InEndgame reports if the download is in endgame mode, that is when all the blocks
+left to download have been requested already. A piece that's being downloaded, but
+has blocks that are still waiting for room in the peer's request queue doesn't count.
+From then on the pieces are requested from every peer that has them, not to wait
+on a single slow peer
+*/
+func (t *Torrent) InEndgame() bool {
+	left := false
+	for _, piece := range t.Pieces {
+		switch piece.Status() {
+		case PieceStatusDefault, PieceStatusFailed:
+			return false
+		case PieceStatusRequested:
+			if piece.unrequested() {
+				return false
+			}
+			left = true
+		}
+	}
+	return left
+}
+
+// EndgamePick picks a piece that's being downloaded from other peers, for the peer
+// to download too (endgame mode). The piece with the fewest peers is picked first
+func (t *Torrent) EndgamePick(p *Peer) *Piece {
+	var best *Piece
+	min := 0
+
+	for i, piece := range t.Pieces {
+		if piece.Status() != PieceStatusRequested || !p.HasPiece(i) {
+			continue
+		}
+		if p.PeerChoking() && !p.AllowedFast(uint32(i)) {
+			continue
+		}
+
+		n, joined := piece.downloaders(p)
+		if joined {
+			continue
+		}
+
+		if best == nil || n < min {
+			best, min = piece, n
+		}
+	}
+
+	return best
+}
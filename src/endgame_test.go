@@ -0,0 +1,170 @@
+package src
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// otherPeer connects another peer to the torrent, that has unchoked us and has all the
+// pieces (same as `downloadingPeer`). The other end of it's connection is returned
+func otherPeer(t *testing.T, tr *Torrent) (*Peer, *Wire) {
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	p := &Peer{Torrent: tr}
+	p.open(a)
+	p.peerChoking = false
+	p.bitfield = make([]bool, len(tr.Pieces))
+	for i := range p.bitfield {
+		p.bitfield[i] = true
+	}
+	return p, NewWire(b)
+}
+
+// readMessages reads the messages from the wire until it's closed, the requests and
+// the cancels are sent to the channels
+func readMessages(w *Wire) (chan *RequestMsg, chan *CancelMsg) {
+	reqs, cancels := make(chan *RequestMsg, 100), make(chan *CancelMsg, 100)
+	go func() {
+		for {
+			msg, err := w.ReadMessage()
+			if err != nil {
+				return
+			}
+			switch m := msg.(type) {
+			case *RequestMsg:
+				reqs <- m
+			case *CancelMsg:
+				cancels <- m
+			}
+		}
+	}()
+	return reqs, cancels
+}
+
+func TestInEndgame(t *testing.T) {
+	data := make([]byte, 2*2*LengthOfBlock)
+	second := uint32(LengthOfBlock) // offset of the second block
+
+	tests := []struct {
+		name    string
+		status  uint8      // of the first piece, the second one is downloaded
+		got     []uint32   // blocks of the first piece received
+		reqs    [][]uint32 // blocks of the first piece requested from each peer
+		endgame bool
+	}{
+		{"a piece isn't picked yet", PieceStatusDefault, nil, nil, false},
+		{"a piece failed", PieceStatusFailed, nil, nil, false},
+		{"picked, not joined yet", PieceStatusRequested, nil, nil, false},
+		{"a block isn't requested", PieceStatusRequested, nil, [][]uint32{{0}}, false},
+		{"all the blocks requested", PieceStatusRequested, nil, [][]uint32{{0, second}}, true},
+		{"requested from two peers", PieceStatusRequested, nil, [][]uint32{{0}, {second}}, true},
+		{"received or requested", PieceStatusRequested, []uint32{0}, [][]uint32{{second}}, true},
+		{"everything downloaded", PieceStatusDownloaded, nil, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := downloadingPeer(t, data)
+			tr := p.Torrent
+			tr.Pieces[1].status = PieceStatusDownloaded
+
+			piece := tr.Pieces[0]
+			for i, reqs := range tt.reqs {
+				q := p
+				if i > 0 {
+					q, _ = otherPeer(t, tr)
+				}
+				pending := make(map[uint32]*Block)
+				for _, beg := range reqs {
+					pending[beg] = piece.Blocks[beg/second]
+				}
+				piece.join(q).setRequested(q, pending)
+			}
+			if len(tt.got) > 0 {
+				dl := piece.join(p)
+				for _, beg := range tt.got {
+					dl.put(beg, make([]byte, LengthOfBlock), p, len(piece.Blocks))
+				}
+			}
+			piece.SetStatus(tt.status)
+
+			if e := tr.InEndgame(); e != tt.endgame {
+				t.Fatalf("endgame %v, want %v", e, tt.endgame)
+			}
+		})
+	}
+}
+
+func TestEndgameCancel(t *testing.T) {
+	data := make([]byte, 2*LengthOfBlock)
+	rand.Read(data)
+
+	p, w := downloadingPeer(t, data)
+	tr := p.Torrent
+	piece := tr.Pieces[0]
+	reqs, cancels := readMessages(w)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the first peer gets the piece, and doesn't answer it's requests
+	if !tr.startDownload(ctx, p) {
+		t.Fatal("no piece handed to the peer")
+	}
+	for i := 0; i < len(piece.Blocks); i++ {
+		select {
+		case <-reqs:
+		case <-time.After(time.Second):
+			t.Fatal("the blocks weren't requested")
+		}
+	}
+
+	// the last piece is requested in whole, a second peer gets it too
+	deadline := time.Now().Add(time.Second)
+	for !tr.InEndgame() {
+		if time.Now().After(deadline) {
+			t.Fatal("not in endgame, with all the blocks requested")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	q, qw := otherPeer(t, tr)
+	qreqs, _ := readMessages(qw)
+	if !tr.startDownload(ctx, q) {
+		t.Fatal("the piece wasn't handed to the second peer")
+	}
+
+	// the second peer answers first, the first one's requests get cancelled
+	for i := 0; i < len(piece.Blocks); i++ {
+		select {
+		case m := <-qreqs:
+			block := data[m.Begin : m.Begin+m.Length]
+			if err := q.handle(&PieceMsg{Index: m.Index, Begin: m.Begin, Block: block}); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the second peer didn't request the blocks")
+		}
+	}
+
+	cancelled := make(map[uint32]bool)
+	for len(cancelled) < len(piece.Blocks) {
+		select {
+		case m := <-cancels:
+			if m.Index != 0 || m.Length != uint32(LengthOfBlock) {
+				t.Fatalf("cancel of index %v length %v", m.Index, m.Length)
+			}
+			cancelled[m.Begin] = true
+		case <-time.After(time.Second):
+			t.Fatalf("%v of %v requests of the first peer cancelled", len(cancelled), len(piece.Blocks))
+		}
+	}
+
+	tr.wg.Wait()
+	if !tr.Complete() {
+		t.Fatal("the piece wasn't downloaded")
+	}
+}
@@ -0,0 +1,223 @@
+package src
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/marksamman/bencode"
+	"github.com/ritsource/torrent-client/output"
+)
+
+// ClientVersion is our client name and version, sent as `v` in the extended handshake
+var ClientVersion = "TC 0.0.1"
+
+// errExtUnsupported is returned when sending an extended message, that the peer doesn't support
+var errExtUnsupported = errors.New("peer doesn't support the extension")
+
+/*
+ExtensionHandler handles the messages of an extension of the extension protocol (BEP 10).
+It gets registered by the extension's name (the key in the `m` dictionary), and receives
+the messages from the peers that support it, from the peer read loop
+*/
+type ExtensionHandler interface {
+	// Handshake is called with the peer's extended handshake, if the peer supports the extension
+	Handshake(p *Peer, hs map[string]interface{}) error
+	// Handle is called with each message of the extension, the bencoded
+	// dictionary of the payload and the raw data following it (if any)
+	Handle(p *Peer, dict map[string]interface{}, data []byte) error
+}
+
+// extension is a registered extension, the extended message id that we
+// assign to it (sent in our `m` dictionary) is it's index in the registry + 1
+type extension struct {
+	name    string
+	handler ExtensionHandler
+}
+
+// extensions is the registry of extensions, guarded by `extMu`
+var (
+	extMu      sync.RWMutex
+	extensions []*extension
+)
+
+/*
+RegisterExtension adds the handler of an extension to the registry, and returns the
+extended message id that the peers are to send it's messages to us with. Registering
+the same name again replaces the handler (the id stays the same)
+*/
+func RegisterExtension(name string, h ExtensionHandler) uint8 {
+	extMu.Lock()
+	defer extMu.Unlock()
+
+	for i, e := range extensions {
+		if e.name == name {
+			e.handler = h
+			return uint8(i + 1)
+		}
+	}
+
+	if len(extensions) >= 255 {
+		panic("too many extensions registered")
+	}
+	extensions = append(extensions, &extension{name: name, handler: h})
+	return uint8(len(extensions))
+}
+
+// extensionByID returns the registered extension with our extended message id, nil if there's none
+func extensionByID(id uint8) *extension {
+	extMu.RLock()
+	defer extMu.RUnlock()
+
+	if id == 0 || int(id) > len(extensions) {
+		return nil
+	}
+	return extensions[id-1]
+}
+
+/*
+handleExtended handles an extension protocol message (BEP 10). The extended handshake
+(id 0) tells us the peer's ids for the extensions, the rest of the messages (sent with
+our ids) are handed over to the handlers of the extensions
+*/
+func (p *Peer) handleExtended(m *ExtendedMsg) error {
+	dict, n, err := decodeExtPayload(m.Payload)
+	if err != nil {
+		return err
+	}
+
+	if m.ExtID == 0 {
+		return p.handleExtHandshake(dict)
+	}
+
+	e := extensionByID(m.ExtID)
+	if e == nil {
+		output.DevInfof("extended message with unknown id %v, ignoring | %v:%v\n", m.ExtID, p.IP, p.Port)
+		return nil
+	}
+	return e.handler.Handle(p, dict, m.Payload[n:])
+}
+
+/*
+handleExtHandshake reads the peer's extended handshake. The `m` dictionary maps
+the names of the extensions to the peer's ids for them (id 0 disables one), and the
+rest of the keys are optional, `v` the client name and version, `p` the port it
+listens on, `reqq` the number of outstanding requests it supports, and `yourip`
+our address as the peer sees it. The handshake can be sent more than once, the
+later ones only update what they include
+*/
+func (p *Peer) handleExtHandshake(hs map[string]interface{}) error {
+	mm, _ := hs["m"].(map[string]interface{})
+
+	p.mu.Lock()
+	if p.extIDs == nil {
+		p.extIDs = make(map[string]uint8)
+	}
+	for name, v := range mm {
+		id, ok := v.(int64)
+		if !ok || id < 0 || id > 255 {
+			continue
+		}
+		if id == 0 {
+			delete(p.extIDs, name)
+		} else {
+			p.extIDs[name] = uint8(id)
+		}
+	}
+	p.mu.Unlock()
+
+	if v, ok := hs["v"].(string); ok {
+		p.Client = v
+	}
+
+	// an incoming peer connects from a random port,
+	// this is the one it accepts connections on
+	p.mu.Lock()
+	if port, ok := hs["p"].(int64); ok && port > 0 && port < 65536 {
+		p.listenPort = uint16(port)
+	}
+
+	if n, ok := hs["reqq"].(int64); ok && n > 0 {
+		p.reqq = int(n)
+	}
+	p.mu.Unlock()
+
+	if ip, ok := hs["yourip"].(string); ok && (len(ip) == 4 || len(ip) == 16) {
+		output.DevInfof("peer sees us as %v | %v:%v\n", net.IP(ip), p.IP, p.Port)
+	}
+
+	output.DevInfof("extended handshake, client=%q extensions=%v | %v:%v\n", p.Client, len(mm), p.IP, p.Port)
+
+	extMu.RLock()
+	exts := append([]*extension{}, extensions...)
+	extMu.RUnlock()
+
+	for _, e := range exts {
+		if _, ok := mm[e.name]; !ok || !p.SupportsExtension(e.name) {
+			continue
+		}
+		if err := e.handler.Handshake(p, hs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+sendExtHandshake sends our extended handshake, with the ids we assign to the
+registered extensions, and the optional keys. `metadata_size` is only sent if we
+have the metadata (not while it's being downloaded for a magnet link)
+*/
+func (p *Peer) sendExtHandshake() error {
+	extMu.RLock()
+	m := make(map[string]interface{}, len(extensions))
+	for i, e := range extensions {
+		m[e.name] = i + 1
+	}
+	extMu.RUnlock()
+
+	hs := map[string]interface{}{
+		"m":    m,
+		"v":    ClientVersion,
+		"p":    int(p.Torrent.client.Config.Port),
+		"reqq": MaxRequestQueue,
+	}
+
+	// the peer's address, as we see it
+	if ip4 := p.IP.To4(); ip4 != nil {
+		hs["yourip"] = string(ip4)
+	} else if len(p.IP) == 16 {
+		hs["yourip"] = string(p.IP)
+	}
+
+	if len(p.Torrent.metadata) > 0 {
+		hs["metadata_size"] = len(p.Torrent.metadata)
+	}
+
+	return p.Send(extMsg(0, hs))
+}
+
+// SupportsExtension checks if the peer has told us (in it's extended handshake) that it supports the extension
+func (p *Peer) SupportsExtension(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.extIDs[name] != 0
+}
+
+// SendExtended sends a message of the extension to the peer (with the peer's id for
+// it), the bencoded dictionary followed by the raw data. `errExtUnsupported` is
+// returned if the peer doesn't support the extension
+func (p *Peer) SendExtended(name string, dict map[string]interface{}, data []byte) error {
+	p.mu.Lock()
+	id := p.extIDs[name]
+	p.mu.Unlock()
+
+	if id == 0 {
+		return errExtUnsupported
+	}
+
+	payload := append(bencode.Encode(dict), data...)
+	return p.Send(&ExtendedMsg{ExtID: id, Payload: payload})
+}
@@ -0,0 +1,214 @@
+package src
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+// AllowedFastCount is the number of pieces in the allowed fast set that we give to
+// a peer, the pieces it can download from us while we are choking it (BEP 6)
+var AllowedFastCount = 10
+
+// MaxSuggested is the number of suggested pieces that are remembered for a peer,
+// and the largest allowed fast set that we accept from a peer
+var MaxSuggested = 32
+
+// ErrRequestRejected is returned when the peer keeps rejecting the requests for a block
+var ErrRequestRejected = errors.New("peer has rejected the block requests")
+
+// fastBit is the bit in the reserved bytes of the handshake, that
+// tells that the peer supports the Fast Extension (BEP 6)
+const fastBit = 0x04
+
+// errNotFast is returned when a peer sends a Fast Extension message, without having negotiated it
+var errNotFast = errors.New("fast extension message, without the fast extension")
+
+/*
+sendPieces lets the peer know which pieces we have, right after the handshake. With
+the Fast Extension `have_all` or `have_none` take the place of the bitfield when they
+can, and the allowed fast set follows it. Otherwise the bitfield is only sent if we
+have any of the pieces
+*/
+func (p *Peer) sendPieces() error {
+	bf := p.Torrent.Bitfield()
+
+	switch {
+	case p.Fast && p.Torrent.Complete():
+		if err := p.Send(&HaveAllMsg{}); err != nil {
+			return err
+		}
+	case p.Fast && isEmpty(bf):
+		if err := p.Send(&HaveNoneMsg{}); err != nil {
+			return err
+		}
+	case !isEmpty(bf):
+		if err := p.Send(&BitfieldMsg{Bitfield: bf}); err != nil {
+			return err
+		}
+	}
+
+	if !p.Fast {
+		return nil
+	}
+
+	set := allowedFastSet(p.IP, p.Torrent.InfoHash, len(p.Torrent.Pieces), AllowedFastCount)
+	for _, idx := range set {
+		if err := p.Send(&AllowedFastMsg{Index: idx}); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.ourFast = make(map[uint32]bool, len(set))
+	for _, idx := range set {
+		p.ourFast[idx] = true
+	}
+	p.mu.Unlock()
+
+	return nil
+}
+
+/*
+allowedFastSet generates the allowed fast set of a peer, with the canonical algorithm
+of BEP 6, from the peer's IPv4 address (the last byte masked out) and the infohash. So
+every peer of a network gets the same set, and reconnecting doesn't give a new one. IPv6
+peers (no algorithm for them) get no set
+*/
+func allowedFastSet(ip net.IP, infohash []byte, npieces, k int) []uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil || npieces == 0 {
+		return nil
+	}
+	if k > npieces {
+		k = npieces
+	}
+
+	x := []byte{ip4[0], ip4[1], ip4[2], 0}
+	x = append(x, infohash...)
+
+	set := []uint32{}
+	seen := make(map[uint32]bool)
+	for len(set) < k {
+		h := sha1.Sum(x)
+		x = h[:]
+
+		for i := 0; i < 5 && len(set) < k; i++ {
+			idx := binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(npieces)
+			if !seen[idx] {
+				seen[idx] = true
+				set = append(set, idx)
+			}
+		}
+	}
+
+	return set
+}
+
+// handleFast handles the Fast Extension messages, the peer has to have negotiated the extension
+func (p *Peer) handleFast(msg Message) error {
+	if !p.Fast {
+		return errNotFast
+	}
+
+	n := len(p.Torrent.Pieces)
+
+	switch m := msg.(type) {
+	case *HaveAllMsg:
+		output.DevInfof("have-all-message | %v:%v\n", p.IP, p.Port)
+		bf := make([]bool, n)
+		for i := range bf {
+			bf[i] = true
+		}
+		p.Torrent.avail.setBitfield(p, bf)
+		return p.updateInterest()
+
+	case *HaveNoneMsg:
+		output.DevInfof("have-none-message | %v:%v\n", p.IP, p.Port)
+		p.Torrent.avail.setBitfield(p, make([]bool, n))
+		return p.updateInterest()
+
+	case *RejectMsg:
+		// handing the reject over to the download of it's piece, like the blocks
+		if d := p.download(m.Index); d != nil {
+			select {
+			case d.rejects <- m:
+			default:
+			}
+		}
+
+	case *AllowedFastMsg:
+		if int(m.Index) >= n {
+			return fmt.Errorf("allowed-fast-message with invalid piece-index, %v", m.Index)
+		}
+		p.mu.Lock()
+		if p.allowed == nil {
+			p.allowed = make(map[uint32]bool)
+		}
+		if len(p.allowed) < MaxSuggested {
+			p.allowed[m.Index] = true
+		}
+		p.mu.Unlock()
+
+		// a download waiting for an unchoke might be able to go on now
+		p.signal()
+
+	case *SuggestMsg:
+		if int(m.Index) >= n {
+			return fmt.Errorf("suggest-piece-message with invalid piece-index, %v", m.Index)
+		}
+		p.mu.Lock()
+		p.suggested = append(p.suggested, m.Index)
+		if len(p.suggested) > MaxSuggested {
+			p.suggested = p.suggested[1:]
+		}
+		p.mu.Unlock()
+	}
+
+	return nil
+}
+
+// AllowedFast checks if the peer lets us download the piece while it's choking us
+func (p *Peer) AllowedFast(pidx uint32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.allowed[pidx]
+}
+
+// hasAllowedFast checks if the peer lets us download any of the pieces while it's choking us
+func (p *Peer) hasAllowedFast() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.allowed) > 0
+}
+
+// suggestedPiece returns the piece that the peer suggested last, out of the ones that are
+// to be downloaded (see `wanted`), nil if there's none. The suggestions take precedence
+// over the piece picker, the peer can send the pieces in it's cache faster
+func suggestedPiece(p *Peer) *Piece {
+	p.mu.Lock()
+	sg := append([]uint32{}, p.suggested...)
+	p.mu.Unlock()
+
+	for i := len(sg) - 1; i >= 0; i-- {
+		if int(sg[i]) < len(p.Torrent.Pieces) && wanted(p, int(sg[i])) {
+			return p.Torrent.Pieces[sg[i]]
+		}
+	}
+	return nil
+}
+
+// reject tells the peer that we won't answer it's request, if it supports the Fast
+// Extension. The requests of the other peers are just ignored
+func (p *Peer) reject(m *RequestMsg) error {
+	if !p.Fast {
+		return nil
+	}
+	return p.Send(&RejectMsg{Index: m.Index, Begin: m.Begin, Length: m.Length})
+}
@@ -0,0 +1,195 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	aa := bytes.Repeat([]byte{0xaa}, 20)
+
+	tests := []struct {
+		name    string
+		ip      net.IP
+		npieces int
+		k       int
+		want    []uint32 // nil if the peer gets no set
+	}{
+		// the examples of BEP 6
+		{"bep 6, 7 pieces", net.IPv4(80, 4, 4, 200), 1313, 7, []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"bep 6, 9 pieces", net.IPv4(80, 4, 4, 200), 1313, 9, []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		{"same network", net.IPv4(80, 4, 4, 1), 1313, 7, []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"ipv6", net.ParseIP("2001:db8::1"), 1313, 7, nil},
+		{"no pieces", net.IPv4(80, 4, 4, 200), 0, 7, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := allowedFastSet(tt.ip, aa, tt.npieces, tt.k)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) || (got == nil) != (tt.want == nil) {
+				t.Fatalf("set %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// more pieces asked for than the torrent has, it's every piece once
+	set := allowedFastSet(net.IPv4(80, 4, 4, 200), aa, 5, 10)
+	seen := make(map[uint32]bool)
+	for _, idx := range set {
+		if idx >= 5 || seen[idx] {
+			t.Fatalf("set %v of a torrent of 5 pieces", set)
+		}
+		seen[idx] = true
+	}
+	if len(set) != 5 {
+		t.Fatalf("set %v of a torrent of 5 pieces, want all of them", set)
+	}
+}
+
+func TestHandleFast(t *testing.T) {
+	max := MaxSuggested
+	defer func() { MaxSuggested = max }()
+	MaxSuggested = 2
+
+	tests := []struct {
+		name    string
+		fast    bool
+		has     []int
+		msgs    []Message
+		err     bool
+		counts  []int    // availability of the pieces afterwards
+		allowed []uint32 // the peer's allowed fast set afterwards
+	}{
+		{"have-all", true, nil, []Message{&HaveAllMsg{}}, false, []int{1, 1, 1, 1}, nil},
+		{"have-none", true, []int{0, 2}, []Message{&HaveNoneMsg{}}, false, []int{0, 0, 0, 0}, nil},
+		{"have-all then have-none", true, nil, []Message{&HaveAllMsg{}, &HaveNoneMsg{}}, false, []int{0, 0, 0, 0}, nil},
+		{"have after have-none", true, nil, []Message{&HaveNoneMsg{}, &HaveMsg{Index: 3}}, false, []int{0, 0, 0, 1}, nil},
+		{"allowed-fast", true, nil, []Message{&AllowedFastMsg{Index: 1}, &AllowedFastMsg{Index: 3}}, false, []int{0, 0, 0, 0}, []uint32{1, 3}},
+		{"allowed-fast up to MaxSuggested", true, nil, []Message{&AllowedFastMsg{Index: 0}, &AllowedFastMsg{Index: 1}, &AllowedFastMsg{Index: 2}}, false, []int{0, 0, 0, 0}, []uint32{0, 1}},
+		{"allowed-fast out of range", true, nil, []Message{&AllowedFastMsg{Index: 4}}, true, []int{0, 0, 0, 0}, nil},
+		{"suggest out of range", true, nil, []Message{&SuggestMsg{Index: 4}}, true, []int{0, 0, 0, 0}, nil},
+		{"reject of nothing requested", true, nil, []Message{&RejectMsg{Index: 2, Begin: 0, Length: 16384}}, false, []int{0, 0, 0, 0}, nil},
+		{"have-all without the extension", false, nil, []Message{&HaveAllMsg{}}, true, []int{0, 0, 0, 0}, nil},
+		{"have-none without the extension", false, []int{1}, []Message{&HaveNoneMsg{}}, true, []int{0, 1, 0, 0}, nil},
+		{"allowed-fast without the extension", false, nil, []Message{&AllowedFastMsg{Index: 1}}, true, []int{0, 0, 0, 0}, nil},
+		{"reject without the extension", false, nil, []Message{&RejectMsg{Index: 1}}, true, []int{0, 0, 0, 0}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := pickerTorrent(stNone, stNone, stNone, stNone)
+			p := pickerPeer(t, tr, tt.has...)
+			p.Fast = tt.fast
+
+			var err error
+			for _, m := range tt.msgs {
+				if err = p.handle(m); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want an error %v", err, tt.err)
+			}
+
+			for i, want := range tt.counts {
+				if got := tr.avail.Count(i); got != want {
+					t.Fatalf("availability of piece %v is %v, want %v", i, got, want)
+				}
+			}
+			for i := range tr.Pieces {
+				want := false
+				for _, idx := range tt.allowed {
+					want = want || idx == uint32(i)
+				}
+				if p.AllowedFast(uint32(i)) != want {
+					t.Fatalf("piece %v allowed fast %v, want %v", i, !want, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRejectRouted(t *testing.T) {
+	tr := pickerTorrent(stNone, stNone)
+	p := pickerPeer(t, tr, 0, 1)
+	p.Fast = true
+
+	d, _ := p.addDownload(1, 1)
+	rej := &RejectMsg{Index: 1, Begin: 16384, Length: 16384}
+
+	// the reject goes to the download of it's piece, and nowhere else
+	if err := p.handle(&RejectMsg{Index: 0, Begin: 0, Length: 16384}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.handle(rej); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-d.rejects:
+		if got != rej {
+			t.Fatalf("reject %#v, want %#v", got, rej)
+		}
+	default:
+		t.Fatal("the reject didn't get to the download")
+	}
+	if len(d.rejects) != 0 {
+		t.Fatalf("%v rejects of other pieces got to the download", len(d.rejects))
+	}
+}
+
+func TestSendPieces(t *testing.T) {
+	tests := []struct {
+		name     string
+		fast     bool
+		statuses []uint8
+		want     string // the messages sent, by type
+	}{
+		{"fast, all the pieces", true, []uint8{stDone, stDone}, "*src.HaveAllMsg *src.AllowedFastMsg *src.AllowedFastMsg"},
+		{"fast, none of the pieces", true, []uint8{stNone, stNone}, "*src.HaveNoneMsg *src.AllowedFastMsg *src.AllowedFastMsg"},
+		{"fast, some of the pieces", true, []uint8{stDone, stNone}, "*src.BitfieldMsg *src.AllowedFastMsg *src.AllowedFastMsg"},
+		{"all the pieces", false, []uint8{stDone, stDone}, "*src.BitfieldMsg"},
+		{"none of the pieces", false, []uint8{stNone, stNone}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := pickerTorrent(tt.statuses...)
+			tr.InfoHash = bytes.Repeat([]byte{0xaa}, 20)
+
+			a, b := net.Pipe()
+			defer b.Close()
+			p := &Peer{Torrent: tr, IP: net.IPv4(80, 4, 4, 200)}
+			p.open(a)
+			p.Fast = tt.fast
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- p.sendPieces()
+				a.Close()
+			}()
+
+			got := []string{}
+			w := NewWire(b)
+			for {
+				msg, err := w.ReadMessage()
+				if err != nil {
+					break
+				}
+				got = append(got, fmt.Sprintf("%T", msg))
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if s := fmt.Sprint(got); s != "["+tt.want+"]" {
+				t.Fatalf("sent %v, want [%v]", s, tt.want)
+			}
+
+			// the allowed fast set we gave the peer is remembered
+			if tt.fast && len(p.ourFast) != len(tr.Pieces) {
+				t.Fatalf("allowed fast set of %v pieces, want %v", len(p.ourFast), len(tr.Pieces))
+			}
+		})
+	}
+}
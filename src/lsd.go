@@ -0,0 +1,256 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+// multicast groups of local service discovery, over IPv4 and IPv6 (BEP 14)
+var (
+	LSDGroup4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	LSDGroup6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// LSDInterval is the time between the announces of all the torrents on the local network
+var LSDInterval = 5 * time.Minute
+
+// LSDMinInterval is the least time between two announces of the same torrent, BEP 14
+// doesn't allow more than one a minute
+var LSDMinInterval = time.Minute
+
+// lsdMaxHashes is the number of infohashes in a single announce, so
+// that the datagram stays within 1400 bytes (each header is 50 bytes)
+const lsdMaxHashes = 20
+
+/*
+LSD is local service discovery (BEP 14), it finds the peers on the local network that
+have the same torrents as us, with no tracker involved. The infohashes of our torrents
+are announced to a multicast group (`BT-SEARCH` messages, the same format as HTTP
+requests), and the announces of the other peers on the network are listened for
+*/
+type LSD struct {
+	Port uint16 // the port we accept peer connections on, announced to the local peers
+
+	cookie     string                         // sent with our announces, to recognize them when they come back
+	conns      []*net.UDPConn                 // joined to the IPv4 group, and the IPv6 group (if available)
+	infohashes func() [][]byte                // infohashes of the torrents to announce
+	found      func(infohash []byte, p *Peer) // called with each peer announced on the local network
+
+	mu     sync.Mutex
+	last   map[string]time.Time // when each infohash was announced last
+	closed bool
+	done   chan struct{}
+}
+
+/*
+NewLSD joins the multicast groups of local service discovery, IPv6 is optional as
+the machine might not have an IPv6 address at all. `infohashes` returns the torrents
+to announce every `LSDInterval`, and `found` gets called with the peers announcing the
+same infohashes (the `Torrent` of the peer isn't set)
+*/
+func NewLSD(port uint16, infohashes func() [][]byte, found func(infohash []byte, p *Peer)) (*LSD, error) {
+	l := &LSD{
+		Port:       port,
+		cookie:     strconv.FormatUint(rand.Uint64(), 36),
+		infohashes: infohashes,
+		found:      found,
+		last:       make(map[string]time.Time),
+		done:       make(chan struct{}),
+	}
+
+	for _, group := range []*net.UDPAddr{LSDGroup4, LSDGroup6} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+
+		conn, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil && network == "udp4" {
+			return nil, err
+		}
+		if err != nil {
+			output.DevWarnf("couldn't join the IPv6 lsd group, %v\n", err)
+			continue
+		}
+		l.conns = append(l.conns, conn)
+	}
+
+	return l, nil
+}
+
+// Close leaves the multicast groups, and stops announcing
+func (l *LSD) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	l.mu.Unlock()
+
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+/*
+Serve listens for the announces on the local network and announces all the
+torrents every `LSDInterval`. It blocks until the LSD is closed
+*/
+func (l *LSD) Serve() {
+	for _, conn := range l.conns {
+		go l.listen(conn)
+	}
+
+	t := time.NewTicker(LSDInterval)
+	defer t.Stop()
+
+	for {
+		l.Announce(l.infohashes()...)
+
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+/*
+Announce multicasts the infohashes to the local network, the ones that
+have been announced within `LSDMinInterval` are left out. Messages look like,
+
+	BT-SEARCH * HTTP/1.1\r\n
+	Host: 239.192.152.143:6771\r\n
+	Port: 6881\r\n
+	Infohash: <40 hex characters>\r\n
+	cookie: <our cookie>\r\n
+	\r\n
+	\r\n
+
+with one `Infohash` header for each infohash
+*/
+func (l *LSD) Announce(infohashes ...[]byte) {
+	l.mu.Lock()
+	due := [][]byte{}
+	for _, ih := range infohashes {
+		if time.Since(l.last[string(ih)]) < LSDMinInterval {
+			continue
+		}
+		l.last[string(ih)] = time.Now()
+		due = append(due, ih)
+	}
+	l.mu.Unlock()
+
+	for len(due) > 0 {
+		n := len(due)
+		if n > lsdMaxHashes {
+			n = lsdMaxHashes
+		}
+
+		for _, conn := range l.conns {
+			group := LSDGroup4
+			if conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+				group = LSDGroup6
+			}
+
+			if _, err := conn.WriteToUDP(l.message(group, due[:n]), group); err != nil {
+				output.DevWarnf("couldn't send the lsd announce, %v | %v\n", err, group)
+			}
+		}
+
+		due = due[n:]
+	}
+}
+
+// message builds an announce of the infohashes, for the multicast group
+func (l *LSD) message(group *net.UDPAddr, infohashes [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "BT-SEARCH * HTTP/1.1\r\nHost: %v\r\nPort: %v\r\n", group, l.Port)
+	for _, ih := range infohashes {
+		fmt.Fprintf(buf, "Infohash: %x\r\n", ih)
+	}
+	fmt.Fprintf(buf, "cookie: %v\r\n\r\n\r\n", l.cookie)
+	return buf.Bytes()
+}
+
+// listen reads the announces from the multicast group, until the connection gets closed
+func (l *LSD) listen(conn *net.UDPConn) {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if !closed {
+				output.DevWarnf("stopped listening for lsd announces, %v\n", err)
+			}
+			return
+		}
+
+		port, infohashes, err := l.parse(buf[:n])
+		if err != nil {
+			output.DevInfof("invalid lsd announce, %v | %v\n", err, addr)
+			continue
+		}
+
+		for _, ih := range infohashes {
+			output.DevInfof("local peer announced %x | %v:%v\n", ih, addr.IP, port)
+			l.found(ih, &Peer{IP: addr.IP, Port: port})
+		}
+	}
+}
+
+// parse reads the port and the infohashes from an announce, our own announces (the ones
+// with our cookie, they come back to us as the multicast loops back) have no infohashes
+func (l *LSD) parse(b []byte) (uint16, [][]byte, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+
+	line, err := r.ReadLine()
+	if err != nil {
+		return 0, nil, err
+	}
+	if !strings.HasPrefix(line, "BT-SEARCH * ") {
+		return 0, nil, fmt.Errorf("not a BT-SEARCH message, %q", line)
+	}
+
+	hdr, err := r.ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return 0, nil, err
+	}
+
+	if hdr.Get("Cookie") == l.cookie {
+		return 0, nil, nil
+	}
+
+	port, err := strconv.ParseUint(hdr.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return 0, nil, fmt.Errorf("invalid port, %q", hdr.Get("Port"))
+	}
+
+	infohashes := [][]byte{}
+	for _, v := range hdr["Infohash"] {
+		ih, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(ih) != 20 {
+			return 0, nil, fmt.Errorf("invalid infohash, %q", v)
+		}
+		infohashes = append(infohashes, ih)
+	}
+
+	return uint16(port), infohashes, nil
+}
@@ -0,0 +1,89 @@
+package src
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLSDParse(t *testing.T) {
+	ih1, ih2 := strings.Repeat("ab", 20), strings.Repeat("0f", 20)
+	l := &LSD{Port: 6881, cookie: "ours"}
+
+	tests := []struct {
+		name  string
+		msg   string
+		port  uint16
+		count int // number of infohashes
+		err   bool
+	}{
+		{"an infohash", "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6882\r\nInfohash: " + ih1 + "\r\n\r\n\r\n", 6882, 1, false},
+		{"two infohashes", "BT-SEARCH * HTTP/1.1\r\nPort: 6882\r\nInfohash: " + ih1 + "\r\nInfohash: " + ih2 + "\r\n\r\n\r\n", 6882, 2, false},
+		{"upper case hex", "BT-SEARCH * HTTP/1.1\r\nPort: 6882\r\nInfohash: " + strings.ToUpper(ih1) + "\r\n\r\n", 6882, 1, false},
+		{"lower case headers", "BT-SEARCH * HTTP/1.1\r\nport: 6882\r\ninfohash: " + ih1 + "\r\n\r\n", 6882, 1, false},
+		{"no blank line at the end", "BT-SEARCH * HTTP/1.1\r\nPort: 6882\r\nInfohash: " + ih1 + "\r\n", 6882, 1, false},
+		{"someone else's cookie", "BT-SEARCH * HTTP/1.1\r\nPort: 6882\r\nInfohash: " + ih1 + "\r\ncookie: theirs\r\n\r\n", 6882, 1, false},
+		{"our own cookie", "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: " + ih1 + "\r\ncookie: ours\r\n\r\n", 0, 0, false},
+		{"no port", "BT-SEARCH * HTTP/1.1\r\nInfohash: " + ih1 + "\r\n\r\n", 0, 0, true},
+		{"port 0", "BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + ih1 + "\r\n\r\n", 0, 0, true},
+		{"port out of range", "BT-SEARCH * HTTP/1.1\r\nPort: 65536\r\nInfohash: " + ih1 + "\r\n\r\n", 0, 0, true},
+		{"port not a number", "BT-SEARCH * HTTP/1.1\r\nPort: http\r\nInfohash: " + ih1 + "\r\n\r\n", 0, 0, true},
+		{"negative port", "BT-SEARCH * HTTP/1.1\r\nPort: -1\r\nInfohash: " + ih1 + "\r\n\r\n", 0, 0, true},
+		{"infohash not hex", "BT-SEARCH * HTTP/1.1\r\nPort: 6882\r\nInfohash: " + strings.Repeat("zz", 20) + "\r\n\r\n", 0, 0, true},
+		{"short infohash", "BT-SEARCH * HTTP/1.1\r\nPort: 6882\r\nInfohash: " + ih1[:38] + "\r\n\r\n", 0, 0, true},
+		{"no infohash", "BT-SEARCH * HTTP/1.1\r\nPort: 6882\r\n\r\n", 6882, 0, false},
+		{"another method", "NOTIFY * HTTP/1.1\r\nPort: 6882\r\nInfohash: " + ih1 + "\r\n\r\n", 0, 0, true},
+		{"empty", "", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, infohashes, err := l.parse([]byte(tt.msg))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("no error, port %v and %v infohashes", port, len(infohashes))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != tt.port || len(infohashes) != tt.count {
+				t.Fatalf("port %v and %v infohashes, want %v and %v", port, len(infohashes), tt.port, tt.count)
+			}
+		})
+	}
+}
+
+func TestLSDMessage(t *testing.T) {
+	ours, theirs := &LSD{Port: 6881, cookie: "ours"}, &LSD{Port: 7000, cookie: "theirs"}
+	infohashes := [][]byte{bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20)}
+
+	msg := ours.message(LSDGroup4, infohashes)
+	if len(msg) > 1400 {
+		t.Fatalf("announce of %v bytes", len(msg))
+	}
+
+	// an other peer gets the port and the infohashes
+	port, got, err := theirs.parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != ours.Port || len(got) != 2 || !bytes.Equal(got[0], infohashes[0]) || !bytes.Equal(got[1], infohashes[1]) {
+		t.Fatalf("port %v, infohashes %x", port, got)
+	}
+
+	// and we ignore it, as it loops back to us
+	if _, got, err := ours.parse(msg); err != nil || len(got) != 0 {
+		t.Fatalf("our own announce, %v infohashes, %v", len(got), err)
+	}
+
+	// the most infohashes in a single announce still fit in a datagram
+	many := make([][]byte, lsdMaxHashes)
+	for i := range many {
+		many[i] = make([]byte, 20)
+	}
+	if n := len(ours.message(LSDGroup6, many)); n > 1400 {
+		t.Fatalf("announce of %v infohashes is %v bytes", lsdMaxHashes, n)
+	}
+}
@@ -0,0 +1,174 @@
+package src
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+/*
+Magnet holds the data read from a magnet URI. A magnet link doesn't
+contain the info dictionary, only the infohash of it. So the info
+dictionary (metadata) has to be downloaded from the peers, by using
+the extension protocol (BEP 10) and `ut_metadata` extension (BEP 9)
+*/
+type Magnet struct {
+	InfoHash []byte     // 20-byte infohash, from `xt=urn:btih:`
+	Name     string     // display name, from `dn` (optional)
+	Trackers []*url.URL // tracker URLs, from `tr` (optional)
+	Peers    []*Peer    // peer addresses, from `x.pe` (optional)
+}
+
+// ParseMagnet parses a magnet URI
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link, scheme = %v", u.Scheme)
+	}
+
+	q := u.Query()
+	m := &Magnet{Name: q.Get("dn")}
+
+	// reading the infohash from the exact topic (`xt`), for BitTorrent the
+	// urn is `urn:btih:` followed by hex (40 chars) or base32 (32 chars)
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+
+		m.InfoHash, err = decodeInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if m.InfoHash == nil {
+		return nil, fmt.Errorf("magnet link doesn't have a `urn:btih:` exact topic")
+	}
+
+	// trackers, invalid ones are ignored
+	for _, tr := range q["tr"] {
+		t, err := url.Parse(tr)
+		if err != nil {
+			output.DevWarnf("invalid tracker in magnet link, %v\n", err)
+			continue
+		}
+		m.Trackers = append(m.Trackers, t)
+	}
+
+	// peer addresses, `host:port` (host can also be a hostname)
+	for _, pe := range q["x.pe"] {
+		addr, err := net.ResolveTCPAddr("tcp", pe)
+		if err != nil {
+			output.DevWarnf("invalid peer address in magnet link, %v\n", err)
+			continue
+		}
+		m.Peers = append(m.Peers, &Peer{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+
+	return m, nil
+}
+
+// decodeInfoHash decodes a hex or base32 encoded infohash
+func decodeInfoHash(s string) ([]byte, error) {
+	switch len(s) {
+	case 40:
+		return hex.DecodeString(s)
+	case 32:
+		return base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return nil, fmt.Errorf("invalid infohash length in magnet link, %v", len(s))
+	}
+}
+
+/*
+ReadMagnet reads a magnet URI and populates the `Torrent`, just like `ReadFile`
+does with a `.torrent` file. It first gets peers from the trackers (and the
+`x.pe` peers) and then downloads the info dictionary from them. Once the
+metadata has been verified against the infohash, `Torrent.Read` does the
+rest. The `x.pe` peers are kept, as the trackers might not know them
+*/
+func (t *Torrent) ReadMagnet(ctx context.Context, uri string) error {
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		return err
+	}
+
+	output.DevInfof("magnet link, infohash=%x name=%v | %v trackers, %v peers\n", m.InfoHash, m.Name, len(m.Trackers), len(m.Peers))
+
+	// `GetPeers` and the handshake require the infohash
+	// and the trackers to be set on the `Torrent`, beforehand
+	t.InfoHash = m.InfoHash
+	for _, tr := range m.Trackers {
+		t.AnnounceList = append(t.AnnounceList, []*url.URL{tr})
+	}
+
+	peers := append([]*Peer{}, m.Peers...)
+	for _, p := range peers {
+		p.Torrent = t
+	}
+	// the announce goes without an event, the download doesn't start before the
+	// metadata arrives (`left` isn't known yet either, see `Torrent.Left`)
+	if len(t.AnnounceList) > 0 || t.client.DHT != nil {
+		prs, err := t.GetPeers(ctx, EventNone, nil)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			output.DevWarnf("%v\n", err)
+		}
+		peers = append(peers, prs...)
+	}
+
+	if len(peers) == 0 {
+		return fmt.Errorf("no peers found to download the metadata from")
+	}
+
+	// downloading the info dictionary from the peers
+	info, raw, err := FetchMetadata(ctx, peers, m.InfoHash)
+
+	if err != nil {
+		return err
+	}
+
+	// building a metainfo dictionary, same as a `.torrent` file would
+	// have, each tracker of the magnet link gets a tier of it's own
+	annlst := []interface{}{}
+	for _, tr := range m.Trackers {
+		annlst = append(annlst, []interface{}{tr.String()})
+	}
+
+	dict := map[string]interface{}{"info": info}
+	if len(annlst) > 0 {
+		dict["announce"] = m.Trackers[0].String()
+		dict["announce-list"] = annlst
+	}
+
+	t.AnnounceList = nil
+	if err := t.Read(&dict); err != nil {
+		return err
+	}
+
+	// the metadata has already been verified against the infohash, the
+	// one `Torrent.Read` calculates by re-encoding the info dictionary
+	// may differ though, if the original encoding wasn't canonical. So
+	// it's the bytes that were verified that get served to the peers
+	t.InfoHash = m.InfoHash
+	t.metadata = raw
+
+	// fresh `Peer`s, as the ones used for the metadata have been disconnected
+	for _, p := range m.Peers {
+		t.xpeers = append(t.xpeers, &Peer{IP: p.IP, Port: p.Port, Torrent: t})
+	}
+
+	return nil
+}
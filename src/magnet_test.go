@@ -0,0 +1,86 @@
+package src
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	ih, _ := hex.DecodeString("c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+
+	tests := []struct {
+		name     string
+		uri      string
+		trackers []string
+		peers    []string
+		dn       string
+		fail     bool
+	}{
+		{name: "hex infohash", uri: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a"},
+		{name: "upper case hex", uri: "magnet:?xt=urn:btih:C12FE1C06BBA254A9DC9F519B335AA7C1367A88A"},
+		{name: "base32 infohash", uri: "magnet:?xt=urn:btih:yex6dqdlxisuvhoj6um3gnnkpqjwpkek"},
+		{
+			name:     "trackers, peers and name",
+			uri:      "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=some+file&tr=udp%3A%2F%2Ftracker.example.com%3A80&tr=http%3A%2F%2Fexample.org%2Fannounce&x.pe=127.0.0.1:6881&x.pe=[::1]:6882",
+			trackers: []string{"udp://tracker.example.com:80", "http://example.org/announce"},
+			peers:    []string{"127.0.0.1:6881", "[::1]:6882"},
+			dn:       "some file",
+		},
+		{
+			name:  "invalid peer addresses skipped",
+			uri:   "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&x.pe=nope&x.pe=127.0.0.1:6881",
+			peers: []string{"127.0.0.1:6881"},
+		},
+		{name: "other exact topics first", uri: "magnet:?xt=urn:sha1:abc&xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a"},
+		{name: "not a magnet link", uri: "http://example.com/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", fail: true},
+		{name: "no exact topic", uri: "magnet:?dn=some+file", fail: true},
+		{name: "no btih exact topic", uri: "magnet:?xt=urn:sha1:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", fail: true},
+		{name: "short infohash", uri: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9", fail: true},
+		{name: "invalid hex", uri: "magnet:?xt=urn:btih:z12fe1c06bba254a9dc9f519b335aa7c1367a88a", fail: true},
+		{name: "invalid base32", uri: "magnet:?xt=urn:btih:1ex6dqdlxisuvhoj6um3gnnkpqjwpkek", fail: true},
+		{name: "invalid uri", uri: "magnet:?xt=%zz", fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseMagnet(tt.uri)
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("parsed, infohash %x", m.InfoHash)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(m.InfoHash, ih) {
+				t.Fatalf("infohash %x, want %x", m.InfoHash, ih)
+			}
+			if m.Name != tt.dn {
+				t.Fatalf("name %q, want %q", m.Name, tt.dn)
+			}
+
+			if len(m.Trackers) != len(tt.trackers) {
+				t.Fatalf("%v trackers, want %v", len(m.Trackers), len(tt.trackers))
+			}
+			for i, tr := range m.Trackers {
+				if tr.String() != tt.trackers[i] {
+					t.Fatalf("tracker %v, want %v", tr, tt.trackers[i])
+				}
+			}
+
+			if len(m.Peers) != len(tt.peers) {
+				t.Fatalf("%v peers, want %v", len(m.Peers), len(tt.peers))
+			}
+			for i, p := range m.Peers {
+				if addr := net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port))); addr != tt.peers[i] {
+					t.Fatalf("peer %v, want %v", addr, tt.peers[i])
+				}
+			}
+		})
+	}
+}
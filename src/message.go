@@ -0,0 +1,379 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message ids of the peer wire protocol (BEP 3), the Fast Extension (BEP 6)
+// and the extended message (BEP 10)
+const (
+	MsgChoke         uint8 = 0
+	MsgUnchoke       uint8 = 1
+	MsgInterested    uint8 = 2
+	MsgNotInterested uint8 = 3
+	MsgHave          uint8 = 4
+	MsgBitfield      uint8 = 5
+	MsgRequest       uint8 = 6
+	MsgPiece         uint8 = 7
+	MsgCancel        uint8 = 8
+	MsgPort          uint8 = 9
+	MsgSuggest       uint8 = 13
+	MsgHaveAll       uint8 = 14
+	MsgHaveNone      uint8 = 15
+	MsgReject        uint8 = 16
+	MsgAllowedFast   uint8 = 17
+	MsgExtended      uint8 = 20
+)
+
+// HandshakeLength is the length of a handshake message (with the 19 byte protocol name)
+const HandshakeLength = 1 + 19 + 8 + 20 + 20
+
+/*
+MaxFrameLength is the longest message (length prefix excluded) accepted from a peer.
+Piece messages are limited to `MaxMessageLength`, but bitfields of torrents with a lot
+of pieces and extended messages can be longer than that
+*/
+var MaxFrameLength = 2 * 1024 * 1024
+
+// Message is a peer wire protocol message, `Bytes` returns the whole
+// message as it's sent over the wire (4-byte length prefix included)
+type Message interface {
+	Bytes() []byte
+}
+
+// KeepAliveMsg has no id or payload, only the length (0)
+type KeepAliveMsg struct{}
+
+// ChokeMsg tells that the peer won't answer our requests
+type ChokeMsg struct{}
+
+// UnchokeMsg tells that the peer will answer our requests
+type UnchokeMsg struct{}
+
+// InterestedMsg tells that the peer wants to download from us
+type InterestedMsg struct{}
+
+// NotInterestedMsg tells that the peer doesn't want to download from us
+type NotInterestedMsg struct{}
+
+// HaveMsg tells that the peer has the piece
+type HaveMsg struct {
+	Index uint32 // piece-index
+}
+
+// BitfieldMsg tells all the pieces that the peer has, a bit for each piece
+type BitfieldMsg struct {
+	Bitfield []byte
+}
+
+// RequestMsg requests a block
+type RequestMsg struct {
+	Index  uint32 // piece-index
+	Begin  uint32 // offset of the block within the piece
+	Length uint32 // length of the block
+}
+
+// PieceMsg holds the data of a block
+type PieceMsg struct {
+	Index uint32 // piece-index
+	Begin uint32 // offset of the block within the piece
+	Block []byte // block data
+}
+
+// CancelMsg cancels a block request
+type CancelMsg struct {
+	Index  uint32 // piece-index
+	Begin  uint32 // offset of the block within the piece
+	Length uint32 // length of the block
+}
+
+// PortMsg tells the port that the peer's DHT node listens on
+type PortMsg struct {
+	Port uint16
+}
+
+// SuggestMsg suggests a piece to download, usually one that the peer has in it's cache (BEP 6)
+type SuggestMsg struct {
+	Index uint32 // piece-index
+}
+
+// HaveAllMsg tells that the peer has all the pieces, in place of the bitfield (BEP 6)
+type HaveAllMsg struct{}
+
+// HaveNoneMsg tells that the peer has none of the pieces, in place of the bitfield (BEP 6)
+type HaveNoneMsg struct{}
+
+// RejectMsg tells that the peer won't answer a block request (BEP 6)
+type RejectMsg struct {
+	Index  uint32 // piece-index
+	Begin  uint32 // offset of the block within the piece
+	Length uint32 // length of the block
+}
+
+// AllowedFastMsg tells that the peer answers the requests for the piece, even while choking us (BEP 6)
+type AllowedFastMsg struct {
+	Index uint32 // piece-index
+}
+
+// ExtendedMsg is an extension protocol message (BEP 10)
+type ExtendedMsg struct {
+	ExtID   uint8  // extended message id, 0 for the extended handshake
+	Payload []byte // bencoded dictionary (may be followed by raw data)
+}
+
+// UnknownMsg is a message with an id that we don't know about
+type UnknownMsg struct {
+	ID      uint8
+	Payload []byte
+}
+
+// Bytes of a keep-alive message
+func (m *KeepAliveMsg) Bytes() []byte { return []byte{0, 0, 0, 0} }
+
+// Bytes of a choke message
+func (m *ChokeMsg) Bytes() []byte { return frame(MsgChoke) }
+
+// Bytes of an unchoke message
+func (m *UnchokeMsg) Bytes() []byte { return frame(MsgUnchoke) }
+
+// Bytes of an interested message
+func (m *InterestedMsg) Bytes() []byte { return frame(MsgInterested) }
+
+// Bytes of a not-interested message
+func (m *NotInterestedMsg) Bytes() []byte { return frame(MsgNotInterested) }
+
+// Bytes of a have message
+func (m *HaveMsg) Bytes() []byte { return frame(MsgHave, m.Index) }
+
+// Bytes of a bitfield message
+func (m *BitfieldMsg) Bytes() []byte { return frame(MsgBitfield, m.Bitfield) }
+
+// Bytes of a request message
+func (m *RequestMsg) Bytes() []byte { return frame(MsgRequest, m.Index, m.Begin, m.Length) }
+
+// Bytes of a piece message
+func (m *PieceMsg) Bytes() []byte { return frame(MsgPiece, m.Index, m.Begin, m.Block) }
+
+// Bytes of a cancel message
+func (m *CancelMsg) Bytes() []byte { return frame(MsgCancel, m.Index, m.Begin, m.Length) }
+
+// Bytes of a port message
+func (m *PortMsg) Bytes() []byte { return frame(MsgPort, m.Port) }
+
+// Bytes of an extended message
+func (m *ExtendedMsg) Bytes() []byte { return frame(MsgExtended, m.ExtID, m.Payload) }
+
+// Bytes of a suggest-piece message
+func (m *SuggestMsg) Bytes() []byte { return frame(MsgSuggest, m.Index) }
+
+// Bytes of a have-all message
+func (m *HaveAllMsg) Bytes() []byte { return frame(MsgHaveAll) }
+
+// Bytes of a have-none message
+func (m *HaveNoneMsg) Bytes() []byte { return frame(MsgHaveNone) }
+
+// Bytes of a reject-request message
+func (m *RejectMsg) Bytes() []byte { return frame(MsgReject, m.Index, m.Begin, m.Length) }
+
+// Bytes of an allowed-fast message
+func (m *AllowedFastMsg) Bytes() []byte { return frame(MsgAllowedFast, m.Index) }
+
+// Bytes of an unknown message
+func (m *UnknownMsg) Bytes() []byte { return frame(m.ID, m.Payload) }
+
+// frame builds a message, length prefix + id + the fields (big-endian)
+func frame(id uint8, fields ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{0, 0, 0, 0}) // length, filled in below
+	buf.WriteByte(id)
+	for _, f := range fields {
+		binary.Write(buf, binary.BigEndian, f)
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[:4], uint32(len(b)-4))
+	return b
+}
+
+/*
+ParseMessage parses a message (without the length prefix, so id + payload)
+into it's typed struct. An empty message is a keep-alive
+*/
+func ParseMessage(b []byte) (Message, error) {
+	if len(b) == 0 {
+		return &KeepAliveMsg{}, nil
+	}
+
+	id, payld := b[0], b[1:]
+	BE := binary.BigEndian
+
+	// the expected payload length of the fixed length messages
+	fixed := map[uint8]int{
+		MsgChoke: 0, MsgUnchoke: 0, MsgInterested: 0, MsgNotInterested: 0,
+		MsgHave: 4, MsgRequest: 12, MsgCancel: 12, MsgPort: 2,
+		MsgSuggest: 4, MsgHaveAll: 0, MsgHaveNone: 0, MsgReject: 12, MsgAllowedFast: 4,
+	}
+	if n, ok := fixed[id]; ok && len(payld) != n {
+		return nil, fmt.Errorf("invalid message, id=%v with %v bytes payload", id, len(payld))
+	}
+
+	switch id {
+	case MsgChoke:
+		return &ChokeMsg{}, nil
+	case MsgUnchoke:
+		return &UnchokeMsg{}, nil
+	case MsgInterested:
+		return &InterestedMsg{}, nil
+	case MsgNotInterested:
+		return &NotInterestedMsg{}, nil
+	case MsgHave:
+		return &HaveMsg{Index: BE.Uint32(payld)}, nil
+	case MsgBitfield:
+		return &BitfieldMsg{Bitfield: payld}, nil
+	case MsgRequest:
+		return &RequestMsg{Index: BE.Uint32(payld[0:4]), Begin: BE.Uint32(payld[4:8]), Length: BE.Uint32(payld[8:12])}, nil
+	case MsgCancel:
+		return &CancelMsg{Index: BE.Uint32(payld[0:4]), Begin: BE.Uint32(payld[4:8]), Length: BE.Uint32(payld[8:12])}, nil
+	case MsgPiece:
+		if len(payld) < 8 || 4+len(b) > MaxMessageLength {
+			return nil, fmt.Errorf("invalid piece message, %v bytes payload", len(payld))
+		}
+		return &PieceMsg{Index: BE.Uint32(payld[0:4]), Begin: BE.Uint32(payld[4:8]), Block: payld[8:]}, nil
+	case MsgPort:
+		return &PortMsg{Port: BE.Uint16(payld)}, nil
+	case MsgSuggest:
+		return &SuggestMsg{Index: BE.Uint32(payld)}, nil
+	case MsgHaveAll:
+		return &HaveAllMsg{}, nil
+	case MsgHaveNone:
+		return &HaveNoneMsg{}, nil
+	case MsgReject:
+		return &RejectMsg{Index: BE.Uint32(payld[0:4]), Begin: BE.Uint32(payld[4:8]), Length: BE.Uint32(payld[8:12])}, nil
+	case MsgAllowedFast:
+		return &AllowedFastMsg{Index: BE.Uint32(payld)}, nil
+	case MsgExtended:
+		if len(payld) < 1 {
+			return nil, fmt.Errorf("invalid extended message, no extended message id")
+		}
+		return &ExtendedMsg{ExtID: payld[0], Payload: payld[1:]}, nil
+	default:
+		return &UnknownMsg{ID: id, Payload: payld}, nil
+	}
+}
+
+/*
+Handshake is the first message sent on a peer connection, by both sides
+
+	pstrlen (1 byte) + pstr (19 bytes) + reserved (8 bytes) + info_hash (20 bytes) + peer_id (20 bytes)
+*/
+type Handshake struct {
+	Reserved [8]byte // reserved bytes, used to tell the supported extensions
+	InfoHash []byte  // 20-byte infohash of the torrent
+	PeerID   []byte  // 20-byte peer id
+}
+
+// Bytes of the handshake message
+func (hs *Handshake) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(uint8(len(PeerProtocolName)))
+	buf.Write(PeerProtocolName)
+	buf.Write(hs.Reserved[:])
+	buf.Write(hs.InfoHash)
+	buf.Write(hs.PeerID)
+	return buf.Bytes()
+}
+
+/*
+Wire reads and writes framed messages on a peer connection. Reads are buffered,
+and each read returns exactly one message, no matter how the data has been split
+or merged by the network. Writes are serialized, so multiple goroutines can send
+messages on the same connection
+*/
+type Wire struct {
+	last int64 // when was the last write (unix nanoseconds), accessed atomically (first, to be 64-bit aligned)
+	Conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+}
+
+// NewWire creates a `Wire` over the connection
+func NewWire(conn net.Conn) *Wire {
+	return &Wire{Conn: conn, r: bufio.NewReaderSize(conn, 64*1024), last: time.Now().UnixNano()}
+}
+
+// ReadHandshake reads exactly one handshake message (68 bytes)
+func (w *Wire) ReadHandshake() (*Handshake, error) {
+	b := make([]byte, HandshakeLength)
+	if _, err := io.ReadFull(w.r, b); err != nil {
+		return nil, err
+	}
+
+	if int(b[0]) != len(PeerProtocolName) || !bytes.Equal(b[1:20], PeerProtocolName) {
+		return nil, fmt.Errorf("invalid handshake message, unknown protocol")
+	}
+
+	hs := &Handshake{
+		InfoHash: append([]byte{}, b[28:48]...),
+		PeerID:   append([]byte{}, b[48:68]...),
+	}
+	copy(hs.Reserved[:], b[20:28])
+
+	return hs, nil
+}
+
+// WriteHandshake writes a handshake message
+func (w *Wire) WriteHandshake(hs *Handshake) error {
+	return w.write(hs.Bytes())
+}
+
+/*
+ReadMessage reads the 4-byte length prefix and then exactly that many
+bytes, and parses the message. A length of 0 is a keep-alive message
+*/
+func (w *Wire) ReadMessage() (Message, error) {
+	lb := make([]byte, 4)
+	if _, err := io.ReadFull(w.r, lb); err != nil {
+		return nil, err
+	}
+
+	lng := binary.BigEndian.Uint32(lb)
+	if int64(lng) > int64(MaxFrameLength) {
+		return nil, fmt.Errorf("invalid message, msg-length = %v bytes", lng+4)
+	}
+
+	b := make([]byte, lng)
+	if _, err := io.ReadFull(w.r, b); err != nil {
+		return nil, err
+	}
+
+	return ParseMessage(b)
+}
+
+// WriteMessage writes a message
+func (w *Wire) WriteMessage(m Message) error {
+	return w.write(m.Bytes())
+}
+
+// write writes the bytes on the connection, one writer at a time
+func (w *Wire) write(b []byte) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	_, err := w.Conn.Write(b)
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+	return err
+}
+
+// SinceWrite returns the time elapsed since the last write on the connection, it
+// doesn't wait for a write that's in progress (a slow peer could hold it up for long)
+func (w *Wire) SinceWrite() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&w.last)))
+}
@@ -0,0 +1,206 @@
+package src
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msgs := []Message{
+		&KeepAliveMsg{},
+		&ChokeMsg{},
+		&UnchokeMsg{},
+		&InterestedMsg{},
+		&NotInterestedMsg{},
+		&HaveMsg{Index: 0xdeadbeef},
+		&BitfieldMsg{Bitfield: []byte{0xff, 0x80}},
+		&RequestMsg{Index: 1, Begin: 16384, Length: 16384},
+		&PieceMsg{Index: 2, Begin: 32768, Block: bytes.Repeat([]byte{7}, LengthOfBlock)},
+		&CancelMsg{Index: 3, Begin: 0, Length: 100},
+		&PortMsg{Port: 6881},
+		&SuggestMsg{Index: 4},
+		&HaveAllMsg{},
+		&HaveNoneMsg{},
+		&RejectMsg{Index: 5, Begin: 16384, Length: 16384},
+		&AllowedFastMsg{Index: 6},
+		&ExtendedMsg{ExtID: 3, Payload: []byte("d1:ai1ee")},
+		&UnknownMsg{ID: 99, Payload: []byte{1, 2, 3}},
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	w, r := NewWire(a), NewWire(b)
+
+	go func() {
+		for _, m := range msgs {
+			if err := w.WriteMessage(m); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, want := range msgs {
+		got, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("%T, %v", want, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("read %#v, want %#v", got, want)
+		}
+	}
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	hs := &Handshake{InfoHash: bytes.Repeat([]byte{1}, 20), PeerID: []byte(GenPeerID())}
+	hs.Reserved[5] |= 0x10
+	hs.Reserved[7] |= fastBit
+
+	if n := len(hs.Bytes()); n != HandshakeLength {
+		t.Fatalf("handshake of %v bytes, want %v", n, HandshakeLength)
+	}
+
+	got, err := NewWire(fakeConn(hs.Bytes())).ReadHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, hs) {
+		t.Fatalf("read %#v, want %#v", got, hs)
+	}
+
+	// another protocol
+	b := hs.Bytes()
+	b[1] = 'b'
+	if _, err := NewWire(fakeConn(b)).ReadHandshake(); err == nil {
+		t.Fatal("handshake of an unknown protocol accepted")
+	}
+
+	// cut short
+	if _, err := NewWire(fakeConn(hs.Bytes()[:HandshakeLength-1])).ReadHandshake(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestParseMessageLengths(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte // id + payload
+		err  bool
+	}{
+		{"keep-alive", nil, false},
+		{"choke with a payload", []byte{MsgChoke, 0}, true},
+		{"interested with a payload", []byte{MsgInterested, 0}, true},
+		{"short have", []byte{MsgHave, 0, 0, 0}, true},
+		{"long have", []byte{MsgHave, 0, 0, 0, 0, 0}, true},
+		{"short request", append([]byte{MsgRequest}, make([]byte, 11)...), true},
+		{"long cancel", append([]byte{MsgCancel}, make([]byte, 13)...), true},
+		{"short port", []byte{MsgPort, 0}, true},
+		{"short suggest", []byte{MsgSuggest, 0, 0}, true},
+		{"have-all with a payload", []byte{MsgHaveAll, 0}, true},
+		{"have-none with a payload", []byte{MsgHaveNone, 0}, true},
+		{"short reject", append([]byte{MsgReject}, make([]byte, 8)...), true},
+		{"long allowed-fast", append([]byte{MsgAllowedFast}, make([]byte, 5)...), true},
+		{"piece without a block", append([]byte{MsgPiece}, make([]byte, 8)...), false},
+		{"piece shorter than the header", append([]byte{MsgPiece}, make([]byte, 7)...), true},
+		{"piece of the longest block", append([]byte{MsgPiece}, make([]byte, 8+LengthOfBlock)...), false},
+		{"piece longer than a block", append([]byte{MsgPiece}, make([]byte, 8+LengthOfBlock+1)...), true},
+		{"extended without an id", []byte{MsgExtended}, true},
+		{"extended handshake", []byte{MsgExtended, 0}, false},
+		{"empty bitfield", []byte{MsgBitfield}, false},
+		{"unknown", []byte{200, 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseMessage(tt.b)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want an error %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadMessageLimits(t *testing.T) {
+	prefix := func(n uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, n)
+		return b
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string // empty if the message has to be read
+	}{
+		{"longest frame", append(prefix(uint32(MaxFrameLength)), append([]byte{MsgBitfield}, make([]byte, MaxFrameLength-1)...)...), ""},
+		{"longer than a frame", append(prefix(uint32(MaxFrameLength)+1), MsgBitfield), "invalid message"},
+		{"length prefix near the limit of uint32", prefix(0xffffffff), "invalid message"},
+		{"short length prefix", []byte{0, 0}, io.ErrUnexpectedEOF.Error()},
+		{"short payload", append(prefix(13), MsgRequest, 0, 0, 0), io.ErrUnexpectedEOF.Error()},
+		{"nothing", nil, io.EOF.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewWire(fakeConn(tt.data)).ReadMessage()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSinceWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	w := NewWire(a)
+
+	// a write that's stuck, as nothing reads the other end
+	time.Sleep(50 * time.Millisecond)
+	go w.WriteMessage(&ChokeMsg{})
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan time.Duration, 1)
+	go func() { done <- w.SinceWrite() }()
+
+	select {
+	case d := <-done:
+		if d < 50*time.Millisecond {
+			t.Fatalf("%v since the last write, want at least 50ms", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waited on the write in progress")
+	}
+
+	// once the write is through
+	if _, err := NewWire(b).ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if d := w.SinceWrite(); d > 50*time.Millisecond {
+		t.Fatalf("%v since the last write, just after one", d)
+	}
+}
+
+// fakeConn is a connection that reads the data, and then EOF
+func fakeConn(data []byte) net.Conn {
+	a, b := net.Pipe()
+	go func() {
+		b.Write(data)
+		b.Close()
+	}()
+	return a
+}
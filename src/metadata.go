@@ -0,0 +1,346 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/marksamman/bencode"
+	"github.com/ritsource/torrent-client/output"
+)
+
+// MetadataPieceLength is the size of each piece of metadata (BEP 9), 16 KiB
+const MetadataPieceLength = 16384
+
+// MaxMetadataSize is the largest info dictionary that we accept from a peer
+const MaxMetadataSize = 8 * 1024 * 1024
+
+// MetadataTimeout is how long a single peer gets to send the whole metadata
+var MetadataTimeout = 30 * time.Second
+
+// utMetadataID is the extended message id that we assign to `ut_metadata`,
+// sent in the `m` dictionary of our extended handshake
+var utMetadataID = RegisterExtension("ut_metadata", metadataExtension{})
+
+// Constants corrosponding to `msg_type` of `ut_metadata` messages
+const (
+	metadataRequest uint8 = 0
+	metadataData    uint8 = 1
+	metadataReject  uint8 = 2
+)
+
+// errMetadataUnsupported is returned when a peer doesn't support `ut_metadata`
+var errMetadataUnsupported = errors.New("peer doesn't support metadata exchange")
+
+/*
+FetchMetadata downloads the info dictionary (metadata) of a torrent from the
+peers, concurrently. The first metadata whose SHA1 hash matches the infohash
+gets decoded and returned (as a dictionary), along with the bytes that were
+verified. Cancelling the context abandons the downloads that are still in progress
+*/
+func FetchMetadata(ctx context.Context, peers []*Peer, infohash []byte) (map[string]interface{}, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	ch := make(chan result, len(peers))
+
+	for _, p := range peers {
+		go func(p *Peer) {
+			data, err := p.fetchMetadata(ctx, infohash)
+			ch <- result{data, err}
+		}(p)
+	}
+
+	var lasterr error
+	for range peers {
+		var r result
+		select {
+		case r = <-ch:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if r.err != nil {
+			lasterr = r.err
+			continue
+		}
+
+		info, err := bencode.Decode(bytes.NewReader(r.data))
+		if err != nil {
+			lasterr = err
+			continue
+		}
+
+		return info, r.data, nil
+	}
+
+	return nil, nil, fmt.Errorf("couldn't download metadata from any peer, %v", lasterr)
+}
+
+/*
+fetchMetadata connects to the peer and downloads the metadata from it. It
+sends a handshake with the extension protocol bit set, exchanges extended
+handshakes and then requests every piece of the metadata (BEP 9). The peer
+gets disconnected once it's done, whether successful or not
+*/
+func (p *Peer) fetchMetadata(ctx context.Context, infohash []byte) ([]byte, error) {
+	addr := net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+
+	// encrypted (MSE) or not, depending on the client's encryption policy
+	dctx, cancel := context.WithTimeout(ctx, MetadataTimeout)
+	conn, _, err := p.Torrent.client.dialPeer(dctx, addr, infohash)
+	cancel()
+	if err != nil {
+		output.DevWarnf("couldn't establish TCP connection, %v | %v\n", err, addr)
+		return nil, err
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+
+	// the whole exchange has to be done within `MetadataTimeout`
+	conn.SetDeadline(time.Now().Add(MetadataTimeout))
+	w := NewWire(conn)
+
+	// handshake, with the extension protocol bit set in the reserved bytes
+	hs := &Handshake{InfoHash: infohash, PeerID: []byte(p.Torrent.client.PeerID)}
+	hs.Reserved[5] |= 0x10
+	if err := w.WriteHandshake(hs); err != nil {
+		return nil, err
+	}
+
+	phs, err := w.ReadHandshake()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read handshake, %v", err)
+	}
+	if !bytes.Equal(phs.InfoHash, infohash) {
+		return nil, fmt.Errorf("invalid handshake message")
+	}
+	if phs.Reserved[5]&0x10 == 0 {
+		return nil, errMetadataUnsupported
+	}
+
+	// sending our extended handshake, letting the peer know
+	// which extended message id we use for `ut_metadata`
+	err = w.WriteMessage(extMsg(0, map[string]interface{}{
+		"m": map[string]interface{}{"ut_metadata": int(utMetadataID)},
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		peerID  uint8  // peer's extended message id for `ut_metadata`
+		size    int    // size of the metadata, from the peer's extended handshake
+		pieces  int    // number of metadata pieces
+		data    []byte // the metadata
+		recvd   []bool // which pieces have been received
+		pending int    // number of pieces not yet received
+	)
+
+	for {
+		msg, err := w.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		// only extended messages matter here, the bitfield,
+		// have and other messages are ignored
+		em, ok := msg.(*ExtendedMsg)
+		if !ok {
+			continue
+		}
+
+		dict, n, err := decodeExtPayload(em.Payload)
+		if err != nil {
+			return nil, err
+		}
+
+		// extended handshake (extended message id = 0)
+		if em.ExtID == 0 {
+			m, _ := dict["m"].(map[string]interface{})
+			id, ok := m["ut_metadata"].(int64)
+			if !ok || id == 0 {
+				return nil, errMetadataUnsupported
+			}
+			sz, ok := dict["metadata_size"].(int64)
+			if !ok || sz <= 0 || sz > MaxMetadataSize {
+				return nil, fmt.Errorf("invalid metadata size, %v", sz)
+			}
+
+			peerID = uint8(id)
+			size = int(sz)
+			pieces = (size + MetadataPieceLength - 1) / MetadataPieceLength
+			data = make([]byte, size)
+			recvd = make([]bool, pieces)
+			pending = pieces
+
+			output.DevInfof("metadata size %v bytes, %v pieces | %v\n", size, pieces, addr)
+
+			// requesting all the pieces at once
+			for i := 0; i < pieces; i++ {
+				err := w.WriteMessage(extMsg(peerID, map[string]interface{}{
+					"msg_type": int(metadataRequest),
+					"piece":    i,
+				}))
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		// `ut_metadata` message, we told the peer to use `utMetadataID`
+		if em.ExtID != utMetadataID || data == nil {
+			continue
+		}
+
+		typ, _ := dict["msg_type"].(int64)
+		idx, _ := dict["piece"].(int64)
+
+		switch uint8(typ) {
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata request, piece=%v", idx)
+
+		case metadataData:
+			if idx < 0 || int(idx) >= pieces {
+				return nil, fmt.Errorf("invalid metadata piece index, %v", idx)
+			}
+
+			// the piece data follows the bencoded dictionary
+			blk := em.Payload[n:]
+			beg := int(idx) * MetadataPieceLength
+			if beg+len(blk) > size || (int(idx) < pieces-1 && len(blk) != MetadataPieceLength) {
+				return nil, fmt.Errorf("invalid metadata piece length, %v", len(blk))
+			}
+			copy(data[beg:], blk)
+
+			if !recvd[idx] {
+				recvd[idx] = true
+				pending--
+			}
+		}
+
+		if pending == 0 {
+			break
+		}
+	}
+
+	hash, err := GetSHA1(data)
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(hash, infohash) {
+		return nil, fmt.Errorf("metadata hash doesn't match, %x != %x", hash, infohash)
+	}
+
+	output.DevInfof("metadata downloaded, %v bytes | %v\n", size, addr)
+	return data, nil
+}
+
+// metadataExtension serves the metadata to the peers on the download connections
+// (BEP 9), for the ones that have joined from a magnet link
+type metadataExtension struct{}
+
+// Handshake of `ut_metadata`, there's nothing to set up
+func (metadataExtension) Handshake(p *Peer, hs map[string]interface{}) error {
+	return nil
+}
+
+// Handle answers the metadata requests with the pieces of the metadata, or rejects
+// them if we don't have the metadata yet. The metadata is only ever downloaded
+// on connections of it's own (see `fetchMetadata`), the rest is ignored
+func (metadataExtension) Handle(p *Peer, dict map[string]interface{}, data []byte) error {
+	typ, _ := dict["msg_type"].(int64)
+	if uint8(typ) != metadataRequest {
+		return nil
+	}
+
+	idx, _ := dict["piece"].(int64)
+	md := p.Torrent.metadata
+	beg := int(idx) * MetadataPieceLength
+
+	if len(md) == 0 || idx < 0 || beg >= len(md) {
+		return p.SendExtended("ut_metadata", map[string]interface{}{
+			"msg_type": int(metadataReject),
+			"piece":    int(idx),
+		}, nil)
+	}
+
+	end := beg + MetadataPieceLength
+	if end > len(md) {
+		end = len(md)
+	}
+
+	return p.SendExtended("ut_metadata", map[string]interface{}{
+		"msg_type":   int(metadataData),
+		"piece":      int(idx),
+		"total_size": len(md),
+	}, md[beg:end])
+}
+
+// extMsg builds an extended message with a bencoded dictionary as the payload
+func extMsg(extID uint8, dict map[string]interface{}) *ExtendedMsg {
+	return &ExtendedMsg{ExtID: extID, Payload: bencode.Encode(dict)}
+}
+
+// decodeExtPayload decodes the bencoded dictionary at the start of an extended
+// message payload, and returns it with it's length (anything after is raw data)
+func decodeExtPayload(b []byte) (map[string]interface{}, int, error) {
+	n, err := bencodeLen(b, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dict, err := bencode.Decode(bytes.NewReader(b[:n]))
+	return dict, n, err
+}
+
+// bencodeLen returns the offset where the bencoded value starting at `i` ends
+func bencodeLen(b []byte, i int) (int, error) {
+	if i >= len(b) {
+		return 0, errors.New("unexpected end of bencoded data")
+	}
+
+	switch b[i] {
+	case 'i':
+		e := bytes.IndexByte(b[i:], 'e')
+		if e < 0 {
+			return 0, errors.New("unterminated bencoded integer")
+		}
+		return i + e + 1, nil
+
+	case 'l', 'd':
+		i++
+		for i < len(b) && b[i] != 'e' {
+			var err error
+			i, err = bencodeLen(b, i)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(b) {
+			return 0, errors.New("unterminated bencoded list or dictionary")
+		}
+		return i + 1, nil
+
+	default:
+		c := bytes.IndexByte(b[i:], ':')
+		if c < 0 {
+			return 0, errors.New("invalid bencoded string")
+		}
+		n, err := strconv.Atoi(string(b[i : i+c]))
+		if err != nil || n < 0 || i+c+1+n > len(b) {
+			return 0, errors.New("invalid bencoded string length")
+		}
+		return i + c + 1 + n, nil
+	}
+}
@@ -0,0 +1,182 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+// rawInfo is the bencoded info dictionary of a single file of 100 bytes, the keys aren't
+// in order (it isn't canonical bencode) and it's padded past two metadata pieces
+var rawInfo = []byte("d4:name1:a6:pieces20:" + strings.Repeat("h", 20) + "12:piece lengthi16384e6:lengthi100e" +
+	"7:padding" + fmt.Sprint(2*MetadataPieceLength) + ":" + strings.Repeat("p", 2*MetadataPieceLength) + "e")
+
+// metadataPeer serves the metadata (BEP 9) on loopback, each piece goes through `piece`
+// (if it's not nil), which returns the piece index and the data to send in it's place
+func metadataPeer(t *testing.T, md []byte, piece func(idx int, blk []byte) (int, []byte)) *Peer {
+	ih := sha1.Sum(md)
+
+	addr := listen(t, func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		w := NewWire(conn)
+		if _, err := w.ReadHandshake(); err != nil {
+			return
+		}
+		hs := &Handshake{InfoHash: ih[:], PeerID: []byte(GenPeerID())}
+		hs.Reserved[5] |= 0x10
+		w.WriteHandshake(hs)
+
+		for {
+			msg, err := w.ReadMessage()
+			if err != nil {
+				return
+			}
+			em, ok := msg.(*ExtendedMsg)
+			if !ok {
+				continue
+			}
+
+			// answering the extended handshake with our own, and
+			// the requests with the pieces (we use id 3 for `ut_metadata`)
+			if em.ExtID == 0 {
+				w.WriteMessage(extMsg(0, map[string]interface{}{
+					"m":             map[string]interface{}{"ut_metadata": 3},
+					"metadata_size": len(md),
+				}))
+				continue
+			}
+
+			dict, _, err := decodeExtPayload(em.Payload)
+			if err != nil || em.ExtID != 3 {
+				return
+			}
+			idx := int(dict["piece"].(int64))
+			end := (idx + 1) * MetadataPieceLength
+			if end > len(md) {
+				end = len(md)
+			}
+			blk := md[idx*MetadataPieceLength : end]
+			if piece != nil {
+				idx, blk = piece(idx, blk)
+			}
+
+			m := extMsg(utMetadataID, map[string]interface{}{
+				"msg_type":   int(metadataData),
+				"piece":      idx,
+				"total_size": len(md),
+			})
+			m.Payload = append(m.Payload, blk...)
+			w.WriteMessage(m)
+		}
+	})
+
+	c := mseClient(EncryptionDisabled)
+	c.PeerID = GenPeerID()
+	host, port, _ := net.SplitHostPort(addr)
+	var pn uint16
+	fmt.Sscan(port, &pn)
+	return &Peer{IP: net.ParseIP(host), Port: pn, Torrent: &Torrent{client: c}}
+}
+
+func TestReadMagnetMetadata(t *testing.T) {
+	p := metadataPeer(t, rawInfo, nil)
+	ih := sha1.Sum(rawInfo)
+
+	// the re-encoded dictionary is canonical, so it isn't the metadata we got
+	info, err := bencode.Decode(bytes.NewReader(rawInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(bencode.Encode(info), rawInfo) {
+		t.Fatal("the info dictionary is canonical")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tr := &Torrent{client: p.Torrent.client}
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%x&x.pe=%v:%v", ih, p.IP, p.Port)
+	if err := tr.ReadMagnet(ctx, uri); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tr.InfoHash, ih[:]) {
+		t.Fatalf("infohash %x, want %x", tr.InfoHash, ih)
+	}
+	if !bytes.Equal(tr.metadata, rawInfo) {
+		t.Fatal("the metadata served isn't the one that was verified")
+	}
+	if tr.Size != 100 || len(tr.Pieces) != 1 {
+		t.Fatalf("%v bytes in %v pieces, want 100 bytes in 1", tr.Size, len(tr.Pieces))
+	}
+}
+
+func TestFetchMetadataPieces(t *testing.T) {
+	ih := sha1.Sum(rawInfo)
+	last := len(rawInfo) / MetadataPieceLength
+
+	tests := []struct {
+		name  string
+		piece func(idx int, blk []byte) (int, []byte)
+		err   string // empty if the metadata has to be assembled
+	}{
+		{"in order", nil, ""},
+		{"index out of range", func(idx int, blk []byte) (int, []byte) {
+			if idx == last {
+				return last + 1, blk
+			}
+			return idx, blk
+		}, "invalid metadata piece index"},
+		{"negative index", func(idx int, blk []byte) (int, []byte) { return -1, blk }, "invalid metadata piece index"},
+		{"short piece", func(idx int, blk []byte) (int, []byte) {
+			if idx == 0 {
+				return idx, blk[:len(blk)-1]
+			}
+			return idx, blk
+		}, "invalid metadata piece length"},
+		{"last piece too long", func(idx int, blk []byte) (int, []byte) {
+			if idx == last {
+				return idx, append(append([]byte{}, blk...), 'x')
+			}
+			return idx, blk
+		}, "invalid metadata piece length"},
+		{"corrupted piece", func(idx int, blk []byte) (int, []byte) {
+			if idx == 1 {
+				blk = append([]byte{}, blk...)
+				blk[0] ^= 0xff
+			}
+			return idx, blk
+		}, "metadata hash doesn't match"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := metadataPeer(t, rawInfo, tt.piece)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			md, err := p.fetchMetadata(ctx, ih[:])
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(md, rawInfo) {
+				t.Fatal("wrong metadata assembled")
+			}
+		})
+	}
+}
@@ -0,0 +1,450 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+// Encryption policies of the peer connections (MSE/PE), see `Config.Encryption`
+const (
+	EncryptionDisabled = "disabled" // plaintext only, the encrypted incoming connections are refused
+	EncryptionPrefer   = "prefer"   // RC4 whenever the peer supports it, plaintext otherwise
+	EncryptionRequire  = "require"  // RC4 only, the plaintext connections are refused both ways
+)
+
+// crypto_provide and crypto_select bits of the MSE handshake
+const (
+	msePlaintext uint32 = 0x01
+	mseRC4       uint32 = 0x02
+)
+
+// MSETimeout is how long the MSE handshake can take, on both sides
+var MSETimeout = 30 * time.Second
+
+// MSEKeyTimeout is how long to wait for the peer's public key (Yb), the first thing it
+// sends back. A peer without MSE support might just wait for a BitTorrent handshake that
+// never comes, with `EncryptionPrefer` it's dialed again for plaintext once this runs out
+var MSEKeyTimeout = 5 * time.Second
+
+// mseMaxPad is the longest padding allowed in the MSE handshake
+const mseMaxPad = 512
+
+// mseP is the 768-bit prime of the Diffie-Hellman key exchange (the generator is 2)
+var mseP, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+// mseVC is the verification constant, 8 zero bytes
+var mseVC = make([]byte, 8)
+
+// errMSEPlaintext is returned when the peer (or our policy) doesn't allow the encryption that is required
+var errMSEPlaintext = errors.New("encryption required, but not supported by the other side")
+
+/*
+dialPeer establishes a connection with the peer (over uTP or TCP, see `dial`), and an encrypted one (MSE) if the
+client's encryption policy says so. With `EncryptionPrefer` a peer that fails the MSE
+handshake (or doesn't send it's key within `MSEKeyTimeout`) gets dialed again, for a
+plaintext connection. It returns if the connection
+is encrypted (RC4, the plaintext crypto method doesn't count)
+*/
+func (c *Client) dialPeer(ctx context.Context, addr string, infohash []byte) (net.Conn, bool, error) {
+	conn, err := c.dial(ctx, addr)
+	if err != nil || c.Config.Encryption == EncryptionDisabled {
+		return conn, false, err
+	}
+
+	provide := msePlaintext | mseRC4
+	if c.Config.Encryption == EncryptionRequire {
+		provide = mseRC4
+	}
+
+	econn, sel, err := mseInitiate(ctx, conn, infohash, provide)
+	if err == nil {
+		return econn, sel == mseRC4, nil
+	}
+	conn.Close()
+
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
+	}
+	if c.Config.Encryption == EncryptionRequire {
+		return nil, false, err
+	}
+
+	// the peer probably doesn't support MSE at all
+	output.DevInfof("mse handshake failed, %v, trying plaintext | %v\n", err, addr)
+	conn, err = c.dial(ctx, addr)
+	return conn, false, err
+}
+
+/*
+acceptPeer tells an encrypted incoming connection from a plaintext one, by the first
+bytes (a plaintext handshake starts with the protocol name), and does the receiving
+side of the MSE handshake if it's encrypted. The infohash of the connection has to be
+of one of our torrents. The connection is refused if our encryption policy doesn't allow
+it's encryption. It returns if the connection is encrypted (RC4)
+*/
+func (c *Client) acceptPeer(conn net.Conn) (net.Conn, bool, error) {
+	br := bufio.NewReader(conn)
+
+	b, err := br.Peek(1 + len(PeerProtocolName))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int(b[0]) == len(PeerProtocolName) && bytes.Equal(b[1:], PeerProtocolName) {
+		if c.Config.Encryption == EncryptionRequire {
+			return nil, false, errMSEPlaintext
+		}
+		return &cryptoConn{Conn: conn, r: br}, false, nil
+	}
+
+	if c.Config.Encryption == EncryptionDisabled {
+		return nil, false, fmt.Errorf("encrypted connection, but encryption is disabled")
+	}
+
+	allow := msePlaintext | mseRC4
+	if c.Config.Encryption == EncryptionRequire {
+		allow = mseRC4
+	}
+
+	econn, sel, err := mseAccept(conn, br, c.skey, allow)
+	if err != nil {
+		return nil, false, err
+	}
+	return econn, sel == mseRC4, nil
+}
+
+// skey returns the infohash of our torrent that matches HASH('req2', SKEY), nil if none does
+func (c *Client) skey(req2 []byte) []byte {
+	for _, t := range c.Torrents() {
+		if bytes.Equal(mseHash("req2", t.InfoHash), req2) {
+			return t.InfoHash
+		}
+	}
+	return nil
+}
+
+/*
+cryptoConn is a peer connection after the MSE handshake. The data read goes
+through `r`, that has the bytes read ahead during the handshake first (and decrypts
+the rest, with RC4), and the data written gets encrypted, unless the plaintext
+crypto method was selected (`enc` nil). On the receiving side, `skey` is the infohash
+that the MSE handshake was done for, the BitTorrent handshake has to be for the same
+torrent (it's nil for a plaintext connection)
+*/
+type cryptoConn struct {
+	net.Conn
+	r    io.Reader
+	wmu  sync.Mutex
+	enc  cipher.Stream
+	skey []byte
+}
+
+// Read reads (and decrypts) data from the connection
+func (c *cryptoConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write encrypts the data and writes it on the connection
+func (c *cryptoConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	// the key stream has to be used in the same order the data is written
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+/*
+mseInitiate does the initiating side (A) of the MSE handshake over the connection, for
+the torrent of the infohash (SKEY). `provide` has the crypto methods we support, the
+peer selects one of them, and the connection of the selected method is returned. The
+steps are,
+
+ 1. A->B: Ya, PadA
+ 2. B->A: Yb, PadB
+ 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+ 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+ 5. A->B: ENCRYPT2(Payload Stream)
+
+where S is the Diffie-Hellman secret, the RC4 keys are HASH('keyA', S, SKEY) and HASH('keyB',
+S, SKEY), with the first 1024 bytes of the key streams discarded. We send no initial payload
+(IA), the BitTorrent handshake follows the MSE handshake
+*/
+func mseInitiate(ctx context.Context, conn net.Conn, infohash []byte, provide uint32) (net.Conn, uint32, error) {
+	defer closeOnCancel(ctx, conn)()
+	deadline := time.Now().Add(MSETimeout)
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	x, y := mseKeys()
+	if _, err := conn.Write(append(y, msePad()...)); err != nil {
+		return nil, 0, err
+	}
+
+	// the peer's key has to arrive a lot sooner than the whole handshake takes
+	conn.SetReadDeadline(time.Now().Add(MSEKeyTimeout))
+	br := bufio.NewReader(conn)
+	yb := make([]byte, 96)
+	if _, err := io.ReadFull(br, yb); err != nil {
+		return nil, 0, err
+	}
+	conn.SetReadDeadline(deadline)
+	s := mseSecret(yb, x)
+
+	enc := mseCipher("keyA", s, infohash)
+	dec := mseCipher("keyB", s, infohash)
+
+	// HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S)
+	buf := new(bytes.Buffer)
+	buf.Write(mseHash("req1", s))
+	buf.Write(xorBytes(mseHash("req2", infohash), mseHash("req3", s)))
+
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), no PadC or IA
+	plain := new(bytes.Buffer)
+	plain.Write(mseVC)
+	binary.Write(plain, binary.BigEndian, provide)
+	binary.Write(plain, binary.BigEndian, uint16(0))
+	binary.Write(plain, binary.BigEndian, uint16(0))
+	encd := make([]byte, plain.Len())
+	enc.XORKeyStream(encd, plain.Bytes())
+	buf.Write(encd)
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, 0, err
+	}
+
+	// PadB is of a random length, the encrypted VC marks where it ends
+	vc := make([]byte, 8)
+	dec.XORKeyStream(vc, mseVC)
+	if err := mseSync(br, vc, mseMaxPad+8); err != nil {
+		return nil, 0, err
+	}
+
+	// ENCRYPT(crypto_select, len(padD), padD)
+	hdr := make([]byte, 6)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(hdr, hdr)
+
+	sel := binary.BigEndian.Uint32(hdr[0:4])
+	if sel&provide == 0 || (sel != msePlaintext && sel != mseRC4) {
+		return nil, 0, fmt.Errorf("invalid crypto_select, %v", sel)
+	}
+
+	padD := int(binary.BigEndian.Uint16(hdr[4:6]))
+	if padD > mseMaxPad {
+		return nil, 0, fmt.Errorf("invalid padD length, %v", padD)
+	}
+	pad := make([]byte, padD)
+	if _, err := io.ReadFull(br, pad); err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(pad, pad)
+
+	if sel == msePlaintext {
+		return &cryptoConn{Conn: conn, r: br}, sel, nil
+	}
+	return &cryptoConn{Conn: conn, r: cipher.StreamReader{S: dec, R: br}, enc: enc}, sel, nil
+}
+
+/*
+mseAccept does the receiving side (B) of the MSE handshake (see `mseInitiate` for
+the steps), the data already read from the connection is in `br`. The infohash
+(SKEY) is found by `skey`, from HASH('req2', SKEY), and RC4 is selected if both
+sides allow it. The initial payload (IA) of the initiator is read first, from the
+connection returned, that has the infohash as it's `skey`
+*/
+func mseAccept(conn net.Conn, br *bufio.Reader, skey func(req2 []byte) []byte, allow uint32) (net.Conn, uint32, error) {
+	conn.SetDeadline(time.Now().Add(MSETimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ya := make([]byte, 96)
+	if _, err := io.ReadFull(br, ya); err != nil {
+		return nil, 0, err
+	}
+
+	x, y := mseKeys()
+	if _, err := conn.Write(append(y, msePad()...)); err != nil {
+		return nil, 0, err
+	}
+	s := mseSecret(ya, x)
+
+	// PadA is of a random length, HASH('req1', S) marks where it ends
+	if err := mseSync(br, mseHash("req1", s), mseMaxPad+20); err != nil {
+		return nil, 0, err
+	}
+
+	h := make([]byte, 20)
+	if _, err := io.ReadFull(br, h); err != nil {
+		return nil, 0, err
+	}
+	infohash := skey(xorBytes(h, mseHash("req3", s)))
+	if infohash == nil {
+		return nil, 0, fmt.Errorf("mse handshake for an unknown torrent")
+	}
+
+	dec := mseCipher("keyA", s, infohash)
+	enc := mseCipher("keyB", s, infohash)
+
+	// ENCRYPT(VC, crypto_provide, len(PadC))
+	hdr := make([]byte, 14)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(hdr, hdr)
+
+	if !bytes.Equal(hdr[0:8], mseVC) {
+		return nil, 0, fmt.Errorf("invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(hdr[8:12])
+
+	padC := int(binary.BigEndian.Uint16(hdr[12:14]))
+	if padC > mseMaxPad {
+		return nil, 0, fmt.Errorf("invalid padC length, %v", padC)
+	}
+
+	// PadC, len(IA), and the initial payload
+	rest := make([]byte, padC+2)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(rest, rest)
+
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padC:]))
+	if _, err := io.ReadFull(br, ia); err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var sel uint32
+	switch {
+	case provide&allow&mseRC4 != 0:
+		sel = mseRC4
+	case provide&allow&msePlaintext != 0:
+		sel = msePlaintext
+	default:
+		return nil, 0, errMSEPlaintext
+	}
+
+	// ENCRYPT(VC, crypto_select, len(padD)), no padD
+	plain := new(bytes.Buffer)
+	plain.Write(mseVC)
+	binary.Write(plain, binary.BigEndian, sel)
+	binary.Write(plain, binary.BigEndian, uint16(0))
+	encd := make([]byte, plain.Len())
+	enc.XORKeyStream(encd, plain.Bytes())
+
+	if _, err := conn.Write(encd); err != nil {
+		return nil, 0, err
+	}
+
+	if sel == msePlaintext {
+		return &cryptoConn{Conn: conn, r: io.MultiReader(bytes.NewReader(ia), br), skey: infohash}, sel, nil
+	}
+	r := io.MultiReader(bytes.NewReader(ia), cipher.StreamReader{S: dec, R: br})
+	return &cryptoConn{Conn: conn, r: r, enc: enc, skey: infohash}, sel, nil
+}
+
+// mseKeys generates a Diffie-Hellman key pair, the 160-bit private key
+// and the public key (2 ^ private mod P), as 96 bytes
+func mseKeys() (*big.Int, []byte) {
+	b := make([]byte, 20)
+	rand.Read(b)
+	x := new(big.Int).SetBytes(b)
+
+	y := new(big.Int).Exp(big.NewInt(2), x, mseP)
+	return x, padLeft(y.Bytes(), 96)
+}
+
+// mseSecret computes the shared secret S, from the other side's
+// public key and our private key, as 96 bytes
+func mseSecret(y []byte, x *big.Int) []byte {
+	s := new(big.Int).Exp(new(big.Int).SetBytes(y), x, mseP)
+	return padLeft(s.Bytes(), 96)
+}
+
+// mseCipher creates the RC4 stream of the key HASH(name, S, SKEY), with
+// the first 1024 bytes of the key stream discarded
+func mseCipher(name string, s, skey []byte) cipher.Stream {
+	c, _ := rc4.NewCipher(mseHash(name, s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// mseHash returns the SHA1 hash of the name and the values, concatenated
+func mseHash(name string, vals ...[]byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(name))
+	for _, v := range vals {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+// msePad returns a random padding, of a random length up to `mseMaxPad`
+func msePad() []byte {
+	pad := make([]byte, mrand.Intn(mseMaxPad+1))
+	rand.Read(pad)
+	return pad
+}
+
+// mseSync reads from `r` until the marker has been read, the marker has
+// to end within `max` bytes. The bytes before the marker are discarded
+func mseSync(r *bufio.Reader, marker []byte, max int) error {
+	buf := make([]byte, 0, max)
+	for len(buf) < max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+
+		if bytes.HasSuffix(buf, marker) {
+			return nil
+		}
+	}
+	return fmt.Errorf("mse handshake marker not found")
+}
+
+// xorBytes returns a xor b, they have to be of the same length
+func xorBytes(a, b []byte) []byte {
+	x := make([]byte, len(a))
+	for i := range a {
+		x[i] = a[i] ^ b[i]
+	}
+	return x
+}
+
+// padLeft pads the big-endian number with leading zeros, to the length
+func padLeft(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+	return append(make([]byte, n-len(b)), b...)
+}
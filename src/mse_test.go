@@ -0,0 +1,396 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a TCP connection over loopback
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a, b
+}
+
+// listen accepts connections on loopback, each one is handed to `serve` (in a goroutine of it's own)
+func listen(t *testing.T, serve func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// mseClient creates a client with the encryption policy, that has the torrents of the infohashes
+func mseClient(policy string, infohashes ...[]byte) *Client {
+	c := &Client{Config: Config{Encryption: policy}, torrents: make(map[string]*Torrent)}
+	for _, ih := range infohashes {
+		c.torrents[string(ih)] = &Torrent{InfoHash: ih}
+	}
+	return c
+}
+
+func randomInfohash() []byte {
+	ih := make([]byte, 20)
+	rand.Read(ih)
+	return ih
+}
+
+// exchange sends a message each way over the connections, they have to arrive as they were sent
+func exchange(t *testing.T, a, b net.Conn) {
+	for _, c := range [][2]net.Conn{{a, b}, {b, a}} {
+		msg := []byte("some data to be sent, " + c[0].LocalAddr().String())
+		errc := make(chan error, 1)
+		go func(w net.Conn) {
+			_, err := w.Write(msg)
+			errc <- err
+		}(c[0])
+
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c[1], got); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("got %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestMSEHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		provide uint32 // crypto methods of the initiator
+		allow   uint32 // crypto methods of the receiver
+		sel     uint32 // the selected method, 0 if the handshake has to fail
+	}{
+		{"rc4 preferred", msePlaintext | mseRC4, msePlaintext | mseRC4, mseRC4},
+		{"rc4 required", mseRC4, msePlaintext | mseRC4, mseRC4},
+		{"plaintext selected", msePlaintext | mseRC4, msePlaintext, msePlaintext},
+		{"rc4 required, plaintext allowed", mseRC4, msePlaintext, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := tcpPair(t)
+			ih := randomInfohash()
+			c := mseClient(EncryptionPrefer, ih)
+
+			type result struct {
+				conn net.Conn
+				sel  uint32
+				err  error
+			}
+			accepted := make(chan result, 1)
+			go func() {
+				conn, sel, err := mseAccept(b, bufio.NewReader(b), c.skey, tt.allow)
+				if err != nil {
+					// the initiator is left waiting for an answer otherwise
+					b.Close()
+				}
+				accepted <- result{conn, sel, err}
+			}()
+
+			ca, sela, erra := mseInitiate(context.Background(), a, ih, tt.provide)
+			rb := <-accepted
+
+			if tt.sel == 0 {
+				if erra == nil || rb.err == nil {
+					t.Fatalf("handshake didn't fail, %v, %v", erra, rb.err)
+				}
+				return
+			}
+
+			if erra != nil || rb.err != nil {
+				t.Fatalf("handshake failed, %v, %v", erra, rb.err)
+			}
+			if sela != tt.sel || rb.sel != tt.sel {
+				t.Fatalf("selected %v and %v, want %v", sela, rb.sel, tt.sel)
+			}
+
+			// only the RC4 connections encrypt the data written
+			encrypted := tt.sel == mseRC4
+			if (ca.(*cryptoConn).enc != nil) != encrypted || (rb.conn.(*cryptoConn).enc != nil) != encrypted {
+				t.Fatal("wrong crypto method on the connections")
+			}
+
+			exchange(t, ca, rb.conn)
+		})
+	}
+}
+
+func TestMSEUnknownTorrent(t *testing.T) {
+	a, b := tcpPair(t)
+	c := mseClient(EncryptionPrefer, randomInfohash())
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := mseAccept(b, bufio.NewReader(b), c.skey, msePlaintext|mseRC4)
+		b.Close()
+		errc <- err
+	}()
+
+	if _, _, err := mseInitiate(context.Background(), a, randomInfohash(), msePlaintext|mseRC4); err == nil {
+		t.Fatal("handshake for an unknown torrent didn't fail")
+	}
+	if err := <-errc; err == nil || !strings.Contains(err.Error(), "unknown torrent") {
+		t.Fatalf("unknown torrent not rejected, %v", err)
+	}
+}
+
+func TestMSEPolicies(t *testing.T) {
+	ih := randomInfohash()
+
+	tests := []struct {
+		name      string
+		dialer    string // encryption policy of the side connecting
+		listener  string // encryption policy of the side accepting
+		encrypted bool
+		fail      bool
+	}{
+		{"prefer both", EncryptionPrefer, EncryptionPrefer, true, false},
+		{"require and prefer", EncryptionRequire, EncryptionPrefer, true, false},
+		{"prefer and disabled", EncryptionPrefer, EncryptionDisabled, false, false},
+		{"disabled and prefer", EncryptionDisabled, EncryptionPrefer, false, false},
+		{"require and disabled", EncryptionRequire, EncryptionDisabled, false, true},
+		{"disabled and require", EncryptionDisabled, EncryptionRequire, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc, dc := mseClient(tt.listener, ih), mseClient(tt.dialer, ih)
+
+			// the listening side answers the BitTorrent handshake with one of
+			// it's own, the connections it refuses are closed right away
+			addr := listen(t, func(conn net.Conn) {
+				econn, _, err := lc.acceptPeer(conn)
+				if err != nil {
+					return
+				}
+				w := NewWire(econn)
+				if _, err := w.ReadHandshake(); err != nil {
+					return
+				}
+				w.WriteHandshake(&Handshake{InfoHash: ih, PeerID: []byte(GenPeerID())})
+				io.Copy(io.Discard, econn)
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, encrypted, err := dc.dialPeer(ctx, addr, ih)
+			if err == nil {
+				defer conn.Close()
+
+				// the policy mismatches show up once the handshake is sent,
+				// as the other side has closed the connection by then
+				w := NewWire(conn)
+				err = w.WriteHandshake(&Handshake{InfoHash: ih, PeerID: []byte(GenPeerID())})
+				if err == nil {
+					var hs *Handshake
+					hs, err = w.ReadHandshake()
+					if err == nil && !bytes.Equal(hs.InfoHash, ih) {
+						t.Fatal("wrong infohash in the handshake")
+					}
+				}
+			}
+
+			if tt.fail {
+				if err == nil {
+					t.Fatal("connected, despite the encryption policies")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted != tt.encrypted {
+				t.Fatalf("encrypted %v, want %v", encrypted, tt.encrypted)
+			}
+		})
+	}
+}
+
+func TestMSEPreferFallback(t *testing.T) {
+	ih := randomInfohash()
+
+	// a peer that doesn't support MSE at all, it drops the connections
+	// that don't start with a plaintext BitTorrent handshake
+	attempts := make(chan bool, 2)
+	addr := listen(t, func(conn net.Conn) {
+		w := NewWire(conn)
+		hs, err := w.ReadHandshake()
+		attempts <- err == nil
+		if err != nil {
+			return
+		}
+		w.WriteHandshake(&Handshake{InfoHash: hs.InfoHash, PeerID: []byte(GenPeerID())})
+		io.Copy(io.Discard, conn)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, encrypted, err := mseClient(EncryptionPrefer, ih).dialPeer(ctx, addr, ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if encrypted {
+		t.Fatal("encrypted connection to a peer without MSE")
+	}
+
+	w := NewWire(conn)
+	if err := w.WriteHandshake(&Handshake{InfoHash: ih, PeerID: []byte(GenPeerID())}); err != nil {
+		t.Fatal(err)
+	}
+	hs, err := w.ReadHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hs.InfoHash, ih) {
+		t.Fatal("wrong infohash in the handshake")
+	}
+
+	// the MSE attempt, then the plaintext one
+	if first, second := <-attempts, <-attempts; first || !second {
+		t.Fatalf("attempts %v, %v", first, second)
+	}
+}
+
+func TestMSEPreferSilentPeer(t *testing.T) {
+	timeout := MSEKeyTimeout
+	defer func() { MSEKeyTimeout = timeout }()
+	MSEKeyTimeout = 200 * time.Millisecond
+
+	ih := randomInfohash()
+
+	// a peer without MSE that doesn't drop the connection on a garbled
+	// handshake, it just keeps reading (and never sends anything)
+	addr := listen(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		b, err := br.Peek(1 + len(PeerProtocolName))
+		if err != nil || !bytes.Equal(b[1:], PeerProtocolName) {
+			io.Copy(io.Discard, br)
+			return
+		}
+		w := NewWire(&cryptoConn{Conn: conn, r: br})
+		hs, err := w.ReadHandshake()
+		if err != nil {
+			return
+		}
+		w.WriteHandshake(&Handshake{InfoHash: hs.InfoHash, PeerID: []byte(GenPeerID())})
+		io.Copy(io.Discard, conn)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the plaintext connection has to be made once the key doesn't
+	// arrive in time, not after the whole MSE handshake times out
+	start := time.Now()
+	conn, encrypted, err := mseClient(EncryptionPrefer, ih).dialPeer(ctx, addr, ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if el := time.Since(start); el > 2*time.Second {
+		t.Fatalf("fell back to plaintext after %v", el)
+	}
+	if encrypted {
+		t.Fatal("encrypted connection to a peer without MSE")
+	}
+
+	w := NewWire(conn)
+	if err := w.WriteHandshake(&Handshake{InfoHash: ih, PeerID: []byte(GenPeerID())}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ReadHandshake(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeMSEInfohash(t *testing.T) {
+	ih, other := randomInfohash(), randomInfohash()
+
+	tests := []struct {
+		name     string
+		infohash []byte // of the BitTorrent handshake, the MSE one is for `ih`
+		accepted bool
+	}{
+		{"same torrent", ih, true},
+		{"another of our torrents", other, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mseClient(EncryptionPrefer, ih, other)
+			c.PeerID = GenPeerID()
+
+			a, b := tcpPair(t)
+			go c.Serve(b)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			econn, _, err := mseInitiate(ctx, a, ih, mseRC4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			econn.SetDeadline(time.Now().Add(5 * time.Second))
+			w := NewWire(econn)
+			if err := w.WriteHandshake(&Handshake{InfoHash: tt.infohash, PeerID: []byte(GenPeerID())}); err != nil {
+				t.Fatal(err)
+			}
+			hs, err := w.ReadHandshake()
+			if !tt.accepted {
+				if err == nil {
+					t.Fatal("handshake for another torrent than the mse one accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(hs.InfoHash, ih) {
+				t.Fatal("wrong infohash in the handshake")
+			}
+		})
+	}
+}
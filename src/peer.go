@@ -2,14 +2,16 @@ package src
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ritsource/torrent-client/output"
@@ -25,26 +27,102 @@ Msg-Length [4 bytes] + MsgID [1 byte] + Piece-Index [4 bytes] + Begin [4 bytes]
 */
 var MaxMessageLength = 4 + 1 + 4 + 4 + LengthOfBlock
 
+// Request queue (pipelining) configuration, the number of outstanding block
+// requests per peer adapts to the peer's rate, between these limits
+var (
+	MinRequestQueue  = 5
+	MaxRequestQueue  = 250
+	RequestQueueTime = 3 * time.Second // the queue should hold this much time worth of blocks
+)
+
+// BlockTimeout is how long to wait for a requested block to arrive
+var BlockTimeout = 30 * time.Second
+
+// PingTimeout is how long a peer gets to send it's bitfield and unchoke us, after connecting
+var PingTimeout = 50 * time.Second
+
+// PeerIdleTimeout is how long a peer connection can stay silent, before it's closed
+var PeerIdleTimeout = 3 * time.Minute
+
+// KeepAliveInterval is how long we can stay silent on a peer connection,
+// a keep-alive message is sent if nothing else has been sent for that long
+var KeepAliveInterval = 2 * time.Minute
+
 /*
 Peer represents a single peer
 */
 type Peer struct {
 	IP          net.IP
 	Port        uint16
+	ID          []byte // 20-byte peer id, if the tracker told us (it has to match the handshake's)
 	Conn        net.Conn
-	Bitfield    []bool
-	UnChoked    bool
 	Connected   bool
-	Downloading bool
+	Downloading bool     // if a piece has been handed to the peer, and it's download hasn't started yet
+	Inbound     bool     // if the peer connected to us, rather than us to it
+	Local       bool     // if the peer was found on the local network (BEP 14)
+	Client      string   // client name and version, from the peer's extended handshake
+	Fast        bool     // if both sides support the Fast Extension (BEP 6)
+	Encrypted   bool     // if the connection is encrypted, with RC4 (MSE)
+	UTP         bool     // if the connection is over uTP (BEP 29), rather than TCP
+	Uploaded    int64    // number of bytes uploaded to the peer (to be accessed atomically)
+	Downloaded  int64    // number of bytes downloaded from the peer (to be accessed atomically)
+	Wire        *Wire    // message framing over `Conn`
+	Torrent     *Torrent // the torrent that we exchange pieces of with the peer
+
+	/*
+		The state of the connection below is guarded by `mu`, along with `Conn`, `Connected`
+		and `Downloading`. The read loop updates it as the messages arrive, while the downloads,
+		the choker and the seeder read it from their own goroutines, so every access takes `mu`
+		(the other files go through the accessors, `Choking`, `AmInterested`, `PeerChoking`,
+		`PeerInterested` and `HasPiece`). Nothing that blocks (like a send) is done with
+		`mu` held
+	*/
+	mu   sync.Mutex
+	done chan struct{} // closed when the connection gets closed
+
+	// state of the connection (BEP 3), both sides start
+	// out choking each other, and not interested
+	amChoking      bool // if we are choking the peer, not answering it's requests
+	amInterested   bool // if we are interested in the pieces the peer has
+	peerChoking    bool // if the peer is choking us
+	peerInterested bool // if the peer is interested in the pieces we have
+
+	bitfield  []bool    // pieces the peer has, empty until it tells us
+	downRate  float64   // download rate from the peer in bytes per second (moving average)
+	rateBytes int64     // bytes downloaded since `rateStart`
+	rateStart time.Time // start of the current download rate measurement
+	upPiece   *Piece    // the last piece read from the files for uploading
+	upData    []byte    // data of `upPiece`
+
+	extIDs     map[string]uint8 // the peer's extended message ids, by extension name
+	listenPort uint16           // the port the peer accepts connections on, from it's extended handshake
+	reqq       int              // the number of outstanding requests the peer supports, 0 if it didn't tell
+	pexRecv    time.Time        // when the last PEX message was received from the peer
+
+	allowed   map[uint32]bool // pieces the peer lets us download while choked
+	ourFast   map[uint32]bool // pieces we let the peer download while choked
+	suggested []uint32        // pieces the peer suggested, the latest last
+
+	connectedAt time.Time // when the connection was opened, the choker favors the new peers
+
+	downloads map[uint32]*peerDownload // the downloads in progress from the peer, by piece index
 }
 
 /*
 IsReady returns a boolean that indicates if the peer is ready to
-request pieces or not. If the peer has been unchoked and holds a
-valid bitfield it returns `true`, else it returns `false`
+request pieces or not. If the peer has unchoked us (or lets us download
+some pieces while choked, BEP 6) and holds a valid bitfield it returns
+`true`, else it returns `false`
 */
 func (p *Peer) IsReady() bool {
-	return p.UnChoked && len(p.Bitfield) == len(Torr.Pieces) && p.Connected
+	if p.PeerChoking() && !p.hasAllowedFast() {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.bitfield) == len(p.Torrent.Pieces) && p.Connected
 }
 
 /*
@@ -52,216 +130,523 @@ IsAlive checks if a peer connection has been disconnected or not.
 If disconnected then it returns `false`, if not then returns `true`
 */
 func (p *Peer) IsAlive() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	return p.Conn != nil && p.Connected
 }
 
-// IsFree .
+/*
+IsFree checks if the peer can take another piece to download. All the blocks of the
+pieces being downloaded from it have to be requested already, and there has to be
+room in it's request queue (see `QueueDepth`). So the requests for the next piece go
+out while the blocks of the current one are still arriving, and the queue doesn't
+drain at the end of every piece
+*/
 func (p *Peer) IsFree() bool {
-	return !p.Downloading
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.free()
+}
+
+// free is `IsFree`, with `mu` held
+func (p *Peer) free() bool {
+	if p.Downloading {
+		return false
+	}
+
+	n := 0
+	for _, d := range p.downloads {
+		if d.queued > 0 {
+			return false
+		}
+		n += d.pending
+	}
+	return n < p.queueDepth()
+}
+
+// reserve marks the peer as busy if it's free, until the download
+// of the piece that it gets handed starts (or `release` gets called)
+func (p *Peer) reserve() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.free() {
+		return false
+	}
+	p.Downloading = true
+	return true
+}
+
+// release undoes `reserve`, when there's no piece to hand to the peer
+func (p *Peer) release() {
+	p.mu.Lock()
+	p.Downloading = false
+	p.mu.Unlock()
 }
 
 // HasPiece .
 func (p *Peer) HasPiece(pidx int) bool {
-	return p.IsReady() && len(p.Bitfield) >= pidx && p.Bitfield[pidx]
+	if !p.IsReady() {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return pidx < len(p.bitfield) && p.bitfield[pidx]
+}
+
+/*
+open sets up the state for a newly established connection,
+both sides start out choking and not interested
+*/
+func (p *Peer) open(conn net.Conn) {
+	p.mu.Lock()
+	p.Conn = conn
+	p.Wire = NewWire(conn)
+	p.Connected = true
+	p.connectedAt = time.Now()
+	p.amChoking, p.amInterested = true, false
+	p.peerChoking, p.peerInterested = true, false
+	p.upPiece, p.upData = nil, nil
+	p.downloads = make(map[uint32]*peerDownload)
+	p.done = make(chan struct{})
+	p.extIDs, p.listenPort, p.reqq, p.pexRecv = nil, 0, 0, time.Time{}
+	p.Fast, p.allowed, p.ourFast, p.suggested = false, nil, nil, nil
+	p.mu.Unlock()
 }
 
 /*
 Disconnect closes the peer connection (TCP) and sets it's state to
-`Unchoked` and `Disconnected`, though it doesn't resets the `Bitfield`
+`Disconnected`, though it doesn't resets the `Bitfield`
 */
 func (p *Peer) Disconnect() {
+	p.mu.Lock()
 	p.Connected = false
 	if p.Conn != nil {
 		p.Conn.Close()
 	}
+	if p.done != nil {
+		select {
+		case <-p.done:
+		default:
+			close(p.done)
+		}
+	}
+	p.mu.Unlock()
+
+	if p.Torrent != nil {
+		p.Torrent.mu.Lock()
+		delete(p.Torrent.peers, p)
+		p.Torrent.mu.Unlock()
+	}
+
+	// the pieces of a disconnected peer aren't available anymore
+	if p.Torrent != nil {
+		p.Torrent.avail.forget(p)
+	}
 }
 
 /*
 Reset not only closes the peer connection and changes the state
-to `Unchoked`, but it also resets the bitfield (to `[]bool{}`)
+to `Disconnected`, but it also resets the bitfield (to `[]bool{}`)
 */
 func (p *Peer) Reset() {
 	p.Disconnect()
-	p.Bitfield = []bool{}
+
+	p.mu.Lock()
+	p.bitfield = []bool{}
+	p.mu.Unlock()
 }
 
 /*
 Ping establishes a TCP connection with the peer and exchanges messages
 to find what pieces the peer has, and if we are allowed to download
-pieces of data from the peer. In detail, it exchange handshake messages
-and waits for the peer to send `bitfield` and `unchoke` messages
-(message read timeout 50 seconds)
+pieces of data from the peer. In detail, it exchange handshake messages,
+starts reading messages from the peer (in a different goroutine) and
+waits for the peer to send `bitfield` and `unchoke` messages. We let the
+peer know that we are interested as soon as it has something we need
+(timeout `PingTimeout`). If the context gets cancelled meanwhile, the
+peer is disconnected and the context's error is returned
 */
-func (p *Peer) Ping() error {
-	// if no response from the peer for 50 seconds disconnect the peer
-	go func(p *Peer) {
-		time.Sleep(50 * time.Second)
-		if p.IsAlive() && !p.IsReady() {
-			output.DevInfof("peer ping timeout, disconnecting.. | %v:%v\n", p.IP, p.Port)
-			p.Disconnect()
-		}
-	}(p)
-
+func (p *Peer) Ping(ctx context.Context) error {
 	// peer server address
-	addr := p.IP.String() + ":" + strconv.Itoa(int(p.Port))
-
-	// establishing a TCP connection with the peer
-	var err error
-	p.Conn, err = net.Dial("tcp", addr)
-	if err != nil {
-		output.DevWarnf("couldn't establish TCP connection, %+v | %v:%v\n", err, p.IP, p.Port)
-		return err
-	}
-	p.Connected = true
+	addr := net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 
-	// building the handshake message buffer
-	hsbuf, err := handshakeMsgBuf()
+	// establishing a connection with the peer (uTP or TCP), encrypted
+	// (MSE) or not, depending on the client's encryption policy
+	conn, encrypted, err := p.Torrent.client.dialPeer(ctx, addr, p.Torrent.InfoHash)
 	if err != nil {
-		output.DevWarnf("couldn't build the handshake buffer, %v | %v:%v\n", err, p.IP, p.Port)
+		output.DevWarnf("couldn't establish connection, %+v | %v:%v\n", err, p.IP, p.Port)
 		return err
 	}
-
-	// writing the handshake message on peer connection
-	_, err = p.Conn.Write(hsbuf.Bytes())
+	p.open(conn)
+	p.Encrypted = encrypted
+	p.UTP = conn.RemoteAddr().Network() == "udp"
+
+	// writing the handshake message on peer connection, with the extension
+	// protocol (BEP 10) and the Fast Extension (BEP 6) bits set in the reserved bytes
+	ours := &Handshake{InfoHash: p.Torrent.InfoHash, PeerID: []byte(p.Torrent.client.PeerID)}
+	ours.Reserved[5] |= 0x10
+	ours.Reserved[7] |= fastBit
+	err = p.Wire.WriteHandshake(ours)
 	if err != nil {
 		output.DevWarnf("couldn't write handshake request, %v | %v:%v\n", err, p.IP, p.Port)
+		p.Disconnect()
 		return err
 	}
 
-	// waiting for the peer to respond with a handshake message
-	d := make([]byte, 1024)
-	nr, err := p.Conn.Read(d)
+	// waiting for the peer to respond with a handshake message, exactly 68
+	// bytes are read, the messages following it stay in the read buffer
+	p.Conn.SetReadDeadline(time.Now().Add(PingTimeout))
+	stop := closeOnCancel(ctx, conn)
+	hs, err := p.Wire.ReadHandshake()
+	stop()
+	if ctx.Err() != nil {
+		p.Disconnect()
+		return ctx.Err()
+	}
 	if err != nil {
 		output.DevWarnf("couldn't to read handshake response, %v | %v:%v\n", err, p.IP, p.Port)
 		p.Disconnect()
 		return err
 	}
 
-	// checkign if the recieved messages is a valid handshake message or not
-	if !isHsMsg(d[:nr]) {
+	// checkign if the handshake is for the same torrent
+	if !bytes.Equal(hs.InfoHash, p.Torrent.InfoHash) {
 		output.DevWarnf("invalid handshake message, disconnecting.. | %v:%v\n", p.IP, p.Port)
 		p.Disconnect()
+		return fmt.Errorf("handshake infohash doesn't match")
+	}
+
+	// and if it's the peer that the tracker told us about
+	if p.ID != nil && !bytes.Equal(hs.PeerID, p.ID) {
+		output.DevWarnf("handshake peer id doesn't match, disconnecting.. | %v:%v\n", p.IP, p.Port)
+		p.Disconnect()
+		return fmt.Errorf("handshake peer id doesn't match")
 	}
+	p.ID = hs.PeerID
+	p.Fast = hs.Reserved[7]&fastBit != 0
+
+	output.DevInfof("handshake-message | %v:%v\n", p.IP, p.Port)
 
-	output.DevInfof("handshake-message, %v bytes | %v:%v\n", nr, p.IP, p.Port)
+	// letting the peer know what we have
+	if err := p.sendPieces(); err != nil {
+		p.Disconnect()
+		return err
+	}
 
-	// now, reading from the connection, waitign for peer to
-	// write `bitfield` and `unchoke` message
+	// and which extensions we support, if it supports the extension protocol
+	if hs.Reserved[5]&0x10 != 0 {
+		if err := p.sendExtHandshake(); err != nil {
+			p.Disconnect()
+			return err
+		}
+	}
+
+	// reading messages from the peer, until the connection closes
+	go p.run()
+
+	// now, waitign for peer to send `bitfield` and `unchoke` message
+	timeout := time.After(PingTimeout)
 	for p.IsAlive() && !p.IsReady() {
-		// read reads messages sent over multiple writes and
-		// concatinates and returns it as a single message
+		select {
+		case <-timeout:
+			output.DevInfof("peer ping timeout, disconnecting.. | %v:%v\n", p.IP, p.Port)
+			p.Disconnect()
+		case <-ctx.Done():
+			p.Disconnect()
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if !p.IsAlive() {
+		return ErrPeerDisconnected
+	}
+	return nil
+}
+
+/*
+run reads messages from the peer and handles them, until the connection gets
+closed or the peer stays silent for longer than `PeerIdleTimeout`. It also sends
+keep-alive messages, whenever we have been silent for `KeepAliveInterval`
+*/
+func (p *Peer) run() {
+	defer p.Disconnect()
+
+	// the handshake is done, so the peer can be told about the new pieces
+	p.Torrent.mu.Lock()
+	p.Torrent.peers[p] = true
+	p.Torrent.mu.Unlock()
+
+	go p.keepAlive(p.done)
+	go p.pex(p.done)
+
+	for p.IsAlive() {
+		p.Conn.SetReadDeadline(time.Now().Add(PeerIdleTimeout))
+
+		// reads exactly one message from the connection
 		msg, err := p.Read()
 		if err != nil {
 			output.DevWarnf("%v, disconnecting.. | %v:%v\n", err, p.IP, p.Port)
-			p.Disconnect()
-			return err
+			return
 		}
 
-		// extracting length, message-id and payload from the message
-		lng, id, payld, err := extractMsg(msg)
-		if err != nil {
+		if err := p.handle(msg); err != nil {
 			output.DevWarnf("%v, disconnecting.. | %v:%v\n", err, p.IP, p.Port)
-			p.Disconnect()
-			return err
+			return
 		}
+	}
+}
 
-		// message id indicates the message type, i==0 -> "choke"; i==1 -> "unchoke" etc..
-		// expecting the peer to write `bitfield` and `unchoke` message
-		switch id {
-		case uint8(0):
-			output.DevInfof("choke-message, %v bytes | %v:%v\n", lng+4, p.IP, p.Port)
-			p.Disconnect()
-		case uint8(1):
-			output.DevInfof("unchoke-message, %v bytes | %v:%v\n", lng+4, p.IP, p.Port)
-			p.UnChoked = true
-		case uint8(4):
-			output.DevInfof("have-message, %v bytes | %v:%v\n", lng+4, p.IP, p.Port)
-		case uint8(5):
-			output.DevInfof("bitfield-message, %v bytes | %v:%v\n", lng+4, p.IP, p.Port)
-			err := p.ReadBitfield(payld)
-			if err != nil {
-				output.DevWarnf("bitfield read error, %v, disconnecting.. | %v:%v\n", err, p.IP, p.Port)
-				p.Disconnect()
-				return err
+// handle updates the connection state according to the message,
+// an error is returned if the peer has broken the protocol
+func (p *Peer) handle(msg Message) error {
+	switch m := msg.(type) {
+	case *KeepAliveMsg:
+		// pass
+
+	case *ChokeMsg:
+		output.DevInfof("choke-message | %v:%v\n", p.IP, p.Port)
+		p.setPeerState(&p.peerChoking, true)
+		p.signal()
+
+	case *UnchokeMsg:
+		output.DevInfof("unchoke-message | %v:%v\n", p.IP, p.Port)
+		p.setPeerState(&p.peerChoking, false)
+		p.signal()
+
+	case *InterestedMsg:
+		p.setPeerState(&p.peerInterested, true)
+		// the choker decides who we upload to, a free slot is given right away
+		return p.Torrent.choker.Interested(p)
+
+	case *NotInterestedMsg:
+		p.setPeerState(&p.peerInterested, false)
+
+	case *HaveMsg:
+		if int(m.Index) >= len(p.Torrent.Pieces) {
+			return fmt.Errorf("have-message with invalid piece-index, %v", m.Index)
+		}
+		// a peer might not send a bitfield at all, if it had no pieces
+		p.mu.Lock()
+		n := len(p.bitfield)
+		p.mu.Unlock()
+		if n != len(p.Torrent.Pieces) {
+			p.Torrent.avail.setBitfield(p, make([]bool, len(p.Torrent.Pieces)))
+		}
+		p.Torrent.avail.have(p, int(m.Index))
+		return p.updateInterest()
+
+	case *BitfieldMsg:
+		output.DevInfof("bitfield-message, %v bytes | %v:%v\n", len(m.Bitfield), p.IP, p.Port)
+		if err := p.ReadBitfield(m.Bitfield); err != nil {
+			return fmt.Errorf("bitfield read error, %v", err)
+		}
+		return p.updateInterest()
+
+	case *RequestMsg:
+		return p.serveRequest(m)
+
+	case *PieceMsg:
+		// handing the block over to the download of it's piece, blocks
+		// that arrive when the piece isn't being downloaded are dropped
+		if d := p.download(m.Index); d != nil {
+			select {
+			case d.blocks <- m:
+			default:
 			}
 		}
+
+	case *CancelMsg:
+		// requests are answered as soon as they arrive, so there's nothing queued to cancel
+
+	case *ExtendedMsg:
+		return p.handleExtended(m)
+
+	case *HaveAllMsg, *HaveNoneMsg, *RejectMsg, *AllowedFastMsg, *SuggestMsg:
+		return p.handleFast(m)
 	}
 
 	return nil
 }
 
-/*
-Read reads messages from peer connection. It reads the messages-length at
-start and concatenates multiple writes and treats it as a whole message
-*/
-func (p *Peer) Read() ([]byte, error) {
-	var lng int              // `lng` holds value of message-length (read from first 4 bytes)
-	buf := new(bytes.Buffer) // `buf` holds message data over multiple writes
-	defer buf.Reset()
+// setPeerState sets a flag of the peer's side of the connection state (BEP 3), with `mu` held
+func (p *Peer) setPeerState(flag *bool, v bool) {
+	p.mu.Lock()
+	*flag = v
+	p.mu.Unlock()
+}
 
-	// as long as the connection is alive, read from the connection
-	// and when a message is complete break continious read
-	for p.IsAlive() {
-		b := make([]byte, MaxMessageLength)
-		nr, err := p.Conn.Read(b)
-		switch err {
-		case nil:
-			// pass
-		case io.EOF:
-			return nil, fmt.Errorf("message read err, %v", err)
+// signal notifies the downloads in progress that the choke state has
+// changed, or that there's room in the request queue again
+func (p *Peer) signal() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, d := range p.downloads {
+		select {
+		case d.notify <- struct{}{}:
 		default:
-			output.DevWarnf("%v | %v:%v\n", err, p.IP, p.Port)
-			return nil, err
 		}
+	}
+}
 
-		// when the `buf` length is 0 (first read), reading total
-		// message length encoded in first four bytes (uint32)
-		if buf.Len() == 0 {
-			lng = int(binary.BigEndian.Uint32(b[:4]))
-		}
+// keepAlive sends a keep-alive message whenever nothing has been sent for
+// `KeepAliveInterval`, until the `done` channel of the connection is closed
+func (p *Peer) keepAlive(done chan struct{}) {
+	t := time.NewTicker(KeepAliveInterval / 12)
+	defer t.Stop()
 
-		// if message length excides teh maximum allowed message
-		// length, disconnecting the peer and trowning an error
-		if lng+4 > MaxMessageLength {
-			return nil, fmt.Errorf("invalid message, msg-length = %v bytes", lng+4)
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if p.Wire.SinceWrite() >= KeepAliveInterval {
+				p.Send(&KeepAliveMsg{})
+			}
 		}
+	}
+}
+
+// SetInterested tells the peer whether we are interested in it's pieces or not
+func (p *Peer) SetInterested(v bool) error {
+	p.mu.Lock()
+	if p.amInterested == v {
+		p.mu.Unlock()
+		return nil
+	}
+	p.amInterested = v
+	p.mu.Unlock()
 
-		// saving corrent read to `buf`
-		buf.Write(b[:nr])
+	if v {
+		return p.Send(&InterestedMsg{})
+	}
+	return p.Send(&NotInterestedMsg{})
+}
+
+// SetChoking chokes or unchokes the peer, the choker and the read loop can both call it
+func (p *Peer) SetChoking(v bool) error {
+	if !p.setChoking(v) {
+		return nil
+	}
+	return p.sendChoking(v)
+}
+
+// setChoking changes if we are choking the peer, without letting it know (see
+// `sendChoking`). It returns false if nothing has changed
+func (p *Peer) setChoking(v bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.amChoking == v {
+		return false
+	}
+	p.amChoking = v
+	return true
+}
+
+// sendChoking sends a choke or an unchoke message to the peer
+func (p *Peer) sendChoking(v bool) error {
+	if v {
+		return p.Send(&ChokeMsg{})
+	}
+	return p.Send(&UnchokeMsg{})
+}
+
+// Choking checks if we are choking the peer
+func (p *Peer) Choking() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.amChoking
+}
 
-		// when the message read is complete (buffer-length
-		// == msg-length + first-4-bytes), break the read
-		if buf.Len() >= lng+4 {
+// AmInterested checks if we are interested in the pieces the peer has
+func (p *Peer) AmInterested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.amInterested
+}
+
+// PeerChoking checks if the peer is choking us
+func (p *Peer) PeerChoking() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.peerChoking
+}
+
+// PeerInterested checks if the peer is interested in the pieces we have
+func (p *Peer) PeerInterested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.peerInterested
+}
+
+// updateInterest makes us interested in the peer if it has any
+// piece that we don't, and not interested otherwise
+func (p *Peer) updateInterest() error {
+	p.mu.Lock()
+	bf := append([]bool{}, p.bitfield...)
+	p.mu.Unlock()
+
+	want := false
+	for i, has := range bf {
+		if has && i < len(p.Torrent.Pieces) && p.Torrent.Pieces[i].Status() != PieceStatusDownloaded {
+			want = true
 			break
 		}
 	}
+	return p.SetInterested(want)
+}
 
-	// return read message
-	return buf.Bytes(), nil
+// Read reads exactly one message from the peer connection
+func (p *Peer) Read() (Message, error) {
+	if !p.IsAlive() || p.Wire == nil {
+		return nil, ErrPeerDisconnected
+	}
+	return p.Wire.ReadMessage()
+}
+
+// Send writes a message on the peer connection
+func (p *Peer) Send(m Message) error {
+	if !p.IsAlive() || p.Wire == nil {
+		return ErrPeerDisconnected
+	}
+	return p.Wire.WriteMessage(m)
 }
 
 /*
 ReadBitfield reads a bitfield message payload and populates the
-`peer.Bitfield` ([]bool) with booleans that indicates if a piece
+`peer.bitfield` ([]bool) with booleans that indicates if a piece
 of that index is available on the peer to be requested
 */
 func (p *Peer) ReadBitfield(payld []byte) error {
-	if len(payld)*8 != len(Torr.Pieces) {
-		return fmt.Errorf("bitfield length (%v) != number of pieces (%v)", len(payld)*8, len(Torr.Pieces))
+	// the bitfield is padded to a whole number of bytes, the
+	// spare bits at the end (if any) are ignored
+	n := len(p.Torrent.Pieces)
+	if len(payld) != (n+7)/8 {
+		return fmt.Errorf("bitfield length (%v bytes) doesn't fit the number of pieces (%v)", len(payld), n)
 	}
 
-	// the booleans directly cannot be appended to `peer.Bitfield` as
-	// the `peer.IsReady()` method checks for len(peer.Bitfield) to be
-	// requal to len(Torr.Pieces) is a concurrent goroutine
-	bf := make([]bool, len(payld)*8)
+	// the booleans directly cannot be appended to `peer.bitfield` as
+	// the `peer.IsReady()` method checks for len(peer.bitfield) to be
+	// requal to len(p.Torrent.Pieces) is a concurrent goroutine
+	bf := make([]bool, n)
 
-	for i, b := range payld {
-		for j := 0; j < 8; j++ {
-			bf[i*8+j] = int8(b>>uint(7-j)&0x01) == 1 // pushing bool
-		}
+	for i := range bf {
+		bf[i] = payld[i/8]>>uint(7-i%8)&0x01 == 1 // pushing bool
 	}
 
-	p.Bitfield = bf
+	// the piece availability counts are updated along with the bitfield
+	p.Torrent.avail.setBitfield(p, bf)
 
 	return nil
 }
@@ -269,66 +654,238 @@ func (p *Peer) ReadBitfield(payld []byte) error {
 // ErrPeerDisconnected has to be thrown when peer messaging fails because of closed peer connection
 var ErrPeerDisconnected = errors.New("peer connection has been closed")
 
+// ErrPeerChoked is returned when the peer choked us in the middle of a download, and
+// didn't unchoke us in time (the piece can be downloaded from an other peer)
+var ErrPeerChoked = errors.New("peer has choked us")
+
 /*
 DownloadPiece downloads all the `Block`s of data of a given `Piece` from the `Peer`,
 and writes the data to the appropriate files.
 
+The block requests are pipelined, instead of waiting for each block before requesting
+the next one, up to `Peer.QueueDepth()` requests are kept outstanding at once. The
+blocks are put in place by their `Begin` offset, so the order they arrive in doesn't matter.
+The queue is shared by all the pieces being downloaded from the peer, once all the blocks
+of the piece are requested the next piece is picked (see `Torrent.startDownload`), so
+it's requests go out while the blocks of this one are still arriving.
+
+If the peer chokes us, the outstanding requests are dropped (the peer discards them) and
+requested again once we're unchoked. If it doesn't unchoke us within `BlockTimeout` the
+download is abandoned with `ErrPeerChoked`. The blocks that are still outstanding when a
+download is abandoned get cancelled. With the Fast Extension (BEP 6) the pieces of the
+peer's allowed fast set are requested while choked too, and the peer rejects the requests
+it doesn't answer, instead of dropping them. A rejected block is requested again, up to 3
+times, then the download is abandoned with `ErrRequestRejected`.
+
+In endgame mode the same piece is downloaded from multiple peers at once, the blocks
+are shared between them. Whenever a block arrives, the other peers' requests for it
+are cancelled. The peer that receives the last block verifies and writes the piece,
+for the others the method returns without an error (and 0 bytes written)
+
 If `Peer` gets disconnected then the method returns a `ErrPeerDisconnected` error,
-so that the client can reestablish connection with the `Peer`
+so that the client can reestablish connection with the `Peer`. If the context gets
+cancelled, the download is abandoned and the context's error is returned
 */
-func (p *Peer) DownloadPiece(piece *Piece) (int, error) {
-	bidx := 0                              // index of the block to be requested
-	downs := make([]byte, 0, piece.Length) // holds all the downloaded data
+func (p *Peer) DownloadPiece(ctx context.Context, piece *Piece) (int, error) {
+	// the download state of the piece, the blocks received
+	// from other peers (or in an earlier attempt) are kept there
+	dl := piece.join(p)
+
+	queue := []*Block{}                // blocks yet to be requested
+	pending := make(map[uint32]*Block) // requested blocks that hasn't arrived yet, by `Begin` offset
+	last := false                      // if we have received the last block of the piece
+
+	for _, b := range piece.Blocks {
+		if !dl.has(b.Begin) {
+			queue = append(queue, b)
+		}
+	}
 
-	// errcnt counts the number download error for a single block of data,
+	// errcnt counts the number of invalid blocks recieved in a row,
 	// so if it excides teh limit the method can throw an error
 	errcnt := 0
 
+	// rejcnt counts the rejected requests of each block (BEP 6), a
+	// rejected block is requested again, but not indefinitely
+	rejcnt := make(map[uint32]int)
+
+	// registering the download, so the blocks (and rejects) of the piece get
+	// routed to it. The peer stays busy until all the blocks are requested
+	d, done := p.addDownload(piece.Index, len(queue))
+
+	// if the next piece has been handed to the peer, the first time it was free
+	// (once all the blocks of this piece were requested). Only when the torrent's
+	// download is running, otherwise the caller picks the pieces itself
+	handed := !p.Torrent.Started()
+
 	// managing the states of `Peer` and `Piece` over the course of download
-	piece.Status = PieceStatusRequested
-	p.Downloading = true
 	defer func(p *Peer) {
-		// this method `peer.DownloadPiece()` doesn't set the `piece.Status` value
-		// to `PieceStatusDownloaded`, it's to be down after the file write, so by
-		// the `piece.WriteToFiles()` method. So, `peer.DownloadPiece()` only checks
-		// that `piece.Status` is equal to `PieceStatusDownloaded` or not, if not
-		// then it sets the value of `piece.Status` to `PieceStatusFailed`
-		if piece.Status != PieceStatusDownloaded {
-			piece.Status = PieceStatusFailed
+		// this method `peer.DownloadPiece()` doesn't set the status of the piece
+		// to `PieceStatusDownloaded`, it's to be down after the file write. When
+		// the last peer downloading the piece leaves, and the piece still hasn't
+		// been downloaded, then it's status is set to `PieceStatusFailed`
+		piece.leave(p, dl)
+		p.removeDownload(piece.Index)
+
+		// cancelling the abandoned requests
+		for _, b := range pending {
+			p.Send(&CancelMsg{Index: b.PieceIndex, Begin: b.Begin, Length: b.Length})
 		}
-		p.Downloading = false
 	}(p)
 
-	for {
+	for !last {
 		if !p.IsAlive() {
 			// returning `ErrPeerDisconnected` error if `Peer` connection is not up
 			return 0, ErrPeerDisconnected
 		}
 
 		if errcnt > 3 {
-			// returning error when download failures for a single block exceeds the limit (3)
-			return 0, fmt.Errorf("download error limit exceeded (%v), for block-index=%v", errcnt, bidx)
+			// returning error when the invalid blocks in a row exceeds the limit (3)
+			return 0, fmt.Errorf("download error limit exceeded (%v), for piece-index=%v", errcnt, piece.Index)
 		}
 
-		if bidx >= len(piece.Blocks) {
-			break
+		// forgetting about the blocks that has arrived from the other
+		// peers (endgame), the requests have been cancelled by them
+		for beg := range pending {
+			if dl.has(beg) {
+				delete(pending, beg)
+			}
+		}
+		for len(queue) > 0 && dl.has(queue[0].Begin) {
+			queue = queue[1:]
 		}
 
-		block := piece.Blocks[bidx]
+		// filling up the request queue, unless we're choked (and the
+		// piece isn't in the peer's allowed fast set either)
+		// (the queue is shared by all the pieces being downloaded from the peer)
+		for (!p.PeerChoking() || p.AllowedFast(piece.Index)) && len(queue) > 0 && p.outstanding() < p.QueueDepth() {
+			block := queue[0]
+			queue = queue[1:]
 
-		b, err := p.RequestBlock(block)
-		if err != nil {
-			errcnt++
-			continue
+			if dl.has(block.Begin) {
+				continue
+			}
+
+			if err := p.Send(block.Request()); err != nil {
+				p.Disconnect()
+				return 0, ErrPeerDisconnected
+			}
+
+			pending[block.Begin] = block
+			p.setPipeline(d, len(queue), len(pending))
+		}
+		p.setPipeline(d, len(queue), len(pending))
+
+		// the blocks requested from the other peers count, for the endgame
+		dl.setRequested(p, pending)
+
+		// all the blocks are requested, picking the next piece while these are
+		// still in flight, so the request queue doesn't drain in between
+		if !handed && len(queue) == 0 {
+			handed = p.Torrent.startDownload(ctx, p)
 		}
-		errcnt = 0
 
-		downs = append(downs, b...)
+		// waiting for the next block to arrive, or the choke state to change
+		timer := time.NewTimer(BlockTimeout)
+
+		select {
+		case m := <-d.blocks:
+			timer.Stop()
+
+			block, ok := pending[m.Begin]
+			if !ok && dl.has(m.Begin) {
+				// a late block, that has already been received from an other peer
+				continue
+			}
+			if !ok || len(m.Block) != int(block.Length) {
+				output.DevWarnf("recieved a unrequested block, pidx=%v,beg=%v,lng=%v | %v:%v\n", m.Index, m.Begin, len(m.Block), p.IP, p.Port)
+				errcnt++
+				continue
+			}
+			errcnt = 0
+			delete(pending, m.Begin)
+			p.setPipeline(d, len(queue), len(pending))
+
+			// there's room in the request queue, for the other pieces too
+			p.signal()
+
+			fresh, others, lst := dl.put(m.Begin, m.Block, p, len(piece.Blocks))
+			if !fresh {
+				continue
+			}
+			last = lst
+
+			p.recordDownload(len(m.Block))
+			atomic.AddInt64(&p.Downloaded, int64(len(m.Block)))
+			atomic.AddInt64(&p.Torrent.DownloadedBytes, int64(len(m.Block)))
+
+			// cancelling the requests for the block, sent to the other peers
+			for _, o := range others {
+				go o.Send(&CancelMsg{Index: m.Index, Begin: m.Begin, Length: uint32(len(m.Block))})
+			}
+
+		case r := <-d.rejects:
+			timer.Stop()
 
-		bidx++
+			block, ok := pending[r.Begin]
+			if !ok {
+				// a late reject from an earlier download
+				continue
+			}
+
+			// only the block fails, it's requested again (after the
+			// unchoke, if the peer rejected it for choking us)
+			delete(pending, r.Begin)
+			rejcnt[r.Begin]++
+			if rejcnt[r.Begin] > 3 {
+				return 0, ErrRequestRejected
+			}
+			queue = append(queue, block)
+
+		case <-d.notify:
+			timer.Stop()
+
+			// when choked, the peer discards all the outstanding requests,
+			// those are to be requested again once we're unchoked. With the
+			// Fast Extension nothing is discarded silently, the requests that
+			// the peer doesn't answer get rejected
+			if p.PeerChoking() && !p.Fast {
+				output.DevInfof("choked while downloading, waiting.. | %v:%v\n", p.IP, p.Port)
+				for _, b := range pending {
+					queue = append(queue, b)
+				}
+				pending = make(map[uint32]*Block)
+			}
+
+		case <-dl.done:
+			timer.Stop()
+
+			// the last block has been received from an other peer, that peer is
+			// going to write the piece (and has cancelled our requests already)
+			pending = nil
+			return 0, nil
+
+		case <-done:
+			timer.Stop()
+			return 0, ErrPeerDisconnected
+
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+
+		case <-timer.C:
+			if p.PeerChoking() {
+				return 0, ErrPeerChoked
+			}
+			return 0, fmt.Errorf("block request timed out, for piece-index=%v", piece.Index)
+		}
 	}
 
-	hash, err := GetSHA1(downs)
+	// all the blocks are here, the download state is no longer needed (if the
+	// hash doesn't match the piece is downloaded again from the scratch)
+	piece.reset(dl)
+
+	hash, err := GetSHA1(dl.data)
 	if err != nil {
 		return 0, fmt.Errorf("couldn't generate sha1 hash of downloaded data")
 	}
@@ -338,96 +895,167 @@ func (p *Peer) DownloadPiece(piece *Piece) (int, error) {
 		return 0, fmt.Errorf("hash doesn't match")
 	}
 
-	nw, err := piece.WriteToFiles(downs)
+	nw, err := piece.WriteToFiles(dl.data)
 	if err != nil {
 		return nw, err
 	}
-	piece.Status = PieceStatusDownloaded
+	piece.SetStatus(PieceStatusDownloaded)
+
+	// letting the connected peers know about the new piece
+	p.Torrent.BroadcastHave(piece.Index)
+
 	return nw, err
 }
 
-// RequestBlock downloads a single block from a peer. It sends a request message and
-// waits for the peer to respond with the data, and returns teh data (block data)
-func (p *Peer) RequestBlock(block *Block) ([]byte, error) {
-	buf, err := block.RequestBuff()
-	if err != nil {
-		return nil, fmt.Errorf("buffer build error, %v", err)
-	}
+// peerDownload is a piece being downloaded from the peer, the blocks (and rejects)
+// of the piece are routed to it. `queued` and `pending` are the number of it's
+// blocks that are yet to be requested, and that are requested (guarded by `mu`)
+type peerDownload struct {
+	blocks  chan *PieceMsg
+	rejects chan *RejectMsg
+	notify  chan struct{} // signalled whenever the peer chokes or unchokes us, or a block arrives
+	queued  int
+	pending int
+}
 
-	_, err = p.Conn.Write(buf.Bytes())
-	if err != nil {
-		return nil, fmt.Errorf("message write error, %v", err)
+// addDownload registers the download of the piece, it returns the connection's
+// `done` channel too. The peer isn't reserved for the piece anymore after it
+func (p *Peer) addDownload(pidx uint32, queued int) (*peerDownload, chan struct{}) {
+	d := &peerDownload{
+		blocks:  make(chan *PieceMsg, MaxRequestQueue),
+		rejects: make(chan *RejectMsg, MaxRequestQueue),
+		notify:  make(chan struct{}, 1),
+		queued:  queued,
 	}
 
-	msg, err := p.Read()
-	if err != nil {
-		output.DevWarnf("%v, disconnecting.. | %v:%v\n", err, p.IP, p.Port)
-		p.Disconnect()
-		return nil, err
-	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	// extracting length, message-id and payload from the message
-	lng, id, payld, err := extractMsg(msg)
-	if err != nil {
-		output.DevWarnf("%v, disconnecting.. | %v:%v\n", err, p.IP, p.Port)
-		p.Disconnect()
-		return nil, err
+	if p.downloads == nil {
+		p.downloads = make(map[uint32]*peerDownload)
 	}
+	p.downloads[pidx] = d
+	p.Downloading = false
+	return d, p.done
+}
 
-	// expecting "piece" message, (id==7)
-	if id == uint8(7) && len(payld) > 8 {
-		output.DevInfof("piece-message, %v bytes | %v:%v\n", lng, p.IP, p.Port)
+// removeDownload removes the download of the piece, the late blocks of it get dropped
+func (p *Peer) removeDownload(pidx uint32) {
+	p.mu.Lock()
+	delete(p.downloads, pidx)
+	p.mu.Unlock()
+}
 
-		pidx := binary.BigEndian.Uint32(payld[:4]) // piece index
-		beg := binary.BigEndian.Uint32(payld[4:8])
-		data := payld[8:]
-		// bidx := beg / uint32(LengthOfBlock)
+// download returns the download of the piece, nil if it's not being downloaded
+func (p *Peer) download(pidx uint32) *peerDownload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		if pidx != block.PieceIndex || beg != block.Begin || len(data) != int(block.Length) {
-			return nil, fmt.Errorf("recieved a unrequested block, pidx=%v,beg=%v,lng=%v", pidx, beg, len(data))
-		}
+	return p.downloads[pidx]
+}
+
+// setPipeline updates the number of blocks of the download that are yet to be requested,
+// and that are requested (the picker hands the peer the next piece by them, see `IsFree`)
+func (p *Peer) setPipeline(d *peerDownload, queued, pending int) {
+	p.mu.Lock()
+	d.queued, d.pending = queued, pending
+	p.mu.Unlock()
+}
+
+// outstanding returns the number of requests outstanding with the peer, of all the downloads
+func (p *Peer) outstanding() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		return data, nil
+	n := 0
+	for _, d := range p.downloads {
+		n += d.pending
 	}
+	return n
+}
 
-	return nil, fmt.Errorf("unexpected message read, %v bytes", lng)
+/*
+QueueDepth returns the number of block requests to keep outstanding with the peer.
+It's the number of blocks the peer can send in `RequestQueueTime` at it's measured
+download rate, kept between `MinRequestQueue` and `MaxRequestQueue`, and within
+the limit the peer told us in it's extended handshake (`reqq`)
+*/
+func (p *Peer) QueueDepth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.queueDepth()
 }
 
-// GetSHA1 returns a `sha1` hash of a given []byte
-func GetSHA1(b []byte) ([]byte, error) {
-	h := sha1.New()
-	_, err := h.Write(b)
-	return h.Sum(nil), err
+// queueDepth is `QueueDepth`, with `mu` held
+func (p *Peer) queueDepth() int {
+	q := int(p.downRate * RequestQueueTime.Seconds() / float64(LengthOfBlock))
+	if q < MinRequestQueue {
+		q = MinRequestQueue
+	}
+	if q > MaxRequestQueue {
+		q = MaxRequestQueue
+	}
+	if p.reqq > 0 && q > p.reqq {
+		q = p.reqq
+	}
+	return q
 }
 
-// extractMsg returns (length, id, and payload)
-func extractMsg(b []byte) (uint32, uint8, []byte, error) {
-	if len(b) < 5 {
-		return 0, 0, nil, fmt.Errorf("message not long enough, %v bytes", len(b))
+// recordDownload adds the downloaded bytes to the peer's download rate, the
+// rate is a moving average, updated once every second (at most)
+func (p *Peer) recordDownload(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rateStart.IsZero() {
+		p.rateStart = time.Now()
 	}
+	p.rateBytes += int64(n)
 
-	lng := binary.BigEndian.Uint32(b[:4])
-	id := b[4]
+	el := time.Since(p.rateStart).Seconds()
+	if el < 1 {
+		return
+	}
 
-	if len(b) > 5 {
-		return lng, id, b[5:], nil
+	rate := float64(p.rateBytes) / el
+	if p.downRate == 0 {
+		p.downRate = rate
+	} else {
+		p.downRate = 0.7*p.downRate + 0.3*rate
 	}
 
-	return lng, id, []byte{}, nil
+	p.rateBytes = 0
+	p.rateStart = time.Now()
 }
 
-// handshakeMsgBuf builds a handshake message buffer
-func handshakeMsgBuf() (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, uint8(len(PeerProtocolName)))
-	err = binary.Write(buf, binary.BigEndian, PeerProtocolName)
-	err = binary.Write(buf, binary.BigEndian, uint64(0))
-	err = binary.Write(buf, binary.BigEndian, Torr.InfoHash)
-	err = binary.Write(buf, binary.BigEndian, []byte(PeerID))
+// closeOnCancel closes the connection if the context gets cancelled before
+// `stop` is called, to unblock a read or write that's in progress on it
+func closeOnCancel(ctx context.Context, c io.Closer) (stop func()) {
+	ch := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-ch:
+		}
+	}()
+	return func() { close(ch) }
+}
 
-	return buf, err
+// GetSHA1 returns a `sha1` hash of a given []byte
+func GetSHA1(b []byte) ([]byte, error) {
+	h := sha1.New()
+	_, err := h.Write(b)
+	return h.Sum(nil), err
 }
 
-func isHsMsg(b []byte) bool {
-	return len(b) >= 20 && reflect.DeepEqual(b[1:20], PeerProtocolName)
+// isEmpty checks if all the bytes are zero
+func isEmpty(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,120 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// downloadingPeer creates a peer that has unchoked us, and has all the pieces of a torrent
+// with the data (in pieces of two blocks). The other end of it's connection is returned
+// to read the requests from, the blocks are to be handed to the peer with `handle`
+func downloadingPeer(t *testing.T, data []byte) (*Peer, *Wire) {
+	fn := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(fn, make([]byte, len(data)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plen := 2 * LengthOfBlock
+	tr := &Torrent{PieceLen: uint32(plen), Size: len(data), Picker: &SequentialPicker{}, started: 1}
+	tr.Files = []*File{{Path: fn, Length: len(data)}}
+	for i := 0; i*plen < len(data); i++ {
+		h := sha1.Sum(data[i*plen : (i+1)*plen])
+		piece := &Piece{Index: uint32(i), Length: uint32(plen), Hash: h[:], t: tr}
+		piece.GenBlocks()
+		tr.Pieces = append(tr.Pieces, piece)
+	}
+	tr.GenPFMap()
+
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	p := &Peer{Torrent: tr}
+	p.open(a)
+	p.peerChoking = false
+	p.bitfield = make([]bool, len(tr.Pieces))
+	for i := range p.bitfield {
+		p.bitfield[i] = true
+	}
+	return p, NewWire(b)
+}
+
+func TestPipelineAcrossPieces(t *testing.T) {
+	data := make([]byte, 4*2*LengthOfBlock)
+	rand.Read(data)
+
+	p, w := downloadingPeer(t, data)
+	tr := p.Torrent
+
+	reqs := make(chan *RequestMsg, 100)
+	go func() {
+		for {
+			msg, err := w.ReadMessage()
+			if err != nil {
+				return
+			}
+			if m, ok := msg.(*RequestMsg); ok {
+				reqs <- m
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if !tr.startDownload(ctx, p) {
+		t.Fatal("no piece handed to the peer")
+	}
+
+	// nothing is answered yet, the requests have to go on past the
+	// two blocks of the first piece, up to the queue depth
+	got := []*RequestMsg{}
+	for len(got) < p.QueueDepth() {
+		select {
+		case m := <-reqs:
+			got = append(got, m)
+		case <-time.After(time.Second):
+			t.Fatalf("%v requests outstanding, the queue drained at the piece boundary", len(got))
+		}
+	}
+	if got[len(got)-1].Index == 0 {
+		t.Fatal("no requests for the next pieces")
+	}
+
+	// answering all the requests (the ones that follow too), until the download completes
+	answer := func(m *RequestMsg) {
+		off := int(m.Index)*2*LengthOfBlock + int(m.Begin)
+		block := data[off : off+int(m.Length)]
+		if err := p.handle(&PieceMsg{Index: m.Index, Begin: m.Begin, Block: block}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range got {
+		answer(m)
+	}
+	deadline := time.After(time.Second)
+	for !tr.Complete() {
+		select {
+		case m := <-reqs:
+			answer(m)
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("%v of %v pieces downloaded", tr.Downloaded(), len(tr.Pieces))
+		}
+	}
+	tr.wg.Wait()
+
+	b, err := os.ReadFile(tr.Files[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatal("wrong data written")
+	}
+}
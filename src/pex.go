@@ -0,0 +1,229 @@
+package src
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+// utPexID is the extended message id that we assign to `ut_pex`, the
+// peers send their PEX messages to us with this id (BEP 10, BEP 11)
+var utPexID = RegisterExtension("ut_pex", pexExtension{})
+
+// PexInterval is the time between the PEX messages sent to a peer, BEP 11
+// doesn't allow more than one a minute. Messages from a peer that come in
+// faster than half of it are ignored
+var PexInterval = time.Minute
+
+// PexMaxPeers is the largest number of added (and of dropped) peers in a single PEX message
+var PexMaxPeers = 50
+
+// Flags of the added peers in PEX messages (BEP 11)
+const (
+	PexEncryption byte = 0x01 // prefers encrypted connections
+	PexSeed       byte = 0x02 // is a seed (or upload-only)
+	PexUTP        byte = 0x04 // supports uTP
+	PexHolepunch  byte = 0x08 // supports the holepunch extension
+	PexReachable  byte = 0x10 // accepts incoming connections
+)
+
+// pexExtension handles the `ut_pex` messages, they bring the peers that the peer is connected to
+type pexExtension struct{}
+
+// Handshake of `ut_pex`, there's nothing to set up
+func (pexExtension) Handshake(p *Peer, hs map[string]interface{}) error {
+	return nil
+}
+
+// Handle adds the peers of a PEX message to the download, messages that arrive
+// sooner than half of `PexInterval` after the last one are ignored
+func (pexExtension) Handle(p *Peer, dict map[string]interface{}, data []byte) error {
+	p.mu.Lock()
+	last := p.pexRecv
+	if time.Since(last) >= PexInterval/2 {
+		p.pexRecv = time.Now()
+	}
+	p.mu.Unlock()
+
+	if time.Since(last) < PexInterval/2 {
+		output.DevInfof("pex message too soon, ignoring | %v:%v\n", p.IP, p.Port)
+		return nil
+	}
+
+	added := pexAdded(dict)
+	output.DevInfof("pex message, %v peers added | %v:%v\n", len(added), p.IP, p.Port)
+
+	p.Torrent.addPeers(added)
+	return nil
+}
+
+// pexAdded returns the added peers of a PEX message, IPv4 and IPv6, at most `PexMaxPeers`
+// of them. The dropped ones aren't of interest, if they are connected to us the
+// connection will tell the same
+func pexAdded(dict map[string]interface{}) []*Peer {
+	added := []*Peer{}
+	if s, ok := dict["added"].(string); ok {
+		added = append(added, parseCompactPeers([]byte(s))...)
+	}
+	if s, ok := dict["added6"].(string); ok {
+		added = append(added, parseCompactPeers6([]byte(s))...)
+	}
+	if len(added) > PexMaxPeers {
+		added = added[:PexMaxPeers]
+	}
+	return added
+}
+
+/*
+pex sends a PEX message to the peer every `PexInterval`, until the `done`
+channel of the connection is closed. Each message has the peers we got
+connected to, and the ones we got disconnected from, since the last one
+*/
+func (p *Peer) pex(done chan struct{}) {
+	t := time.NewTicker(PexInterval)
+	defer t.Stop()
+
+	// addresses of the peers that the peer has been told about
+	sent := make(map[string]*Peer)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		if !p.SupportsExtension("ut_pex") {
+			continue
+		}
+
+		now := make(map[string]*Peer)
+		for _, o := range p.Torrent.Peers() {
+			if addr := o.pexAddr(); o != p && addr != "" {
+				now[addr] = o
+			}
+		}
+
+		var added, dropped []*Peer
+		for addr, o := range now {
+			if sent[addr] == nil && len(added) < PexMaxPeers {
+				added = append(added, o)
+				sent[addr] = o
+			}
+		}
+		for addr, o := range sent {
+			if now[addr] == nil && len(dropped) < PexMaxPeers {
+				dropped = append(dropped, o)
+				delete(sent, addr)
+			}
+		}
+
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+
+		if err := p.SendExtended("ut_pex", pexDict(added, dropped), nil); err != nil {
+			return
+		}
+	}
+}
+
+// pexPort returns the port that the peer accepts connections on, 0 if it's
+// not known (an incoming peer that didn't tell us it's port)
+func (p *Peer) pexPort() uint16 {
+	if p.Inbound {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		return p.listenPort
+	}
+	return p.Port
+}
+
+// pexAddr returns the address that the peer accepts connections on, empty if it's not known
+func (p *Peer) pexAddr() string {
+	if p.pexPort() == 0 {
+		return ""
+	}
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.pexPort())))
+}
+
+// pexFlags returns the flags of the peer, for the PEX messages
+func (p *Peer) pexFlags() byte {
+	f := byte(0)
+	if !p.Inbound {
+		f |= PexReachable
+	}
+	if p.Encrypted {
+		f |= PexEncryption
+	}
+	if p.UTP {
+		f |= PexUTP
+	}
+
+	p.mu.Lock()
+	seed := len(p.bitfield) > 0
+	for _, has := range p.bitfield {
+		seed = seed && has
+	}
+	p.mu.Unlock()
+	if seed {
+		f |= PexSeed
+	}
+
+	return f
+}
+
+// pexDict builds the dictionary of a PEX message, the IPv4 and the
+// IPv6 peers are in `added` and `added6` (and `dropped`, `dropped6`)
+func pexDict(added, dropped []*Peer) map[string]interface{} {
+	var a4, f4, a6, f6, d4, d6 []byte
+
+	for _, o := range added {
+		port := o.pexPort()
+		if ip4 := o.IP.To4(); ip4 != nil {
+			a4 = append(append(a4, ip4...), byte(port>>8), byte(port))
+			f4 = append(f4, o.pexFlags())
+		} else {
+			a6 = append(append(a6, o.IP.To16()...), byte(port>>8), byte(port))
+			f6 = append(f6, o.pexFlags())
+		}
+	}
+
+	for _, o := range dropped {
+		port := o.pexPort()
+		if ip4 := o.IP.To4(); ip4 != nil {
+			d4 = append(append(d4, ip4...), byte(port>>8), byte(port))
+		} else {
+			d6 = append(append(d6, o.IP.To16()...), byte(port>>8), byte(port))
+		}
+	}
+
+	return map[string]interface{}{
+		"added":    string(a4),
+		"added.f":  string(f4),
+		"added6":   string(a6),
+		"added6.f": string(f6),
+		"dropped":  string(d4),
+		"dropped6": string(d6),
+	}
+}
+
+// addPeers connects to the peers found through PEX (or on the local network), the ones
+// that unchoke us are used for downloading. Nothing is done unless a download is in progress
+func (t *Torrent) addPeers(peers []*Peer) {
+	t.mu.Lock()
+	ss := t.ss
+	t.mu.Unlock()
+
+	if ss == nil || t.Complete() {
+		return
+	}
+
+	for _, p := range peers {
+		p.Torrent = t
+	}
+	ss.find(ss.ctx, peers)
+}
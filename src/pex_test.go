@@ -0,0 +1,151 @@
+package src
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// compact encodes the addresses (`ip:port`) as compact peer info, IPv4 or IPv6 by the address
+func compact(addrs ...string) string {
+	var b []byte
+	for _, a := range addrs {
+		addr, _ := net.ResolveTCPAddr("tcp", a)
+		ip := addr.IP.To4()
+		if ip == nil {
+			ip = addr.IP.To16()
+		}
+		b = append(append(b, ip...), byte(addr.Port>>8), byte(addr.Port))
+	}
+	return string(b)
+}
+
+// addrs returns the `ip:port` addresses of the peers
+func addrs(peers []*Peer) []string {
+	a := []string{}
+	for _, p := range peers {
+		a = append(a, net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port))))
+	}
+	return a
+}
+
+func TestPexAdded(t *testing.T) {
+	max := PexMaxPeers
+	defer func() { PexMaxPeers = max }()
+	PexMaxPeers = 3
+
+	tests := []struct {
+		name string
+		dict map[string]interface{}
+		want []string
+	}{
+		{"ipv4", map[string]interface{}{"added": compact("10.0.0.1:6881", "10.0.0.2:51413")},
+			[]string{"10.0.0.1:6881", "10.0.0.2:51413"}},
+		{"ipv6", map[string]interface{}{"added6": compact("[2001:db8::1]:6881")},
+			[]string{"[2001:db8::1]:6881"}},
+		{"both", map[string]interface{}{"added": compact("10.0.0.1:6881"), "added6": compact("[2001:db8::1]:6882")},
+			[]string{"10.0.0.1:6881", "[2001:db8::1]:6882"}},
+		{"the dropped ones aren't added", map[string]interface{}{
+			"added":    compact("10.0.0.1:6881"),
+			"dropped":  compact("10.0.0.2:6881"),
+			"dropped6": compact("[2001:db8::2]:6881"),
+		}, []string{"10.0.0.1:6881"}},
+		{"flags don't matter", map[string]interface{}{
+			"added":   compact("10.0.0.1:6881", "10.0.0.2:6881"),
+			"added.f": string([]byte{PexSeed | PexUTP}),
+		}, []string{"10.0.0.1:6881", "10.0.0.2:6881"}},
+		{"trailing bytes", map[string]interface{}{"added": compact("10.0.0.1:6881") + "\x0a\x00"},
+			[]string{"10.0.0.1:6881"}},
+		{"at most PexMaxPeers", map[string]interface{}{
+			"added":  compact("10.0.0.1:1", "10.0.0.2:2", "10.0.0.3:3"),
+			"added6": compact("[2001:db8::1]:4"),
+		}, []string{"10.0.0.1:1", "10.0.0.2:2", "10.0.0.3:3"}},
+		{"not a string", map[string]interface{}{"added": int64(1), "added6": []interface{}{"x"}}, []string{}},
+		{"empty", map[string]interface{}{}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := addrs(pexAdded(tt.dict))
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Fatalf("added %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPexDict(t *testing.T) {
+	tr := chokerTorrent(false)
+
+	// an outgoing peer over uTP that has all the pieces, an encrypted incoming one that
+	// told us it's port, and an IPv6 one
+	seed := &Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881, UTP: true, Torrent: tr, bitfield: []bool{true}}
+	in := &Peer{IP: net.IPv4(10, 0, 0, 2), Port: 40000, Inbound: true, Encrypted: true, listenPort: 6882, Torrent: tr}
+	v6 := &Peer{IP: net.ParseIP("2001:db8::1"), Port: 6883, Torrent: tr, bitfield: []bool{false}}
+	gone := &Peer{IP: net.IPv4(10, 0, 0, 3), Port: 6884, Torrent: tr}
+	gone6 := &Peer{IP: net.ParseIP("2001:db8::2"), Port: 6885, Torrent: tr}
+
+	dict := pexDict([]*Peer{seed, in, v6}, []*Peer{gone, gone6})
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"added", compact("10.0.0.1:6881", "10.0.0.2:6882")},
+		{"added.f", string([]byte{PexReachable | PexUTP | PexSeed, PexEncryption})},
+		{"added6", compact("[2001:db8::1]:6883")},
+		{"added6.f", string([]byte{PexReachable})},
+		{"dropped", compact("10.0.0.3:6884")},
+		{"dropped6", compact("[2001:db8::2]:6885")},
+	}
+	for _, tt := range tests {
+		if got, _ := dict[tt.key].(string); got != tt.want {
+			t.Errorf("%v = %x, want %x", tt.key, got, tt.want)
+		}
+	}
+
+	// and back, as the other side reads it
+	if got := addrs(pexAdded(dict)); strings.Join(got, " ") != "10.0.0.1:6881 10.0.0.2:6882 [2001:db8::1]:6883" {
+		t.Fatalf("added %v", got)
+	}
+
+	// an incoming peer that didn't tell it's port isn't sent
+	in.listenPort = 0
+	if in.pexAddr() != "" {
+		t.Fatalf("address %v, of an incoming peer without a port", in.pexAddr())
+	}
+}
+
+func TestPexTooSoon(t *testing.T) {
+	interval := PexInterval
+	defer func() { PexInterval = interval }()
+	PexInterval = 200 * time.Millisecond
+
+	p := &Peer{Torrent: chokerTorrent(false)}
+	dict := map[string]interface{}{"added": compact("10.0.0.1:6881")}
+
+	received := func() time.Time {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.pexRecv
+	}
+
+	// the first one is taken, the next one too soon after it isn't
+	pexExtension{}.Handle(p, dict, nil)
+	first := received()
+	if first.IsZero() {
+		t.Fatal("the first message wasn't taken")
+	}
+	pexExtension{}.Handle(p, dict, nil)
+	if !received().Equal(first) {
+		t.Fatal("a message too soon after the last one was taken")
+	}
+
+	time.Sleep(PexInterval / 2)
+	pexExtension{}.Handle(p, dict, nil)
+	if received().Equal(first) {
+		t.Fatal("a message after half the interval wasn't taken")
+	}
+}
@@ -0,0 +1,221 @@
+package src
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+/*
+PiecePicker decides which piece is to be downloaded next from a peer. `Pick`
+only returns pieces that the peer has, and that are neither downloaded nor
+being downloaded (from an other peer) yet, `nil` if there's no such piece
+*/
+type PiecePicker interface {
+	Pick(p *Peer) *Piece
+}
+
+// NewPicker returns the piece picker by it's name, "rarest", "random" or "sequential"
+func NewPicker(name string) (PiecePicker, error) {
+	switch name {
+	case "rarest":
+		return &RarestFirstPicker{RandomFirst: 4}, nil
+	case "random":
+		return &RandomPicker{}, nil
+	case "sequential":
+		return &SequentialPicker{}, nil
+	default:
+		return nil, fmt.Errorf("unknown piece picker, %v", name)
+	}
+}
+
+/*
+RarestFirstPicker picks the piece that the fewest of the connected peers have
+(ties are broken randomly), so the rare pieces get downloaded before the peers
+holding them leave. The first `RandomFirst` pieces are picked at random instead,
+as getting a complete piece (to upload) quickly matters more in the beginning
+*/
+type RarestFirstPicker struct {
+	RandomFirst int // number of pieces to be picked at random, before going rarest-first
+}
+
+// Pick the rarest piece that the peer has
+func (rp *RarestFirstPicker) Pick(p *Peer) *Piece {
+	t := p.Torrent
+	if t.Downloaded() < rp.RandomFirst {
+		return (&RandomPicker{}).Pick(p)
+	}
+
+	t.avail.Lock()
+	defer t.avail.Unlock()
+	t.avail.grow()
+
+	var best *Piece
+	min, ties := 0, 0
+
+	for i, piece := range t.Pieces {
+		if !wanted(p, i) {
+			continue
+		}
+
+		n := t.avail.counts[i]
+		switch {
+		case best == nil || n < min:
+			best, min, ties = piece, n, 1
+		case n == min:
+			// reservoir sampling, every one of the rarest pieces gets an equal chance
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = piece
+			}
+		}
+	}
+
+	return best
+}
+
+// RandomPicker picks a random piece out of the ones that the peer has
+type RandomPicker struct{}
+
+// Pick a random piece that the peer has
+func (rp *RandomPicker) Pick(p *Peer) *Piece {
+	var pick *Piece
+	n := 0
+
+	for i, piece := range p.Torrent.Pieces {
+		if !wanted(p, i) {
+			continue
+		}
+		n++
+		if rand.Intn(n) == 0 {
+			pick = piece
+		}
+	}
+
+	return pick
+}
+
+// SequentialPicker picks the pieces in order, the lowest piece-index first
+// (so the beginning of the files can be used before the download completes)
+type SequentialPicker struct{}
+
+// Pick the first piece that the peer has
+func (sp *SequentialPicker) Pick(p *Peer) *Piece {
+	for i, piece := range p.Torrent.Pieces {
+		if wanted(p, i) {
+			return piece
+		}
+	}
+	return nil
+}
+
+// wanted checks if the piece is to be downloaded, and the peer has it (and
+// would send it, if the peer is choking us it has to be in the allowed fast set)
+func wanted(p *Peer, pidx int) bool {
+	st := p.Torrent.Pieces[pidx].Status()
+	return st != PieceStatusDownloaded && st != PieceStatusRequested && p.HasPiece(pidx) &&
+		(!p.PeerChoking() || p.AllowedFast(uint32(pidx)))
+}
+
+/*
+Availability holds the availability of each piece, the number of connected peers that
+have the piece. It's updated from the `bitfield` and `have` messages, and a peer's
+pieces are no longer counted once it gets disconnected
+*/
+type Availability struct {
+	sync.Mutex
+	t      *Torrent
+	counts []int
+	peers  map[*Peer]bool // peers whose bitfield is being counted
+}
+
+// Count returns the number of connected peers that have the piece
+func (a *Availability) Count(pidx int) int {
+	a.Lock()
+	defer a.Unlock()
+
+	if pidx >= len(a.counts) {
+		return 0
+	}
+	return a.counts[pidx]
+}
+
+// setBitfield replaces the bitfield of the peer, and updates the counts
+func (a *Availability) setBitfield(p *Peer, bf []bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.remove(p)
+	p.mu.Lock()
+	p.bitfield = bf
+	p.mu.Unlock()
+	a.add(p)
+}
+
+// have records that the peer has got a new piece
+func (a *Availability) have(p *Peer, pidx int) {
+	a.Lock()
+	defer a.Unlock()
+
+	p.mu.Lock()
+	had := p.bitfield[pidx]
+	p.bitfield[pidx] = true
+	p.mu.Unlock()
+	if had {
+		return
+	}
+
+	if a.peers[p] {
+		a.grow()
+		a.counts[pidx]++
+	}
+}
+
+// forget stops counting the pieces of the peer (when it gets disconnected)
+func (a *Availability) forget(p *Peer) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.remove(p)
+}
+
+// add starts counting the pieces of the peer
+func (a *Availability) add(p *Peer) {
+	if a.peers == nil {
+		a.peers = make(map[*Peer]bool)
+	}
+	a.grow()
+
+	p.mu.Lock()
+	for i, has := range p.bitfield {
+		if has && i < len(a.counts) {
+			a.counts[i]++
+		}
+	}
+	p.mu.Unlock()
+	a.peers[p] = true
+}
+
+// remove stops counting the pieces of the peer, if they are being counted
+func (a *Availability) remove(p *Peer) {
+	if !a.peers[p] {
+		return
+	}
+
+	p.mu.Lock()
+	for i, has := range p.bitfield {
+		if has && i < len(a.counts) {
+			a.counts[i]--
+		}
+	}
+	p.mu.Unlock()
+	delete(a.peers, p)
+}
+
+// grow makes sure there's a count for every piece (the number
+// of pieces isn't known before the metadata is read)
+func (a *Availability) grow() {
+	if len(a.counts) < len(a.t.Pieces) {
+		a.counts = append(a.counts, make([]int, len(a.t.Pieces)-len(a.counts))...)
+	}
+}
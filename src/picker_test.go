@@ -0,0 +1,259 @@
+package src
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// pickerTorrent creates a torrent of the pieces, with the statuses
+func pickerTorrent(statuses ...uint8) *Torrent {
+	tr := &Torrent{peers: make(map[*Peer]bool)}
+	tr.avail = &Availability{t: tr}
+	for i, st := range statuses {
+		tr.Pieces = append(tr.Pieces, &Piece{Index: uint32(i), Length: 16384, status: st, t: tr})
+	}
+	return tr
+}
+
+// pickerPeer connects a peer that has the pieces (it's counted in the availability),
+// and has unchoked us. The messages sent to it are discarded
+func pickerPeer(t *testing.T, tr *Torrent, has ...int) *Peer {
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	go io.Copy(io.Discard, b)
+
+	p := &Peer{Torrent: tr}
+	p.open(a)
+	p.peerChoking = false
+
+	bf := make([]bool, len(tr.Pieces))
+	for _, i := range has {
+		bf[i] = true
+	}
+	tr.avail.setBitfield(p, bf)
+	return p
+}
+
+// pieceIndex returns the index of the piece, -1 if it's nil
+func pieceIndex(pc *Piece) int {
+	if pc == nil {
+		return -1
+	}
+	return int(pc.Index)
+}
+
+// short names of the piece statuses, for the tables
+const (
+	stNone = PieceStatusDefault
+	stDone = PieceStatusDownloaded
+	stBusy = PieceStatusRequested
+	stFail = PieceStatusFailed
+)
+
+func TestSequentialPicker(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []uint8
+		has      []int
+		want     int
+	}{
+		{"first piece", []uint8{stNone, stNone, stNone}, []int{0, 1, 2}, 0},
+		{"skips the downloaded ones", []uint8{stDone, stDone, stNone}, []int{0, 1, 2}, 2},
+		{"skips the ones being downloaded", []uint8{stBusy, stNone, stNone}, []int{0, 1, 2}, 1},
+		{"failed ones are picked again", []uint8{stDone, stFail, stNone}, []int{0, 1, 2}, 1},
+		{"only the peer's pieces", []uint8{stNone, stNone, stNone}, []int{2}, 2},
+		{"nothing the peer has", []uint8{stNone, stDone, stNone}, []int{1}, -1},
+		{"everything downloaded", []uint8{stDone, stDone}, []int{0, 1}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := pickerTorrent(tt.statuses...)
+			p := pickerPeer(t, tr, tt.has...)
+
+			if got := pieceIndex((&SequentialPicker{}).Pick(p)); got != tt.want {
+				t.Fatalf("picked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandomPicker(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []uint8
+		has      []int
+		want     []int // the pieces that can be picked, nil if none
+	}{
+		{"any of them", []uint8{stNone, stNone, stNone, stNone}, []int{0, 1, 2, 3}, []int{0, 1, 2, 3}},
+		{"only the ones left", []uint8{stDone, stBusy, stNone, stFail}, []int{0, 1, 2, 3}, []int{2, 3}},
+		{"only the peer's pieces", []uint8{stNone, stNone, stNone, stNone}, []int{1, 3}, []int{1, 3}},
+		{"nothing the peer has", []uint8{stNone, stDone}, []int{1}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := pickerTorrent(tt.statuses...)
+			p := pickerPeer(t, tr, tt.has...)
+
+			picks := make(map[int]int)
+			for i := 0; i < 400; i++ {
+				picks[pieceIndex((&RandomPicker{}).Pick(p))]++
+			}
+
+			if tt.want == nil {
+				if picks[-1] != 400 {
+					t.Fatalf("picked %v", picks)
+				}
+				return
+			}
+			// every one of them has a fair chance, and nothing else gets picked
+			for _, i := range tt.want {
+				if picks[i] < 400/len(tt.want)/2 {
+					t.Fatalf("piece %v picked %v times out of 400, %v", i, picks[i], picks)
+				}
+			}
+			if len(picks) != len(tt.want) {
+				t.Fatalf("picked %v, want %v", picks, tt.want)
+			}
+		})
+	}
+}
+
+func TestRarestFirstPicker(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []uint8
+		has      []int   // pieces of the peer picked for
+		others   [][]int // pieces of the other peers
+		random   int     // `RandomFirst`
+		want     []int   // the pieces that can be picked, nil if none
+	}{
+		{"the rarest", []uint8{stNone, stNone, stNone}, []int{0, 1, 2}, [][]int{{0, 1}, {0}}, 0, []int{2}},
+		{"ties broken randomly", []uint8{stNone, stNone, stNone}, []int{0, 1, 2}, [][]int{{0}}, 0, []int{1, 2}},
+		{"the rarest that's left", []uint8{stNone, stNone, stDone}, []int{0, 1, 2}, [][]int{{0, 1}, {0}}, 0, []int{1}},
+		{"the rarest the peer has", []uint8{stNone, stNone, stNone}, []int{0, 1}, [][]int{{0, 1}, {0}}, 0, []int{1}},
+		{"random first", []uint8{stNone, stNone, stNone}, []int{0, 1, 2}, [][]int{{0, 1}, {0}}, 1, []int{0, 1, 2}},
+		{"random until enough are downloaded", []uint8{stDone, stNone, stNone, stNone}, []int{1, 2, 3}, [][]int{{1, 2}}, 2, []int{1, 2, 3}},
+		{"rarest once enough are downloaded", []uint8{stDone, stDone, stNone, stNone}, []int{2, 3}, [][]int{{2}}, 2, []int{3}},
+		{"nothing the peer has", []uint8{stNone, stDone}, []int{1}, nil, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := pickerTorrent(tt.statuses...)
+			p := pickerPeer(t, tr, tt.has...)
+			for _, has := range tt.others {
+				pickerPeer(t, tr, has...)
+			}
+
+			picker := &RarestFirstPicker{RandomFirst: tt.random}
+			picks := make(map[int]int)
+			for i := 0; i < 300; i++ {
+				picks[pieceIndex(picker.Pick(p))]++
+			}
+
+			if tt.want == nil {
+				if picks[-1] != 300 {
+					t.Fatalf("picked %v", picks)
+				}
+				return
+			}
+			for _, i := range tt.want {
+				if picks[i] < 300/len(tt.want)/2 {
+					t.Fatalf("piece %v picked %v times out of 300, %v", i, picks[i], picks)
+				}
+			}
+			if len(picks) != len(tt.want) {
+				t.Fatalf("picked %v, want %v", picks, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickAllowedFast(t *testing.T) {
+	tr := pickerTorrent(stNone, stNone, stNone, stNone)
+	p := pickerPeer(t, tr, 0, 1, 2, 3)
+
+	// choked, only the pieces of the allowed fast set can be picked
+	p.peerChoking = true
+	p.allowed = map[uint32]bool{2: true}
+
+	pickers := []PiecePicker{&SequentialPicker{}, &RandomPicker{}, &RarestFirstPicker{}}
+	for _, picker := range pickers {
+		if got := pieceIndex(picker.Pick(p)); got != 2 {
+			t.Fatalf("%T picked %v while choked, want 2", picker, got)
+		}
+	}
+
+	p.allowed = nil
+	for _, picker := range pickers {
+		if got := picker.Pick(p); got != nil {
+			t.Fatalf("%T picked %v while choked", picker, got.Index)
+		}
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	tr := pickerTorrent(stNone, stNone, stNone, stNone)
+	p := pickerPeer(t, tr, 0, 1)
+	q := pickerPeer(t, tr, 1)
+
+	counts := func() []int {
+		c := []int{}
+		for i := range tr.Pieces {
+			c = append(c, tr.avail.Count(i))
+		}
+		return c
+	}
+	check := func(step string, want ...int) {
+		t.Helper()
+		got := counts()
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%v, counts %v, want %v", step, got, want)
+			}
+		}
+	}
+
+	check("bitfields", 1, 2, 0, 0)
+
+	// a `have` is counted once, even if it's sent twice
+	if err := q.handle(&HaveMsg{Index: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.handle(&HaveMsg{Index: 3}); err != nil {
+		t.Fatal(err)
+	}
+	check("have", 1, 2, 0, 1)
+
+	// a `have` out of range
+	if err := q.handle(&HaveMsg{Index: 4}); err == nil {
+		t.Fatal("have of a piece that doesn't exist")
+	}
+
+	// a new bitfield replaces the peer's pieces
+	if err := p.handle(&BitfieldMsg{Bitfield: []byte{0x20}}); err != nil {
+		t.Fatal(err)
+	}
+	check("bitfield replaced", 0, 1, 1, 1)
+
+	// a peer that sends `have`s without a bitfield
+	r := pickerPeer(t, tr)
+	tr.avail.forget(r)
+	r.mu.Lock()
+	r.bitfield = nil
+	r.mu.Unlock()
+	if err := r.handle(&HaveMsg{Index: 0}); err != nil {
+		t.Fatal(err)
+	}
+	check("have without a bitfield", 1, 1, 1, 1)
+
+	// the pieces of a disconnected peer aren't counted
+	q.Disconnect()
+	check("disconnected", 1, 0, 1, 0)
+	r.Disconnect()
+	p.Disconnect()
+	check("all disconnected", 0, 0, 0, 0)
+}
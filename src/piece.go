@@ -1,11 +1,10 @@
 package src
 
 import (
-	"bytes"
-	"encoding/binary"
 	"math"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/ritsource/torrent-client/output"
 )
@@ -24,14 +23,34 @@ type Piece struct {
 	Hash   []byte   // 20-byte long SHA1-hash of the piece-data, extracted from `.torrent` file
 	Length uint32   // size of piece (equal to piece-length of torrent)
 	Blocks []*Block // pointer to blocks that the piece conatins
-	Status uint8    // status of the piece default, requested, downloaded, failed
+
+	t      *Torrent       // the torrent that the piece is a part of
+	dl     *pieceDownload // state of the download in progress, shared by the peers downloading the piece
+	status uint8          // status of the piece default, requested, downloaded, failed (guarded by `mu`)
+	mu     sync.Mutex     // guards `dl` and `status`
+}
+
+// Status returns the status of the piece, default, requested, downloaded or failed
+func (p *Piece) Status() uint8 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.status
+}
+
+// SetStatus sets the status of the piece
+func (p *Piece) SetStatus(st uint8) {
+	p.mu.Lock()
+	p.status = st
+	p.mu.Unlock()
 }
 
 // GenBlocks calculates out blocks of data of a piece and
 // appends pointer to all the `Block` on `Piece.Blocks`
 func (p *Piece) GenBlocks() {
-	// nubmer of blocks that the piece holds (for block-length = LengthOfBlock)
-	n := int(math.Ceil(float64(p.Length / uint32(LengthOfBlock))))
+	// nubmer of blocks that the piece holds (for block-length = LengthOfBlock),
+	// the last block is shorter if the piece-length isn't a multiple of it
+	n := (int(p.Length) + LengthOfBlock - 1) / LengthOfBlock
 
 	// calculating each possible block's "index", "start
 	// -offset" and "length" and appending them to `p.Blocks`
@@ -57,12 +76,12 @@ func (p *Piece) WriteToFiles(data []byte) (int, error) {
 	output.DevInfof("Piece-Index=%v\n", p.Index)
 
 	// retrieving the files where the data has to be written, the method
-	// `Torr.WhichFiles` returns pointer to all the files that a piece covers
-	fs := Torr.WhichFiles(int(p.Index))
+	// `Torrent.WhichFiles` returns pointer to all the files that a piece covers
+	fs := p.t.WhichFiles(int(p.Index))
 
 	// `psoff` and `peoff` are the "piece start offset" and
 	// "piece end offset" in the full concatinated data
-	psoff := int(p.Length * p.Index)
+	psoff := p.t.PieceOffset(int(p.Index))
 	peoff := psoff + int(p.Length)
 
 	// calculating and writing the right chunk of for each file
@@ -115,6 +134,50 @@ func (p *Piece) WriteToFiles(data []byte) (int, error) {
 	return int(p.Length), nil
 }
 
+/*
+ReadFromFiles reads the data of the piece back from the files it covers, it's
+the opposite of `WriteToFiles` (same offset calculations). Used for uploading
+the piece to other peers, so the piece must have been downloaded already
+*/
+func (p *Piece) ReadFromFiles() ([]byte, error) {
+	data := make([]byte, p.Length)
+
+	// the files that the piece covers
+	fs := p.t.WhichFiles(int(p.Index))
+
+	// "piece start offset" and "piece end offset" in the full concatinated data
+	psoff := p.t.PieceOffset(int(p.Index))
+	peoff := psoff + int(p.Length)
+
+	for _, f := range fs {
+		// `rs` and `re` is the offset in the piece data where the data read
+		// from the file begins and ends, `off` is the offset in the file
+		var rs, re, off int
+
+		if f.Start > psoff {
+			rs = f.Start - psoff
+			off = 0
+		} else {
+			rs = 0
+			off = psoff - f.Start
+		}
+
+		if f.Start+f.Length > peoff {
+			re = int(p.Length)
+		} else {
+			re = f.Start + f.Length - psoff
+		}
+
+		// so `data[rs:re]` needs to be read, from `off` offset of file
+		_, err := f.ReadData(data[rs:re], off)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
 /*
 LengthOfBlock is the length of each block. While downloading pieces
 from the peers, we request pieces in chunks. This is called a block.
@@ -129,16 +192,9 @@ type Block struct {
 	Length     uint32 // length of the block in bytes
 }
 
-// RequestBuff builds and returns a buffer for `Block` request message
-func (b *Block) RequestBuff() (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
-	// length of message (1 (id) + 4 (piece-index) + 4 (begin) + 4 (length) = 13 bytes)
-	err := binary.Write(buf, binary.BigEndian, uint32(13))
-	err = binary.Write(buf, binary.BigEndian, uint8(6))     // message-id
-	err = binary.Write(buf, binary.BigEndian, b.PieceIndex) // piece-index
-	err = binary.Write(buf, binary.BigEndian, b.Begin)      // length
-	err = binary.Write(buf, binary.BigEndian, b.Length)     // begin offset
-	return buf, err
+// Request builds the request message for the `Block`
+func (b *Block) Request() *RequestMsg {
+	return &RequestMsg{Index: b.PieceIndex, Begin: b.Begin, Length: b.Length}
 }
 
 // File holds necessary info for each file
@@ -197,3 +253,14 @@ func (f *File) WriteData(bs []byte, off int) (int, error) {
 	// writing the provided data on the right file offset (also provided)
 	return fl.WriteAt(bs, int64(off))
 }
+
+// ReadData reads data from the `File` at the provided offset, into `bs`
+func (f *File) ReadData(bs []byte, off int) (int, error) {
+	fl, err := os.Open(f.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer fl.Close()
+
+	return fl.ReadAt(bs, int64(off))
+}
@@ -0,0 +1,160 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+
+	"github.com/marksamman/bencode"
+	"github.com/ritsource/torrent-client/output"
+)
+
+/*
+Resume restores the state of an interrupted download. If a fast-resume file
+(`fn`) exists and the files on disk haven't changed since it was saved, the
+pieces recorded in it are marked as downloaded straight away. Otherwise all
+the data on disk gets rehashed (`Torrent.Recheck`). Returns the number of
+pieces that don't need to be downloaded again
+*/
+func (t *Torrent) Resume(fn string) int {
+	if fn != "" {
+		n, err := t.LoadResume(fn)
+		if err == nil {
+			output.DevInfof("fast-resume, %v pieces already downloaded\n", n)
+			return n
+		}
+		output.DevInfof("couldn't fast-resume, rechecking files, %v\n", err)
+	}
+
+	return t.Recheck()
+}
+
+/*
+Recheck hashes the data that already exists on disk, piece by piece (through
+`PFMap`), and marks the pieces whose hash matches as `PieceStatusDownloaded`.
+The pieces that are missing, incomplete or corrupt are left to be downloaded.
+Returns the number of verified pieces
+*/
+func (t *Torrent) Recheck() int {
+	n := 0
+
+	for _, piece := range t.Pieces {
+		// any of the files might be missing or shorter than
+		// expected, then the piece can't be read at all
+		data, err := piece.ReadFromFiles()
+		if err != nil {
+			continue
+		}
+
+		hash, err := GetSHA1(data)
+		if err != nil || !reflect.DeepEqual(hash, piece.Hash) {
+			continue
+		}
+
+		piece.SetStatus(PieceStatusDownloaded)
+		n++
+	}
+
+	output.DevInfof("recheck complete, %v out of %v pieces already downloaded\n", n, len(t.Pieces))
+	return n
+}
+
+/*
+SaveResume writes the fast-resume file, it holds the infohash, the bitfield of the
+downloaded pieces, and the size and modification time of each file. A change to any
+of the files after it's saved invalidates it (the data gets rehashed instead)
+*/
+func (t *Torrent) SaveResume(fn string) error {
+	files := []interface{}{}
+	for _, f := range t.Files {
+		size, mtime := fileStat(f.Path)
+		files = append(files, map[string]interface{}{
+			"path":  f.Path,
+			"size":  size,
+			"mtime": mtime,
+		})
+	}
+
+	data := bencode.Encode(map[string]interface{}{
+		"info hash": string(t.InfoHash),
+		"bitfield":  string(t.Bitfield()),
+		"files":     files,
+	})
+
+	// writing to a temporary file first, so a crash
+	// never leaves a half-written resume file behind
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+/*
+LoadResume reads the fast-resume file, and marks the pieces recorded in it as
+`PieceStatusDownloaded`. An error is returned (and nothing is marked) if the
+file is for an other torrent, or if any of the files has changed since
+*/
+func (t *Torrent) LoadResume(fn string) (int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dict, err := bencode.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	ih, _ := dict["info hash"].(string)
+	if !bytes.Equal([]byte(ih), t.InfoHash) {
+		return 0, fmt.Errorf("resume file is for an other torrent")
+	}
+
+	bf, _ := dict["bitfield"].(string)
+	if len(bf) != (len(t.Pieces)+7)/8 {
+		return 0, fmt.Errorf("invalid bitfield length in resume file, %v", len(bf))
+	}
+
+	// the files has to be exactly the same as when the resume file was saved
+	files, _ := dict["files"].([]interface{})
+	if len(files) != len(t.Files) {
+		return 0, fmt.Errorf("number of files doesn't match")
+	}
+	for i, file := range files {
+		fd, _ := file.(map[string]interface{})
+		path, _ := fd["path"].(string)
+		size, _ := fd["size"].(int64)
+		mtime, _ := fd["mtime"].(int64)
+
+		if path != t.Files[i].Path {
+			return 0, fmt.Errorf("file path doesn't match, %v", path)
+		}
+		if s, m := fileStat(path); s != size || m != mtime {
+			return 0, fmt.Errorf("file has changed since, %v", path)
+		}
+	}
+
+	n := 0
+	for i, piece := range t.Pieces {
+		if bf[i/8]&(0x80>>uint(i%8)) != 0 {
+			piece.SetStatus(PieceStatusDownloaded)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// fileStat returns the size and modification time (unix nanoseconds)
+// of a file, -1 and 0 if the file doesn't exist
+func fileStat(fn string) (int64, int64) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return -1, 0
+	}
+	return fi.Size(), fi.ModTime().UnixNano()
+}
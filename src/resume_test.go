@@ -0,0 +1,190 @@
+package src
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resumeTorrent creates a torrent of three files (100000 bytes in 4 pieces, the middle ones
+// span two files each) with random data, and writes the files in the directory
+func resumeTorrent(t *testing.T, dir string) *Torrent {
+	const plen = 32768
+	names, lengths := []string{"a", "b", "c"}, []int{50000, 30000, 20000}
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+
+	tr := readTorrent(t, dir, plen, names, lengths)
+	tr.GenPFMap()
+	for i, piece := range tr.Pieces {
+		end := (i + 1) * plen
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[i*plen : end])
+		piece.Hash = h[:]
+	}
+
+	off := 0
+	for i, f := range tr.Files {
+		os.MkdirAll(filepath.Dir(f.Path), 0755)
+		if err := os.WriteFile(f.Path, data[off:off+lengths[i]], 0644); err != nil {
+			t.Fatal(err)
+		}
+		off += lengths[i]
+	}
+	return tr
+}
+
+// downloaded returns the indexes of the downloaded pieces
+func downloaded(tr *Torrent) []int {
+	idxs := []int{}
+	for i, piece := range tr.Pieces {
+		if piece.Status() == PieceStatusDownloaded {
+			idxs = append(idxs, i)
+		}
+	}
+	return idxs
+}
+
+// sameInts checks if the two slices are the same
+func sameInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRecheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, tr *Torrent)
+		want   []int // the pieces verified
+	}{
+		{"intact", func(*testing.T, *Torrent) {}, []int{0, 1, 2, 3}},
+		{"a file missing", func(t *testing.T, tr *Torrent) {
+			os.Remove(tr.Files[1].Path)
+		}, []int{0, 3}},
+		{"a file cut short", func(t *testing.T, tr *Torrent) {
+			os.Truncate(tr.Files[2].Path, 10000)
+		}, []int{0, 1}},
+		{"a corrupt byte", func(t *testing.T, tr *Torrent) {
+			b, err := os.ReadFile(tr.Files[0].Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b[40000] ^= 0xff
+			os.WriteFile(tr.Files[0].Path, b, 0644)
+		}, []int{0, 2, 3}},
+		{"nothing on disk", func(t *testing.T, tr *Torrent) {
+			for _, f := range tr.Files {
+				os.Remove(f.Path)
+			}
+		}, []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := resumeTorrent(t, t.TempDir())
+			tt.change(t, tr)
+
+			n := tr.Recheck()
+			if got := downloaded(tr); n != len(tt.want) || !sameInts(got, tt.want) {
+				t.Fatalf("%v pieces verified %v, want %v", n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFastResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, tr *Torrent, fn string)
+		err    bool  // if the resume file has to be rejected (the files get rehashed)
+		want   []int // the pieces `Resume` finds, from the resume file or the rehash
+	}{
+		{"unchanged", func(*testing.T, *Torrent, string) {}, false, []int{0, 2}},
+		{"a file grew", func(t *testing.T, tr *Torrent, fn string) {
+			f, err := os.OpenFile(tr.Files[1].Path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte{0})
+			f.Close()
+		}, true, []int{0, 1, 2, 3}},
+		{"a file modified since", func(t *testing.T, tr *Torrent, fn string) {
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(tr.Files[2].Path, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}, true, []int{0, 1, 2, 3}},
+		{"a file missing", func(t *testing.T, tr *Torrent, fn string) {
+			os.Remove(tr.Files[0].Path)
+		}, true, []int{2, 3}},
+		{"another torrent", func(t *testing.T, tr *Torrent, fn string) {
+			tr.InfoHash = make([]byte, 20)
+		}, true, []int{0, 1, 2, 3}},
+		{"truncated resume file", func(t *testing.T, tr *Torrent, fn string) {
+			b, _ := os.ReadFile(fn)
+			os.WriteFile(fn, b[:len(b)/2], 0644)
+		}, true, []int{0, 1, 2, 3}},
+		{"no resume file", func(t *testing.T, tr *Torrent, fn string) {
+			os.Remove(fn)
+		}, true, []int{0, 1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fn := filepath.Join(dir, ".resume")
+
+			// pieces 0 and 2 were downloaded (as far as the resume file is concerned)
+			tr := resumeTorrent(t, dir)
+			tr.Pieces[0].SetStatus(PieceStatusDownloaded)
+			tr.Pieces[2].SetStatus(PieceStatusDownloaded)
+			if err := tr.SaveResume(fn); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(fn + ".tmp"); !os.IsNotExist(err) {
+				t.Fatal("the temporary file is left behind")
+			}
+
+			// the next run, with nothing downloaded yet
+			for _, piece := range tr.Pieces {
+				piece.SetStatus(PieceStatusDefault)
+			}
+			tt.change(t, tr, fn)
+
+			n, err := tr.LoadResume(fn)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("stale resume file accepted, %v pieces", n)
+				}
+				if got := downloaded(tr); len(got) != 0 {
+					t.Fatalf("pieces %v marked from a rejected resume file", got)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			// the files get rehashed if the resume file is rejected, then everything
+			// that's on disk is found (not only what the resume file had)
+			for _, piece := range tr.Pieces {
+				piece.SetStatus(PieceStatusDefault)
+			}
+			n = tr.Resume(fn)
+			if got := downloaded(tr); n != len(tt.want) || !sameInts(got, tt.want) {
+				t.Fatalf("%v pieces resumed %v, want %v", n, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package src
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DHTBucketSize is the maximum number of nodes in a k-bucket (K)
+const DHTBucketSize = 8
+
+// DHTNodeExpiry is the duration after which a node that we haven't heard from
+// is considered questionable, and can be replaced by a new node in the bucket
+var DHTNodeExpiry = 15 * time.Minute
+
+// DHTNode represents a single node in the DHT network
+type DHTNode struct {
+	ID       []byte       // 20-byte node id
+	Addr     *net.UDPAddr // UDP address of the node
+	LastSeen time.Time    // when did we last hear from this node
+	Fails    int          // number of consecutive queries that the node didn't respond to
+}
+
+/*
+RoutingTable holds the nodes that we know about in k-buckets. Bucket `i` holds
+the nodes whose ids share a prefix of exactly `i` bits with our own id, so the
+closer a node is to us (XOR distance) the deeper the bucket it falls into
+*/
+type RoutingTable struct {
+	ID      []byte // our own node id
+	buckets [160][]*DHTNode
+	mu      sync.Mutex
+}
+
+// NewRoutingTable creates an empty routing table for the given node id
+func NewRoutingTable(id []byte) *RoutingTable {
+	return &RoutingTable{ID: id}
+}
+
+/*
+Insert adds a node to the routing table, or refreshes it if it's already there.
+If the bucket is full the least recently seen node gets replaced, but only if
+it has gone bad (failed to respond or expired). Returns if the node is in the table
+*/
+func (rt *RoutingTable) Insert(n *DHTNode) bool {
+	idx := rt.bucketIndex(n.ID)
+	if idx < 0 {
+		return false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	bkt := rt.buckets[idx]
+
+	// if the node is already in the bucket, moving it to the end (most recently
+	// seen), only if we have heard from it more recently than what's recorded
+	for i, nd := range bkt {
+		if bytes.Equal(nd.ID, n.ID) {
+			if n.LastSeen.After(nd.LastSeen) {
+				nd.Addr = n.Addr
+				nd.LastSeen = n.LastSeen
+				nd.Fails = 0
+				rt.buckets[idx] = append(append(bkt[:i:i], bkt[i+1:]...), nd)
+			}
+			return true
+		}
+	}
+
+	if len(bkt) < DHTBucketSize {
+		rt.buckets[idx] = append(bkt, n)
+		return true
+	}
+
+	// bucket is full, replacing the first bad node (least recently seen first)
+	for i, nd := range bkt {
+		if nd.Fails > 0 || time.Since(nd.LastSeen) > DHTNodeExpiry {
+			rt.buckets[idx] = append(append(bkt[:i:i], bkt[i+1:]...), n)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Failed records a failed query to a node, it gets removed after two failures
+func (rt *RoutingTable) Failed(id []byte) {
+	idx := rt.bucketIndex(id)
+	if idx < 0 {
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	bkt := rt.buckets[idx]
+	for i, nd := range bkt {
+		if bytes.Equal(nd.ID, id) {
+			nd.Fails++
+			if nd.Fails >= 2 {
+				rt.buckets[idx] = append(bkt[:i:i], bkt[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// Closest returns the `n` nodes closest to the target id (by XOR distance)
+func (rt *RoutingTable) Closest(target []byte, n int) []*DHTNode {
+	nodes := rt.Nodes()
+	sortByDistance(nodes, target)
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// Nodes returns all the nodes in the routing table
+func (rt *RoutingTable) Nodes() []*DHTNode {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	nodes := []*DHTNode{}
+	for _, bkt := range rt.buckets {
+		nodes = append(nodes, bkt...)
+	}
+	return nodes
+}
+
+// Len returns the number of nodes in the routing table
+func (rt *RoutingTable) Len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	n := 0
+	for _, bkt := range rt.buckets {
+		n += len(bkt)
+	}
+	return n
+}
+
+// bucketIndex returns the length of the common prefix of `id` and our own
+// id (in bits), -1 if the id is invalid or it's our own id
+func (rt *RoutingTable) bucketIndex(id []byte) int {
+	if len(id) != 20 {
+		return -1
+	}
+
+	for i := 0; i < 20; i++ {
+		x := id[i] ^ rt.ID[i]
+		if x == 0 {
+			continue
+		}
+		n := i * 8
+		for x&0x80 == 0 {
+			x <<= 1
+			n++
+		}
+		return n
+	}
+
+	return -1
+}
+
+// sortByDistance sorts the nodes by their XOR distance to the target id
+func sortByDistance(nodes []*DHTNode, target []byte) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].ID, nodes[j].ID)
+	})
+}
+
+// closer reports if `a` is closer to the target than `b`
+func closer(target, a, b []byte) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
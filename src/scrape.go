@@ -0,0 +1,199 @@
+package src
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/marksamman/bencode"
+	"github.com/ritsource/torrent-client/output"
+)
+
+// MaxScrapeHashes is the number of infohashes that fit in a single UDP scrape request (BEP 15)
+const MaxScrapeHashes = 74
+
+// ScrapeResult holds the numbers the tracker has on a torrent
+type ScrapeResult struct {
+	Complete   int // number of seeders
+	Incomplete int // number of leechers
+	Downloaded int // number of times the download has been completed
+}
+
+/*
+Scrape asks the tracker about the torrents of the infohashes, without announcing.
+The results are mapped by infohash (as a string), the torrents that the tracker
+doesn't know about are left out
+*/
+func Scrape(ctx context.Context, tr *url.URL, infohashes [][]byte) (map[string]*ScrapeResult, error) {
+	switch tr.Scheme {
+	case "udp":
+		return ScrapeUDP(ctx, tr.Host, infohashes)
+	case "http", "https":
+		return ScrapeHTTP(ctx, tr, infohashes)
+	default:
+		return nil, fmt.Errorf("unsupported announce protocol, %v", tr.Scheme)
+	}
+}
+
+/*
+ScrapeURL derives the scrape URL of a HTTP tracker from it's announce URL, the
+last "announce" in the path gets replaced with "scrape". An error is returned if
+the path doesn't end in "announce..", then the tracker doesn't support scraping
+*/
+func ScrapeURL(tr *url.URL) (*url.URL, error) {
+	dir, file := path.Split(tr.Path)
+	if !strings.HasPrefix(file, "announce") {
+		return nil, fmt.Errorf("tracker doesn't support scrape, %v", tr)
+	}
+
+	u := *tr
+	u.Path = dir + "scrape" + strings.TrimPrefix(file, "announce")
+	return &u, nil
+}
+
+// ScrapeHTTP sends a scrape request to a HTTP tracker
+func ScrapeHTTP(ctx context.Context, tr *url.URL, infohashes [][]byte) (map[string]*ScrapeResult, error) {
+	u, err := ScrapeURL(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the infohashes are added to the query, if there's one there already
+	pr := u.Query()
+	for _, ih := range infohashes {
+		pr.Add("info_hash", string(ih))
+	}
+	u.RawQuery = pr.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scrape request failed: %v", resp.StatusCode)
+	}
+
+	data, err := bencode.Decode(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := data["failure reason"]; ok {
+		return nil, fmt.Errorf("scrape request rejected: %v", v)
+	}
+
+	// `files` maps the infohashes to the dictionaries with the numbers
+	files, _ := data["files"].(map[string]interface{})
+
+	res := make(map[string]*ScrapeResult)
+	for ih, v := range files {
+		d, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		sr := &ScrapeResult{}
+		if n, ok := d["complete"].(int64); ok {
+			sr.Complete = int(n)
+		}
+		if n, ok := d["incomplete"].(int64); ok {
+			sr.Incomplete = int(n)
+		}
+		if n, ok := d["downloaded"].(int64); ok {
+			sr.Downloaded = int(n)
+		}
+		res[ih] = sr
+	}
+
+	return res, nil
+}
+
+/*
+ScrapeUDP scrapes the infohashes from a UDP tracker (`host:port`). At most `MaxScrapeHashes`
+infohashes fit in a single request, so those are scraped in batches (one after another),
+and the results are merged
+*/
+func ScrapeUDP(ctx context.Context, addr string, infohashes [][]byte) (map[string]*ScrapeResult, error) {
+	res := make(map[string]*ScrapeResult)
+
+	for len(infohashes) > 0 {
+		n := len(infohashes)
+		if n > MaxScrapeHashes {
+			n = MaxScrapeHashes
+		}
+
+		batch, err := scrapeUDP(ctx, addr, infohashes[:n])
+		if err != nil {
+			return nil, err
+		}
+		for ih, sr := range batch {
+			res[ih] = sr
+		}
+
+		infohashes = infohashes[n:]
+	}
+
+	return res, nil
+}
+
+/*
+scrapeUDP sends a single scrape request to a UDP tracker, of at most `MaxScrapeHashes`
+infohashes, see `udpRequest` for the connection and the retransmissions
+
+Packet structure looks like,
+[0-8] -> `connection_id` -> `connection_id` recieved from UDP-connection-response (64-Bit integer)
+[8-12] -> `action` -> 2, represents scrape request (32-Bit integer)
+[12-16] -> `transaction_id` -> a fresh `transaction_id`, for each request (32-Bit integer)
+[16-..] -> `info_hash` -> the infohashes, 20 bytes each
+
+Response packet structure looks like,
+[0-4] -> `action` -> 2 (32-Bit integer)
+[4-8] -> `transaction_id` -> same as in the request (32-Bit integer)
+[8-..] -> `seeders`, `completed` and `leechers` of each infohash, in order (32-Bit integers)
+*/
+func scrapeUDP(ctx context.Context, addr string, infohashes [][]byte) (map[string]*ScrapeResult, error) {
+	if len(infohashes) > MaxScrapeHashes {
+		return nil, fmt.Errorf("too many infohashes to scrape, %v > %v", len(infohashes), MaxScrapeHashes)
+	}
+
+	// the infohashes follow the connection id, action and transaction id
+	body := []byte{}
+	for _, ih := range infohashes {
+		body = append(body, ih...)
+	}
+
+	resp, err := udpRequest(ctx, addr, udpActionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+
+	output.DevInfof("read %v bytes as udp scrape response\n", len(resp))
+
+	BE := binary.BigEndian
+
+	res := make(map[string]*ScrapeResult)
+	for i, ih := range infohashes {
+		off := 8 + i*12
+		if off+12 > len(resp) {
+			break
+		}
+
+		res[string(ih)] = &ScrapeResult{
+			Complete:   int(BE.Uint32(resp[off : off+4])),
+			Downloaded: int(BE.Uint32(resp[off+4 : off+8])),
+			Incomplete: int(BE.Uint32(resp[off+8 : off+12])),
+		}
+	}
+
+	return res, nil
+}
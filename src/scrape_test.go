@@ -0,0 +1,97 @@
+package src
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// udpTracker starts a UDP tracker on loopback that answers the connection, announce and
+// scrape requests. The announces get the peers back (in compact form), and the seeders of
+// each torrent scraped are the first byte of it's infohash. The number of infohashes in
+// each scrape request is sent on the channel
+func udpTracker(t *testing.T, peers []byte) (string, chan int) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	reqs := make(chan int, 100)
+	go func() {
+		BE := binary.BigEndian
+		b := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+
+			resp := make([]byte, 8)
+			BE.PutUint32(resp[0:4], BE.Uint32(b[8:12]))
+			copy(resp[4:8], b[12:16])
+
+			switch BE.Uint32(b[8:12]) {
+			case udpActionConnect:
+				resp = append(resp, 0, 0, 0, 0, 0, 0, 0, 1)
+			case udpActionAnnounce:
+				// interval, leechers and seeders
+				nums := make([]byte, 12)
+				BE.PutUint32(nums[0:4], 1800)
+				resp = append(append(resp, nums...), peers...)
+			case udpActionScrape:
+				hashes := (n - 16) / 20
+				reqs <- hashes
+				for i := 0; i < hashes; i++ {
+					nums := make([]byte, 12)
+					BE.PutUint32(nums[0:4], uint32(b[16+i*20]))
+					resp = append(resp, nums...)
+				}
+			}
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), reqs
+}
+
+func TestScrapeUDPBatches(t *testing.T) {
+	addr, reqs := udpTracker(t, nil)
+
+	// more than two requests worth of infohashes
+	ihs := [][]byte{}
+	for i := 0; i < 2*MaxScrapeHashes+10; i++ {
+		ih := make([]byte, 20)
+		rand.Read(ih)
+		ih[0] = byte(i)
+		ihs = append(ihs, ih)
+	}
+
+	res, err := ScrapeUDP(context.Background(), addr, ihs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != len(ihs) {
+		t.Fatalf("%v results, want %v", len(res), len(ihs))
+	}
+	for i, ih := range ihs {
+		if sr := res[string(ih)]; sr == nil || sr.Complete != i%256 {
+			t.Fatalf("wrong result of infohash %v, %+v", i, sr)
+		}
+	}
+
+	// the tracker counts the infohashes before it answers
+	batches := []int{}
+	for len(reqs) > 0 {
+		batches = append(batches, <-reqs)
+	}
+	if len(batches) != 3 || batches[0] != MaxScrapeHashes || batches[1] != MaxScrapeHashes || batches[2] != 10 {
+		t.Fatalf("scraped in batches of %v", batches)
+	}
+}
@@ -0,0 +1,201 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+// MaxRequestLength is the largest block that a peer can request from us
+var MaxRequestLength = LengthOfBlock * 2
+
+/*
+accept accepts peer connections on the client's port (the port we announce to
+the trackers), until the listener gets closed. Every peer connecting to us gets
+served in it's own goroutine, we send them our bitfield and answer their block
+requests with the data that we have downloaded
+*/
+func (c *Client) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			output.DevWarnf("stopped accepting peer connections, %v\n", err)
+			return
+		}
+
+		go c.Serve(conn)
+	}
+}
+
+/*
+Serve handles an incoming peer connection. It expects the peer to send a handshake
+for the infohash of one of our torrents, responds with our own handshake and bitfield,
+and then reads messages from the peer until the connection closes (same as for the peers
+that we connect to). The peer gets unchoked as soon as it's interested, and each `request`
+is answered with a `piece` message
+*/
+func (c *Client) Serve(conn net.Conn) {
+	// the connection is over TCP, or uTP
+	p := &Peer{Inbound: true}
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		p.IP, p.Port = addr.IP, uint16(addr.Port)
+	case *net.UDPAddr:
+		p.IP, p.Port, p.UTP = addr.IP, uint16(addr.Port), true
+	}
+
+	// the connection might be encrypted (MSE), then the handshake is encrypted too
+	conn.SetReadDeadline(time.Now().Add(PeerIdleTimeout))
+	econn, encrypted, err := c.acceptPeer(conn)
+	if err != nil {
+		output.DevWarnf("couldn't accept incoming connection, %v | %v:%v\n", err, p.IP, p.Port)
+		conn.Close()
+		return
+	}
+
+	p.open(econn)
+	p.Encrypted = encrypted
+	defer p.Disconnect()
+
+	conn.SetReadDeadline(time.Now().Add(PeerIdleTimeout))
+
+	// reading the peer's handshake, the infohash has to be of one of our torrents
+	hs, err := p.Wire.ReadHandshake()
+	if err != nil {
+		output.DevWarnf("couldn't read incoming handshake, %v | %v:%v\n", err, p.IP, p.Port)
+		return
+	}
+	t := c.torrent(hs.InfoHash)
+	if t == nil {
+		output.DevWarnf("invalid incoming handshake, disconnecting.. | %v:%v\n", p.IP, p.Port)
+		return
+	}
+	// and of the torrent that the MSE handshake was for, if the connection is encrypted
+	if cc, ok := econn.(*cryptoConn); ok && cc.skey != nil && !bytes.Equal(cc.skey, hs.InfoHash) {
+		output.DevWarnf("incoming handshake for another torrent than the mse one, disconnecting.. | %v:%v\n", p.IP, p.Port)
+		return
+	}
+	p.Torrent, p.ID = t, hs.PeerID
+
+	ours := &Handshake{InfoHash: t.InfoHash, PeerID: []byte(c.PeerID)}
+	ours.Reserved[5] |= 0x10
+	ours.Reserved[7] |= fastBit
+	err = p.Wire.WriteHandshake(ours)
+	if err != nil {
+		return
+	}
+	p.Fast = hs.Reserved[7]&fastBit != 0
+
+	// letting the peer know which pieces we have
+	if err := p.sendPieces(); err != nil {
+		return
+	}
+
+	// and which extensions we support, if it supports the extension protocol
+	if hs.Reserved[5]&0x10 != 0 {
+		if err := p.sendExtHandshake(); err != nil {
+			return
+		}
+	}
+
+	output.DevInfof("incoming peer connected | %v:%v\n", p.IP, p.Port)
+
+	p.run()
+}
+
+/*
+serveRequest answers a block request with a `piece` message. Requests from
+a peer that we are choking (unless the piece is in it's allowed fast set), and
+for pieces that we don't have, are ignored, or rejected if the peer supports
+the Fast Extension (BEP 6)
+*/
+func (p *Peer) serveRequest(m *RequestMsg) error {
+	if int(m.Index) >= len(p.Torrent.Pieces) {
+		return fmt.Errorf("request for invalid piece, %v", m.Index)
+	}
+
+	p.mu.Lock()
+	allowed := p.ourFast[m.Index] || !p.amChoking
+	p.mu.Unlock()
+
+	if !allowed {
+		return p.reject(m)
+	}
+
+	// the block has to be within the piece (checked so that `Begin + Length` can't overflow)
+	piece := p.Torrent.Pieces[m.Index]
+	if piece.Status() != PieceStatusDownloaded || m.Length == 0 || int(m.Length) > MaxRequestLength || m.Begin > piece.Length || m.Length > piece.Length-m.Begin {
+		return p.reject(m)
+	}
+
+	// the last piece read from the files is cached, as the
+	// blocks of a piece are usually requested one after another
+	p.mu.Lock()
+	data := p.upData
+	if piece != p.upPiece {
+		data = nil
+	}
+	p.mu.Unlock()
+
+	if data == nil {
+		var err error
+		data, err = piece.ReadFromFiles()
+		if err != nil {
+			output.DevErrorf("couldn't read piece %v, %v\n", m.Index, err)
+			return err
+		}
+
+		p.mu.Lock()
+		p.upPiece, p.upData = piece, data
+		p.mu.Unlock()
+	}
+
+	err := p.Send(&PieceMsg{Index: m.Index, Begin: m.Begin, Block: data[m.Begin : m.Begin+m.Length]})
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&p.Uploaded, int64(m.Length))
+	atomic.AddInt64(&p.Torrent.Uploaded, int64(m.Length))
+	return nil
+}
+
+// BroadcastHave sends a `have` message to all the connected peers, to let them
+// know that we have just finished downloading the piece. We might not be
+// interested in some of the peers anymore, they get told so too
+func (t *Torrent) BroadcastHave(pidx uint32) {
+	for _, p := range t.Peers() {
+		go func(p *Peer) {
+			p.Send(&HaveMsg{Index: pidx})
+			p.updateInterest()
+		}(p)
+	}
+}
+
+// Peers returns the peers that we are connected to, either way
+func (t *Torrent) Peers() []*Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	peers := make([]*Peer, 0, len(t.peers))
+	for p := range t.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Bitfield builds the bitfield message payload, from the status of the pieces.
+// The highest bit of the first byte corresponds to piece 0, spare bits are 0
+func (t *Torrent) Bitfield() []byte {
+	bf := make([]byte, (len(t.Pieces)+7)/8)
+	for i, p := range t.Pieces {
+		if p.Status() == PieceStatusDownloaded {
+			bf[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return bf
+}
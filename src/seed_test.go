@@ -0,0 +1,87 @@
+package src
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// servingPeer creates an unchoked peer (with the Fast Extension) of a torrent with a single
+// downloaded piece, the other end of it's connection is returned to read the answers from
+func servingPeer(t *testing.T, data []byte) (*Peer, *Wire) {
+	fn := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &Torrent{PieceLen: uint32(len(data)), Size: len(data)}
+	tr.Files = []*File{{Path: fn, Length: len(data)}}
+	tr.Pieces = []*Piece{{Index: 0, Length: uint32(len(data)), status: PieceStatusDownloaded, t: tr}}
+	tr.GenPFMap()
+
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	p := &Peer{Torrent: tr}
+	p.open(a)
+	p.Fast = true
+	p.amChoking = false
+	return p, NewWire(b)
+}
+
+func TestServeRequest(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2048) // 32768 bytes
+
+	tests := []struct {
+		name   string
+		begin  uint32
+		length uint32
+		served bool
+	}{
+		{"first block", 0, 16384, true},
+		{"last block", 16384, 16384, true},
+		{"short block at the end", 32768 - 100, 100, true},
+		{"past the end", 16384 + 1, 16384, false},
+		{"begin past the piece", 32769, 1, false},
+		{"begin + length wraps to 0", 0xFFFFC000, 0x4000, false},
+		{"begin + length wraps within the piece", 0xFFFFFFFF, 2, false},
+		{"zero length", 0, 0, false},
+		{"too long", 0, uint32(MaxRequestLength) + 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, w := servingPeer(t, data)
+
+			m := &RequestMsg{Index: 0, Begin: tt.begin, Length: tt.length}
+			errc := make(chan error, 1)
+			go func() { errc <- p.serveRequest(m) }()
+
+			msg, err := w.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			switch r := msg.(type) {
+			case *PieceMsg:
+				if !tt.served {
+					t.Fatalf("served an invalid request, begin %v length %v", tt.begin, tt.length)
+				}
+				if !bytes.Equal(r.Block, data[tt.begin:tt.begin+tt.length]) {
+					t.Fatal("wrong block data")
+				}
+			case *RejectMsg:
+				if tt.served {
+					t.Fatal("valid request rejected")
+				}
+			default:
+				t.Fatalf("unexpected answer, %T", msg)
+			}
+		})
+	}
+}
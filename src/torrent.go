@@ -3,23 +3,24 @@ package src
 // comment
 
 import (
+	"context"
+	"fmt"
 	"math"
+	"math/rand"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/marksamman/bencode"
 )
 
-// Torr holds teh values read from
-// the provided `.torrent` file
-var Torr = &Torrent{}
-
 // ReadFile reads the `.torrent` file provided
-// in the arguemet and populates `Torr` with
-// the relevent data. The torrent specific
-// data is accessable via `src.Torr`
-func ReadFile(fn string) error {
+// in the arguemet and populates the `Torrent`
+// with the relevent data
+func (t *Torrent) ReadFile(fn string) error {
 
 	// reading the `.torrent` file content. It
 	// contains information about the files you
@@ -37,9 +38,9 @@ func ReadFile(fn string) error {
 		return err
 	}
 
-	// populating `Torr` with data
+	// populating the `Torrent` with data
 	// read from the decoded dictionary
-	return Torr.Read(&dict)
+	return t.Read(&dict)
 }
 
 // Constants corrosponding to file-mode enum value of `Torrent`
@@ -50,15 +51,39 @@ const (
 
 // Torrent holds necesary data aquired from `.torrent` file
 type Torrent struct {
-	Announce *url.URL // announce URL of the tracker
-	InfoHash []byte   // 20-byte long SHA1-hash of the bencode encoded info dictionary
-	Mode     uint8    // enum specifying if single-file torrent or multi-file
-	Files    []*File  // list of Files, where downloaded data needs to be written
-	DirName  string   // name of the directory
-	PieceLen uint32   // length of each piece in bytes (equal)
-	Pieces   []*Piece // list containing pieces of data
-	Size     int      // total size
-	PFMap    [][]*File
+	Announce     *url.URL     // announce URL of the tracker
+	AnnounceList [][]*url.URL // tiers of tracker announce URLs (BEP 12), falls back to `Announce`
+	InfoHash     []byte       // 20-byte long SHA1-hash of the bencode encoded info dictionary
+	Mode         uint8        // enum specifying if single-file torrent or multi-file
+	Files        []*File      // list of Files, where downloaded data needs to be written
+	DirName      string       // name of the directory
+	PieceLen     uint32       // length of each piece in bytes (equal)
+	Pieces       []*Piece     // list containing pieces of data
+	Size         int          // total size
+	PFMap        [][]*File
+	Picker       PiecePicker // decides which piece to download next
+	ResumeFile   string      // path of the fast-resume file, empty if disabled
+	Uploaded     int64       // total number of bytes uploaded to other peers (to be accessed atomically)
+
+	// total number of bytes downloaded from other peers (to be accessed atomically)
+	DownloadedBytes int64
+
+	client   *Client                  // the client that the torrent belongs to
+	mu       sync.Mutex               // guards `peers`, `trackers` and `ss`
+	peers    map[*Peer]bool           // peers that we are connected to, either way
+	avail    *Availability            // availability of each piece among the connected peers
+	xpeers   []*Peer                  // peers from the magnet link (`x.pe`), the trackers might not know them
+	started  int32                    // if the download has started, 1 if it has (to be accessed atomically)
+	wg       sync.WaitGroup           // piece downloads in progress
+	pickMu   sync.Mutex               // serializes the picking of pieces, see `startDownload`
+	trackers map[string]*trackerState // by announce url
+	annStop  context.CancelFunc       // stops the announce loop
+	annDone  chan struct{}            // closed when the announce loop returns
+	ss       *seeders                 // the peers being downloaded from, nil until the download starts
+	metadata []byte                   // the bencoded info dictionary, served to the peers (BEP 9)
+
+	choker    *Choker            // decides which peers get the upload slots
+	chokeStop context.CancelFunc // stops the choker
 }
 
 // WhichFiles .
@@ -68,32 +93,98 @@ func (t *Torrent) WhichFiles(pidx int) []*File {
 
 // PRFMap -> Piece Range / File map
 
-// GenPFMap .
+// GenPFMap maps each piece to the files that it covers (in order). A piece
+// can cover multiple files, and a file can span multiple pieces. Zero-length
+// files don't hold any data, so those aren't mapped to any piece at all
 func (t *Torrent) GenPFMap() {
-	mmap := make([][]*File, t.Size/int(t.PieceLen))
+	mmap := make([][]*File, len(t.Pieces))
 
 	for _, f := range t.Files {
+		if f.Length == 0 {
+			continue
+		}
+
 		// fpof, first piece's index of this file
 		// lpof, last piece's index of this file
 		fpof, lpof := t.getFileOffset(f)
 
-		for x := fpof; x <= lpof; x++ {
-			mmap[int(x)] = append(mmap[int(x)], f)
+		for x := fpof; x <= lpof && x < len(mmap); x++ {
+			mmap[x] = append(mmap[x], f)
 		}
 	}
 
 	t.PFMap = mmap
 }
 
+// getFileOffset returns the indexes of the first and the last piece
+// that the file covers (the file can't be empty)
 func (t *Torrent) getFileOffset(f *File) (int, int) {
-	s := int(math.Ceil(float64(f.Start / int(t.PieceLen))))
-	e := int(math.Ceil(float64((f.Start + f.Length) / int(t.PieceLen))))
+	s := f.Start / int(t.PieceLen)
+	e := (f.Start + f.Length - 1) / int(t.PieceLen)
 
-	if (f.Start+f.Length)%int(t.PieceLen) == 0 {
-		return s, e - 1
-	}
 	return s, e
+}
 
+// CreateEmptyFiles creates the zero-length files, as no piece covers them
+// they would never get created by writing the downloaded data
+func (t *Torrent) CreateEmptyFiles() error {
+	for _, f := range t.Files {
+		if f.Length != 0 {
+			continue
+		}
+		if _, err := os.Stat(f.Path); err == nil {
+			continue
+		}
+		if err := f.Create(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+readAnnounceList reads the `announce-list` property (a list of lists of URLs)
+from the metainfo dictionary. As said in BEP 12, the URLs within each tier are
+shuffled once when they are read, invalid URLs and empty tiers are skipped
+*/
+func readAnnounceList(dict map[string]interface{}) [][]*url.URL {
+	tiers := [][]*url.URL{}
+
+	lst, ok := dict["announce-list"].([]interface{})
+	if !ok {
+		return tiers
+	}
+
+	for _, t := range lst {
+		urls, ok := t.([]interface{})
+		if !ok {
+			continue
+		}
+
+		tier := []*url.URL{}
+		for _, u := range urls {
+			str, ok := u.(string)
+			if !ok {
+				continue
+			}
+			tr, err := url.Parse(str)
+			if err != nil {
+				continue
+			}
+			tier = append(tier, tr)
+		}
+
+		if len(tier) == 0 {
+			continue
+		}
+
+		// shuffling the trackers in the tier
+		rand.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+
+		tiers = append(tiers, tier)
+	}
+
+	return tiers
 }
 
 // Read reads a bencode dictionary and populates
@@ -101,92 +192,187 @@ func (t *Torrent) getFileOffset(f *File) (int, int) {
 func (t *Torrent) Read(dict *map[string]interface{}) error {
 	var err error
 
-	// reading the announce-url from bencode metainfo dictionary
-	// fmt.Println((*dict)["announce"].(string))
-	t.Announce, err = url.Parse((*dict)["announce"].(string))
-	if err != nil {
-		return err
+	// reading the announce-url from bencode metainfo dictionary, it's
+	// optional if the torrent comes with an `announce-list` though
+	if a, ok := (*dict)["announce"].(string); ok {
+		t.Announce, err = url.Parse(a)
+		if err != nil {
+			return err
+		}
+	}
+
+	// reading the tiers of trackers from `announce-list` (multitracker
+	// extension). If it's absent, `Announce` becomes the only tier
+	// (a magnet link might not have any tracker at all though)
+	t.AnnounceList = readAnnounceList(*dict)
+	if len(t.AnnounceList) == 0 && t.Announce != nil {
+		t.AnnounceList = [][]*url.URL{{t.Announce}}
+	}
+	if t.Announce == nil && len(t.AnnounceList) > 0 {
+		t.Announce = t.AnnounceList[0][0]
+	}
+
+	// converting info into a dictionary (map[string]interface{}), the
+	// metainfo might come from a peer (magnet links), so nothing in it is
+	// taken for granted, every value is checked before it's used
+	info, ok := (*dict)["info"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid metainfo, no info dictionary")
 	}
 
 	// calculating infohash, a 20-byte long SHA1 hash of bencode encoded
 	// info value. Every torrent is uniquely identified by its infohash
-	enc := bencode.Encode((*dict)["info"])
+	enc := bencode.Encode(info)
 	hash, err := GetSHA1(enc)
 	if err != nil {
 		return err
 	}
 	t.InfoHash = hash
-
-	// converting info into a dictionary (map[string]interface{})
-	info := (*dict)["info"].(map[string]interface{})
+	t.metadata = enc
 
 	// extracting each piece length from
 	// the decoded info dictionary
-	t.PieceLen = uint32(info["piece length"].(int64))
+	plen, ok := info["piece length"].(int64)
+	if !ok || plen <= 0 || plen > math.MaxUint32 {
+		return fmt.Errorf("invalid metainfo, piece length %v", info["piece length"])
+	}
+	t.PieceLen = uint32(plen)
 
 	// concatinated SHA1 hash of all the pieces,
 	// can be used to extract the number of pieces
-	pieces := []byte(info["pieces"].(string))
-
-	// reading pieces from the concatinated hash
-	// and appending `*Piece` to the `Torrent`
-	for i := 0; i+20 <= len(pieces); i += 20 {
-		t.Pieces = append(t.Pieces, &Piece{
-			Hash:   pieces[i : i+20],
-			Index:  uint32(i / 20),
-			Length: t.PieceLen,
-		})
+	phashes, ok := info["pieces"].(string)
+	if !ok {
+		return fmt.Errorf("invalid metainfo, no pieces")
 	}
+	pieces := []byte(phashes)
+
+	// the files can't hold more data than the pieces cover (it keeps the
+	// sums of the lengths from overflowing, whatever the metainfo says)
+	maxSize := int64(len(pieces)/20) * plen
 
-	// total size of the content, to be downloaded
-	t.Size = int(t.PieceLen) * len(t.Pieces)
+	// the paths are joined to the data directory, so none of their
+	// components can lead out of it (see `validPathComponent`)
+	name, ok := info["name"].(string)
+	if !ok || !validPathComponent(name) {
+		return fmt.Errorf("invalid metainfo, name %q", info["name"])
+	}
 
 	// checking if `info["files"]` property exists. If "yes" then
 	// it's a multi file downloader, else single-file downloader
 	if _, ok := info["files"]; ok {
-		t.Mode = TorrMultiFile            // setting file-mode to multi-file enum
-		t.DirName = info["name"].(string) // root directory name
+		t.Mode = TorrMultiFile // setting file-mode to multi-file enum
+		t.DirName = name       // root directory name
 
 		// converting the value at `info["files"]` into a list
-		files := info["files"].([]interface{})
-		dirnm := info["name"].(string)
+		files, ok := info["files"].([]interface{})
+		if !ok {
+			return fmt.Errorf("invalid metainfo, files isn't a list")
+		}
 
 		off := 0
 
-		for _, file := range files {
+		for i, file := range files {
 			// converting each element into dictionaries,
 			// that describes a single file
-			f := file.(map[string]interface{})
+			f, ok := file.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("invalid metainfo, file %v isn't a dictionary", i)
+			}
 
 			// extracting the file path from the
 			// list of file and directory names
+			pl, ok := f["path"].([]interface{})
+			if !ok || len(pl) == 0 {
+				return fmt.Errorf("invalid metainfo, file %v has no path", i)
+			}
+
 			var fp string
-			for _, p := range f["path"].([]interface{}) {
-				fp = path.Join(fp, p.(string))
+			for _, p := range pl {
+				c, ok := p.(string)
+				if !ok || !validPathComponent(c) {
+					return fmt.Errorf("invalid metainfo, file %v has an invalid path", i)
+				}
+				fp = path.Join(fp, c)
 			}
 
-			lng := int(uint32(f["length"].(int64)))
+			lng, ok := f["length"].(int64)
+			if !ok || lng < 0 || lng > maxSize-int64(off) {
+				return fmt.Errorf("invalid metainfo, file %v length %v", i, f["length"])
+			}
 
 			// appending all the files in `Piles` peroperty of `Torrent`
 			t.Files = append(t.Files, &File{
-				Path:   path.Join(dirnm, fp),
+				Path:   path.Join(name, fp),
 				Start:  off,
-				Length: lng,
+				Length: int(lng),
 			})
 
-			off += lng
+			off += int(lng)
 		}
 	} else {
 		t.Mode = TorrSingleFile // single-file mode
 
+		lng, ok := info["length"].(int64)
+		if !ok || lng < 0 || lng > maxSize {
+			return fmt.Errorf("invalid metainfo, length %v", info["length"])
+		}
+
 		// appending the single file in `Files` property.
 		// for single-file mode length will always be 1
 		t.Files = append(t.Files, &File{
-			Path:   info["name"].(string),
+			Path:   name,
 			Start:  0,
-			Length: int(uint32(info["length"].(int64))),
+			Length: int(lng),
+		})
+	}
+
+	// total size of the content to be downloaded, the sum of the file lengths
+	t.Size = 0
+	for _, f := range t.Files {
+		t.Size += f.Length
+	}
+
+	// the number of pieces has to be just enough to cover all the data
+	n := len(pieces) / 20
+	if len(pieces)%20 != 0 || t.PieceLen == 0 || n != (t.Size+int(t.PieceLen)-1)/int(t.PieceLen) {
+		return fmt.Errorf("invalid metainfo, %v pieces of %v bytes for %v bytes of data", n, t.PieceLen, t.Size)
+	}
+
+	// reading pieces from the concatinated hash
+	// and appending `*Piece` to the `Torrent`
+	for i := 0; i < n; i++ {
+		t.Pieces = append(t.Pieces, &Piece{
+			Hash:   pieces[i*20 : i*20+20],
+			Index:  uint32(i),
+			Length: t.PieceLength(i),
+			t:      t,
 		})
 	}
 
 	return nil
 }
+
+// validPathComponent checks if a file or directory name from the metainfo is safe to be
+// used in a path, it can't be empty, `.` or `..`, have a separator or a volume name in it
+func validPathComponent(c string) bool {
+	if c == "" || c == "." || c == ".." || filepath.VolumeName(c) != "" {
+		return false
+	}
+	return !strings.ContainsAny(c, "/\\\x00")
+}
+
+// PieceLength returns the length of the piece, all the pieces are `PieceLen`
+// bytes long except for the last one, which holds whatever data is left
+func (t *Torrent) PieceLength(pidx int) uint32 {
+	off := int(t.PieceLen) * pidx
+	if t.Size-off < int(t.PieceLen) {
+		return uint32(t.Size - off)
+	}
+	return t.PieceLen
+}
+
+// PieceOffset returns the offset where the piece starts, in the full data
+// (all the files concatenated)
+func (t *Torrent) PieceOffset(pidx int) int {
+	return int(t.PieceLen) * pidx
+}
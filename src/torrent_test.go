@@ -0,0 +1,345 @@
+package src
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/marksamman/bencode"
+)
+
+// metainfo builds the metainfo dictionary of a torrent of the files (names and lengths),
+// in the directory of the name. A single file makes it a single-file torrent
+func metainfo(name string, plen int, names []string, lengths []int) map[string]interface{} {
+	size := 0
+	for _, l := range lengths {
+		size += l
+	}
+	n := (size + plen - 1) / plen
+
+	info := map[string]interface{}{
+		"piece length": int64(plen),
+		"pieces":       strings.Repeat("h", 20*n),
+	}
+	if len(names) == 1 {
+		info["name"] = names[0]
+		info["length"] = int64(lengths[0])
+	} else {
+		info["name"] = name
+		files := []interface{}{}
+		for i, nm := range names {
+			files = append(files, map[string]interface{}{
+				"path":   []interface{}{nm},
+				"length": int64(lengths[i]),
+			})
+		}
+		info["files"] = files
+	}
+
+	return map[string]interface{}{"info": info}
+}
+
+// readTorrent reads the torrent of the files from it's metainfo dictionary (see `metainfo`),
+// the files go in the directory (as `Client.add` puts them in the data directory)
+func readTorrent(t *testing.T, dir string, plen int, names []string, lengths []int) *Torrent {
+	dict := metainfo("files", plen, names, lengths)
+	tr := &Torrent{}
+	if err := tr.Read(&dict); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range tr.Files {
+		f.Path = filepath.Join(dir, f.Path)
+	}
+	return tr
+}
+
+func TestTorrentLayout(t *testing.T) {
+	const plen = 32768
+
+	tests := []struct {
+		name      string
+		files     []string
+		lengths   []int
+		size      int
+		last      uint32  // length of the last piece
+		lastBlock uint32  // length of the last block of the last piece
+		blocks    int     // number of blocks of the last piece
+		pfmap     [][]int // indexes of the files that each piece covers
+		offsets   [][]int // first and last piece of each file, nil for the zero-length ones
+	}{
+		{
+			name:    "single file",
+			files:   []string{"a"},
+			lengths: []int{100000},
+			size:    100000, last: 100000 - 3*plen, lastBlock: 100000 - 3*plen, blocks: 1,
+			pfmap:   [][]int{{0}, {0}, {0}, {0}},
+			offsets: [][]int{{0, 3}},
+		},
+		{
+			name:    "single file of whole pieces",
+			files:   []string{"a"},
+			lengths: []int{2 * plen},
+			size:    2 * plen, last: plen, lastBlock: 16384, blocks: 2,
+			pfmap:   [][]int{{0}, {0}},
+			offsets: [][]int{{0, 1}},
+		},
+		{
+			name:    "multiple files on piece boundaries",
+			files:   []string{"a", "b"},
+			lengths: []int{plen, plen},
+			size:    2 * plen, last: plen, lastBlock: 16384, blocks: 2,
+			pfmap:   [][]int{{0}, {1}},
+			offsets: [][]int{{0, 0}, {1, 1}},
+		},
+		{
+			name:    "files straddling pieces",
+			files:   []string{"a", "b", "c"},
+			lengths: []int{40000, 30000, 10000},
+			size:    80000, last: 80000 - 2*plen, lastBlock: 80000 - 2*plen, blocks: 1,
+			pfmap:   [][]int{{0}, {0, 1}, {1, 2}},
+			offsets: [][]int{{0, 1}, {1, 2}, {2, 2}},
+		},
+		{
+			name:    "a piece covering three files",
+			files:   []string{"a", "b", "c"},
+			lengths: []int{30000, 1000, 40000},
+			size:    71000, last: 71000 - 2*plen, lastBlock: 71000 - 2*plen, blocks: 1,
+			pfmap:   [][]int{{0, 1, 2}, {2}, {2}},
+			offsets: [][]int{{0, 0}, {0, 0}, {0, 2}},
+		},
+		{
+			name:    "zero-length files",
+			files:   []string{"a", "b", "c", "d", "e"},
+			lengths: []int{0, 50000, 0, 20000, 0},
+			size:    70000, last: 70000 - 2*plen, lastBlock: 70000 - 2*plen, blocks: 1,
+			pfmap:   [][]int{{1}, {1, 3}, {3}},
+			offsets: [][]int{nil, {0, 1}, nil, {1, 2}, nil},
+		},
+		{
+			name:    "last piece of multiple blocks",
+			files:   []string{"a", "b"},
+			lengths: []int{plen, 20000},
+			size:    plen + 20000, last: 20000, lastBlock: 20000 - 16384, blocks: 2,
+			pfmap:   [][]int{{0}, {1}},
+			offsets: [][]int{{0, 0}, {1, 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := readTorrent(t, t.TempDir(), plen, tt.files, tt.lengths)
+
+			if tr.Size != tt.size {
+				t.Fatalf("size %v, want %v", tr.Size, tt.size)
+			}
+			if len(tr.Pieces) != len(tt.pfmap) {
+				t.Fatalf("%v pieces, want %v", len(tr.Pieces), len(tt.pfmap))
+			}
+
+			for i, piece := range tr.Pieces {
+				want := uint32(plen)
+				if i == len(tr.Pieces)-1 {
+					want = tt.last
+				}
+				if piece.Length != want || tr.PieceLength(i) != want {
+					t.Fatalf("piece %v is %v bytes (%v), want %v", i, piece.Length, tr.PieceLength(i), want)
+				}
+				piece.GenBlocks()
+			}
+
+			last := tr.Pieces[len(tr.Pieces)-1]
+			if len(last.Blocks) != tt.blocks {
+				t.Fatalf("%v blocks in the last piece, want %v", len(last.Blocks), tt.blocks)
+			}
+			if b := last.Blocks[len(last.Blocks)-1]; b.Length != tt.lastBlock || b.Begin+b.Length != tt.last {
+				t.Fatalf("last block at %v of %v bytes, want %v bytes", b.Begin, b.Length, tt.lastBlock)
+			}
+
+			for i, f := range tr.Files {
+				if f.Length == 0 {
+					continue
+				}
+				if s, e := tr.getFileOffset(f); s != tt.offsets[i][0] || e != tt.offsets[i][1] {
+					t.Fatalf("file %v covers pieces %v-%v, want %v", tt.files[i], s, e, tt.offsets[i])
+				}
+			}
+
+			tr.GenPFMap()
+			pfmap := [][]int{}
+			for _, fs := range tr.PFMap {
+				idx := []int{}
+				for _, f := range fs {
+					for i := range tr.Files {
+						if tr.Files[i] == f {
+							idx = append(idx, i)
+						}
+					}
+				}
+				pfmap = append(pfmap, idx)
+			}
+			if !reflect.DeepEqual(pfmap, tt.pfmap) {
+				t.Fatalf("piece-file map %v, want %v", pfmap, tt.pfmap)
+			}
+
+			// writing the pieces, each file has to end up with it's part of the data
+			data := make([]byte, tr.Size)
+			rand.Read(data)
+			for i, piece := range tr.Pieces {
+				off := tr.PieceOffset(i)
+				n, err := piece.WriteToFiles(data[off : off+int(piece.Length)])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != int(piece.Length) {
+					t.Fatalf("%v bytes written of piece %v, want %v", n, i, piece.Length)
+				}
+			}
+			if err := tr.CreateEmptyFiles(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, f := range tr.Files {
+				b, err := os.ReadFile(f.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, data[f.Start:f.Start+f.Length]) {
+					t.Fatalf("file %v has the wrong data, %v bytes of %v", tt.files[i], len(b), f.Length)
+				}
+			}
+		})
+	}
+}
+
+func TestReadInvalidMetainfo(t *testing.T) {
+	// changes to the info dictionary of a valid torrent, of two files
+	tests := []struct {
+		name   string
+		change func(info map[string]interface{})
+	}{
+		{"piece length missing", func(info map[string]interface{}) { delete(info, "piece length") }},
+		{"piece length a string", func(info map[string]interface{}) { info["piece length"] = "32768" }},
+		{"piece length zero", func(info map[string]interface{}) { info["piece length"] = int64(0) }},
+		{"piece length negative", func(info map[string]interface{}) { info["piece length"] = int64(-1) }},
+		{"piece length too big", func(info map[string]interface{}) { info["piece length"] = int64(1) << 40 }},
+		{"pieces missing", func(info map[string]interface{}) { delete(info, "pieces") }},
+		{"pieces a list", func(info map[string]interface{}) { info["pieces"] = []interface{}{} }},
+		{"pieces not a multiple of 20", func(info map[string]interface{}) { info["pieces"] = info["pieces"].(string)[1:] }},
+		{"too few pieces", func(info map[string]interface{}) { info["pieces"] = info["pieces"].(string)[20:] }},
+		{"name missing", func(info map[string]interface{}) { delete(info, "name") }},
+		{"name an integer", func(info map[string]interface{}) { info["name"] = int64(1) }},
+		{"files a dictionary", func(info map[string]interface{}) { info["files"] = map[string]interface{}{} }},
+		{"file a string", func(info map[string]interface{}) { info["files"] = []interface{}{"a"} }},
+		{"path missing", func(info map[string]interface{}) { delete(file(info, 0), "path") }},
+		{"path empty", func(info map[string]interface{}) { file(info, 0)["path"] = []interface{}{} }},
+		{"path a string", func(info map[string]interface{}) { file(info, 0)["path"] = "a" }},
+		{"path component an integer", func(info map[string]interface{}) { file(info, 1)["path"] = []interface{}{"d", int64(1)} }},
+		{"length missing", func(info map[string]interface{}) { delete(file(info, 1), "length") }},
+		{"length a string", func(info map[string]interface{}) { file(info, 0)["length"] = "100" }},
+		{"length negative", func(info map[string]interface{}) { file(info, 0)["length"] = int64(-100) }},
+		{"lengths overflowing", func(info map[string]interface{}) {
+			file(info, 0)["length"] = int64(1) << 62
+			file(info, 1)["length"] = int64(1) << 62
+		}},
+		{"single file length missing", func(info map[string]interface{}) {
+			delete(info, "files")
+		}},
+		{"single file length too big", func(info map[string]interface{}) {
+			delete(info, "files")
+			info["length"] = int64(1) << 62
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dict := metainfo("d", 32768, []string{"a", "b"}, []int{40000, 30000})
+			tt.change(dict["info"].(map[string]interface{}))
+
+			if err := (&Torrent{}).Read(&dict); err == nil {
+				t.Fatal("invalid metainfo read")
+			}
+		})
+	}
+
+	for _, dict := range []map[string]interface{}{{}, {"info": "d4:name1:ae"}, {"info": []interface{}{}}} {
+		if err := (&Torrent{}).Read(&dict); err == nil {
+			t.Fatalf("metainfo without an info dictionary read, %v", dict)
+		}
+	}
+}
+
+// file returns the dictionary of a file, from the info dictionary of a multi-file torrent
+func file(info map[string]interface{}, i int) map[string]interface{} {
+	return info["files"].([]interface{})[i].(map[string]interface{})
+}
+
+func TestReadUnsafePaths(t *testing.T) {
+	tests := []struct {
+		name string   // of the torrent, the directory of a multi-file one
+		path []string // of the second file of it, nil for a single-file torrent
+		ok   bool
+	}{
+		{"a", nil, true},
+		{"dir", []string{"sub", "b"}, true},
+		{"a..b", []string{"..b", "c.."}, true},
+		{"..", nil, false},
+		{".", nil, false},
+		{"", nil, false},
+		{"../a", nil, false},
+		{"/etc/passwd", nil, false},
+		{"dir", []string{".."}, false},
+		{"dir", []string{"..", "..", "etc", "passwd"}, false},
+		{"dir", []string{"sub", ".", "b"}, false},
+		{"dir", []string{"/etc/passwd"}, false},
+		{"dir", []string{"a/../../b"}, false},
+		{"dir", []string{`..\..\b`}, false},
+		{"dir", []string{""}, false},
+		{"dir", []string{"b\x00"}, false},
+		{"../dir", []string{"b"}, false},
+	}
+
+	for _, tt := range tests {
+		dict := metainfo(tt.name, 32768, []string{tt.name}, []int{1000})
+		if tt.path != nil {
+			dict = metainfo(tt.name, 32768, []string{"a", "b"}, []int{1000, 1000})
+			path := []interface{}{}
+			for _, c := range tt.path {
+				path = append(path, c)
+			}
+			file(dict["info"].(map[string]interface{}), 1)["path"] = path
+		}
+
+		err := (&Torrent{}).Read(&dict)
+		if tt.ok && err != nil {
+			t.Fatalf("%q %q: %v", tt.name, tt.path, err)
+		}
+		if !tt.ok && err == nil {
+			t.Fatalf("%q %q: unsafe path read", tt.name, tt.path)
+		}
+	}
+
+	// nothing gets written outside the data directory by adding the torrent either
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	c, err := NewClient(Config{NoListen: true, DataDir: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dict := metainfo("..", 32768, []string{"a", "b"}, []int{1000, 1000})
+	fn := filepath.Join(dir, "evil.torrent")
+	if err := os.WriteFile(fn, bencode.Encode(dict), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AddTorrent(fn); err == nil {
+		t.Fatal("torrent with an unsafe path added")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); err == nil {
+		t.Fatal("file created outside of the data directory")
+	}
+}
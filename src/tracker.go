@@ -1,152 +1,305 @@
 package src
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/marksamman/bencode"
 	"github.com/ritsource/torrent-client/output"
 )
 
-// RequestPeerNum ...
-var RequestPeerNum = 40
+// Events of the announce requests, to let the tracker know about the
+// state of the download (`EventNone` for the regular announces)
+const (
+	EventNone      = ""
+	EventCompleted = "completed"
+	EventStarted   = "started"
+	EventStopped   = "stopped"
+)
 
-// GetPeers returns the peers
-func GetPeers() ([]*Peer, error) {
-	// check protocol
-	switch Torr.Announce.Scheme {
-	case "udp":
-		// sending connection request to UDP server (the announce host) and reading responses
-		connID, tranID, err := ConnReqUDP()
-		if err != nil {
-			return []*Peer{}, err
-		}
+// udpEvents are the UDP tracker protocol (BEP 15) codes of the events
+var udpEvents = map[string]uint32{EventNone: 0, EventCompleted: 1, EventStarted: 2, EventStopped: 3}
 
-		// once connection request is successfule, sending announce request
-		// this will mainly get us a list of seeders for that torrent files
-		return GetPeersUDP(Torr.Announce.String(), connID, tranID)
+// DefaultAnnounceInterval is the time between the regular announces, for
+// trackers that don't tell us (the tracker's `interval` is used otherwise)
+var DefaultAnnounceInterval = 30 * time.Minute
 
-	case "http", "https":
-		// if the announce scheme is http then send a http tracker request
-		return GetPeersHTTP()
+// AnnounceRetryInterval is how long to wait before announcing again, to a tracker that failed
+var AnnounceRetryInterval = 5 * time.Minute
 
-	default:
-		return []*Peer{}, fmt.Errorf("unsupported announce protocol, %v", Torr.Announce.Scheme)
+// AnnounceTimeout caps each round of announces, so an unresponsive tracker doesn't hold up
+// the rest. The trackers that haven't responded by then are retried after `AnnounceRetryInterval`
+var AnnounceTimeout = time.Minute
+
+// trackerState is what we know about a tracker, from it's last response
+type trackerState struct {
+	interval    time.Duration // time between the regular announces, the tracker's `interval`
+	minInterval time.Duration // the tracker doesn't want to be announced to more often than this
+	trackerID   string        // to be sent back to the tracker, in the next announces
+	started     bool          // if the `started` announce got through
+	next        time.Time     // when the next regular announce is due
+}
+
+// tracker returns the state of the tracker (by it's announce url)
+func (t *Torrent) tracker(addr string) *trackerState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.trackers == nil {
+		t.trackers = make(map[string]*trackerState)
+	}
+	st, ok := t.trackers[addr]
+	if !ok {
+		st = &trackerState{}
+		t.trackers[addr] = st
 	}
+	return st
 }
 
 /*
-ConnReqUDP sends a UDP-connection-request to the tracker and returns
-the relevent response data (connection_id and error)
+GetPeers walks through the tiers of trackers in `Torrent.AnnounceList` (BEP 12)
+and sends an announce request with the event to each of them, concurrently (an unresponsive UDP
+tracker can take a long while to give up on). The peers from every reachable
+tracker are merged into a single list (without duplicates), and the new ones are
+handed to `found` (if it's not nil) as soon as each tracker responds, rather than
+once all of them have. Whenever a tracker responds successfully it gets moved to
+the front of it's tier, so the next announce tries it first. If the client has a
+DHT node, the peers found in the DHT are merged in too.
+
+The round is capped at `AnnounceTimeout`, the trackers that haven't responded by
+then are given up on (until their next announce). An error is returned only if
+no peer source responded
 */
-func ConnReqUDP() (uint64, uint32, error) {
-	// building the required packet in connection request
-	packet, err := udpConnPacket(TransactionID)
-	if err != nil {
-		return 0, 0, err
-	}
+func (t *Torrent) GetPeers(ctx context.Context, event string, found func([]*Peer)) ([]*Peer, error) {
+	peers := []*Peer{}            // merged peers from all the trackers
+	seen := make(map[string]bool) // "ip:port" of the peers that are already in `peers`
+
+	merge := func(prs []*Peer) {
+		fresh := []*Peer{}
+		for _, p := range prs {
+			addr := net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			p.Torrent = t
+			fresh = append(fresh, p)
+		}
+		peers = append(peers, fresh...)
 
-	// UDP protocol doesn't esablish any connection between client and server, the
-	// connection doesn't actually represents any actual connection in transition layer
-	conn, err := net.Dial("udp", Torr.Announce.String())
-	if err != nil {
-		return 0, 0, err
+		if found != nil && len(fresh) > 0 {
+			found(fresh)
+		}
 	}
-	defer conn.Close()
 
-	// writing the data to the server (tracker-server)
-	nw, err := conn.Write(packet)
-	if err != nil {
-		return 0, 0, err
+	// the deadline of the round, the parent context is still checked on it's own
+	rctx, cancel := context.WithTimeout(ctx, AnnounceTimeout)
+	defer cancel()
+
+	// looking for peers in the DHT, concurrently with the tracker requests
+	var dhtch chan []*Peer
+	if d := t.client.DHT; d != nil {
+		dhtch = make(chan []*Peer, 1)
+		go func() {
+			prs, err := d.GetPeers(rctx, t.InfoHash, t.client.Config.Port)
+			if err != nil {
+				output.DevWarnf("dht lookup failed, %v\n", err)
+			}
+			dhtch <- prs
+		}()
 	}
 
-	output.DevInfof("written %v bytes as udp connection request\n", nw)
+	lasterr := fmt.Errorf("no trackers to announce to") // error from the last failed tracker
+	reached := false                                    // if any of the trackers responded
 
-	// reading on the connection (waiting for teh server to respond in
-	// actual) for a UDP-connection-response recieved from the server
-	resp := make([]byte, 16)
-	nr, err := bufio.NewReader(conn).Read(resp)
-	if err != nil {
-		return 0, 0, err
+	type result struct {
+		tier  []*url.URL
+		tr    *url.URL
+		peers []*Peer
+		err   error
 	}
 
-	output.DevInfof("read %v bytes as udp connection response\n", nr)
+	ch := make(chan result)
+	n := 0
+	for _, tier := range t.AnnounceList {
+		for _, tr := range tier {
+			n++
+			go func(tier []*url.URL, tr *url.URL) {
+				prs, err := t.GetPeersFrom(rctx, tr, event)
+				ch <- result{tier, tr, prs, err}
+			}(tier, tr)
+		}
+	}
+
+	// the results are handled as they come in, the tiers only get
+	// reordered here, once all the requests are sent
+	for n > 0 || dhtch != nil {
+		select {
+		case r := <-ch:
+			n--
+			if r.err != nil {
+				if ctx.Err() == nil {
+					output.DevWarnf("tracker request failed, %v | %v\n", r.err, r.tr)
+				}
+				lasterr = r.err
+				continue
+			}
+			reached = true
 
-	// the connection response includes data that is required in the announce request
-	// `action` (32-bit integer, value = 0), `transaction_id` (32-bit integer, same value
-	// as in the request), and `connection_id` (64-bit integer, required in announce request)
-	// [0-4] -> action, [4-8] -> transaction_id, [8-16] -> connection_id
+			promoteTracker(r.tier, r.tr)
+			merge(r.peers)
 
-	// if response length is less than 16 bytes, it's not invalid
-	if len(resp) < 16 {
-		return 0, 0, fmt.Errorf("the response length is shorter then 16 bytes")
+		case prs := <-dhtch:
+			dhtch = nil
+			if len(prs) > 0 {
+				reached = true
+			}
+			merge(prs)
+		}
 	}
 
-	// extracting the information from response
-	BE := binary.BigEndian
+	if ctx.Err() != nil {
+		return peers, ctx.Err()
+	}
 
-	// checking if the response (recieved from tracker), has the same `transition_id`
-	// that was in the request, if not then it's not a successful transaction
-	tID := BE.Uint32(resp[4:8])
-	if tID != TransactionID {
-		return 0, 0, fmt.Errorf("the response doesn't have the expected `transaction_id`")
+	if !reached {
+		return peers, fmt.Errorf("none of the trackers responded, %v", lasterr)
 	}
 
-	// returning the `connection_id` which is going
-	// to be required in UDP-accounce-request
-	return BE.Uint64(resp[8:16]), tID, err
+	output.DevInfof("found %v peers\n", len(peers))
+	return peers, nil
 }
 
 /*
-GetPeersUDP sends a UDP announce request to the tracker and extracts
-information about the peers from the response sent back by the tracker
+GetPeersFrom sends an announce request to a single tracker, with the event. The
+time of the next regular announce to the tracker is set according to it's
+`interval` (and `min interval`), or `AnnounceRetryInterval` if it failed. Only
+the `started` announce puts us in the tracker's swarm, as far as `AnnounceStopped`
+is concerned (the ones without an event, sent for the metadata, don't)
 */
-func GetPeersUDP(addr string, connID uint64, tranID uint32) ([]*Peer, error) {
-	// building the required packet in connection request
-	packet, err := udpAnnouncePacket(connID, tranID)
-	if err != nil {
-		return []*Peer{}, err
+func (t *Torrent) GetPeersFrom(ctx context.Context, tr *url.URL, event string) ([]*Peer, error) {
+	prs, err := t.announceTo(ctx, tr, event)
+
+	st := t.tracker(tr.String())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	wait := AnnounceRetryInterval
+	if err == nil {
+		switch event {
+		case EventStarted:
+			st.started = true
+		case EventStopped:
+			st.started = false
+		}
+
+		wait = st.interval
+		if wait <= 0 {
+			wait = DefaultAnnounceInterval
+		}
+	}
+	if wait < st.minInterval {
+		wait = st.minInterval
 	}
+	st.next = time.Now().Add(wait)
 
-	// udp dial (WTF, just because comments are cool)
-	conn, err := net.Dial("udp", addr)
+	return prs, err
+}
+
+// announceTo sends the announce request, over the tracker's protocol
+func (t *Torrent) announceTo(ctx context.Context, tr *url.URL, event string) ([]*Peer, error) {
+	// check protocol
+	switch tr.Scheme {
+	case "udp":
+		// connecting to the UDP tracker (the announce host) and sending
+		// the announce request, to get a list of seeders for the torrent
+		return t.GetPeersUDP(ctx, tr, event)
+
+	case "http", "https":
+		// if the announce scheme is http then send a http tracker request
+		return t.GetPeersHTTP(ctx, tr, event)
+
+	default:
+		return []*Peer{}, fmt.Errorf("unsupported announce protocol, %v", tr.Scheme)
+	}
+}
+
+/*
+AnnounceStopped lets the trackers know that we are leaving the swarm, so they stop
+handing out our address. It's sent to every tracker that the `started` announce
+got through to
+*/
+func (t *Torrent) AnnounceStopped(ctx context.Context) {
+	for _, tier := range t.AnnounceList {
+		for _, tr := range tier {
+			st := t.tracker(tr.String())
+			t.mu.Lock()
+			started := st.started
+			t.mu.Unlock()
+
+			if !started {
+				continue
+			}
+			if _, err := t.GetPeersFrom(ctx, tr, EventStopped); err != nil {
+				output.DevWarnf("stopped announce failed, %v | %v\n", err, tr)
+			}
+		}
+	}
+}
+
+// promoteTracker moves the tracker to the front of the tier
+func promoteTracker(tier []*url.URL, tr *url.URL) {
+	for i, u := range tier {
+		if u == tr {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = tr
+			return
+		}
+	}
+}
+
+/*
+GetPeersUDP sends a UDP announce request to the tracker (see `udpRequest`) and
+extracts information about the peers from the response sent back by the tracker.
+When the tracker is reached over IPv6, it responds with IPv6 peers (BEP 15)
+*/
+func (t *Torrent) GetPeersUDP(ctx context.Context, tr *url.URL, event string) ([]*Peer, error) {
+	// the host of the announce url, the path (usually `/announce`) isn't used
+	raddr, err := resolveUDPAddr(ctx, tr.Host)
 	if err != nil {
 		return []*Peer{}, err
 	}
-	defer conn.Close()
+	ipv6 := raddr.IP.To4() == nil
 
-	// writing to data to the udp server
-	nw, err := conn.Write(packet)
+	// building the announce request, after the connection id, action and transaction id
+	body, err := t.udpAnnouncePacket(event, ipv6)
 	if err != nil {
 		return []*Peer{}, err
 	}
-	output.DevInfof("written %v bytes to as udp announce request\n", nw)
 
-	// reading tracker response
-	resp := make([]byte, 20+RequestPeerNum*6) // 20 + `RequestPeerNum` * 6 is the largest possible value for response (cause `RequestPeerNum` is finite)
-	nr, err := bufio.NewReader(conn).Read(resp)
+	resp, err := udpRequest(ctx, raddr.String(), udpActionAnnounce, body)
 	if err != nil {
 		return []*Peer{}, err
 	}
 
-	output.DevInfof("read %v bytes as udp announce response\n", nr)
-	resp = resp[:nr] // skipping rest of the bytes, only populated ones contains all the data
+	output.DevInfof("read %v bytes as udp announce response\n", len(resp))
 
 	// if len(resp) < 20, somethings wrong with the response
 	if len(resp) < 20 {
-		output.DevInfof("the announce response length is shorter than 20 bytes")
-		return []*Peer{}, err
+		return []*Peer{}, fmt.Errorf("the announce response length is shorter than 20 bytes")
 	}
 
 	// response packet structure
-	// 0-4 -> 32-bit integer -> action -> 1 (announce), not needed now
-	// 4-8 -> 32-bit integer -> transaction_id
+	// 0-4 -> 32-bit integer -> action -> 1 (announce), checked by `udpRequest`
+	// 4-8 -> 32-bit integer -> transaction_id, checked by `udpRequest`
 	// 8-12 -> 32-bit integer -> interval (new announce req can not be made until interval seconds have passed)
 	// 12-16 -> 32-bit integer -> leechers
 	// 16-20 -> 32-bit integer -> number of seeders
@@ -155,105 +308,77 @@ func GetPeersUDP(addr string, connID uint64, tranID uint32) ([]*Peer, error) {
 	// to extract data from response, the response is formatted like,
 	BE := binary.BigEndian
 
-	// checking if the response (recieved from tracker), has the same `transition_id`
-	// that was in the request, if not then it's not a successful transaction
-	if BE.Uint32(resp[4:8]) != TransactionID {
-		return []*Peer{}, fmt.Errorf("the response doesn't have the expected `transaction_id`")
-	}
+	// the time to wait before the next regular announce, in seconds
+	st := t.tracker(tr.String())
+	t.mu.Lock()
+	st.interval = time.Duration(BE.Uint32(resp[8:12])) * time.Second
+	t.mu.Unlock()
 
-	// interval := BE.Uint32(resp[8:12])
 	// leechers := BE.Uint32(resp[12:16])
 	// numseed := BE.Uint32(resp[16:20])
 	// output.DevInfof("number of seeders found = %v *****\n", numseed)
 
 	// [After 20-bytes] - the rest contains peer (seeder) information, 6 bytes for each peer
-	// first 4 bytes are IP address and last 2 bytes are port. Reading the peer info,
-	// more about it http://www.bittorrent.org/beps/bep_0015.html
-
-	// holds all the peer pointers
-	peers := []*Peer{}
-
-	i := 20 // i = 21st byte
-
-	// reading the data after 20-bytes, and extracting information about other peers
-	// maximux needed peers <= 12
-	for {
-		if i >= len(resp) || i >= RequestPeerNum*6 {
-			break
-		}
-
-		peers = append(peers, &Peer{IP: net.IP(resp[i : i+4]), Port: binary.BigEndian.Uint16(resp[i+4 : i+6])})
-
-		i += 6
+	// first 4 bytes are IP address and last 2 bytes are port (18 bytes over IPv6, with 16-byte
+	// IP addresses). Reading the peer info, more about it http://www.bittorrent.org/beps/bep_0015.html
+	// all of them are read, the tracker may send more than `numwant`
+	var peers []*Peer
+	if ipv6 {
+		peers = parseCompactPeers6(resp[20:])
+	} else {
+		peers = parseCompactPeers(resp[20:])
 	}
 
-	// returning the extracted information about peers
-	return peers, err
-}
-
-/*
-udpConnPacket builds and returns data required to be sent
-in the packet for UDP-connection-request to the tracker
-
-Packet structure looks like,
-[0-8] -> `protocol_id` -> a `protocol_id` (0x41727101980, 64-bit integer, magic constant)
-[8-12] -> `action` -> corrosponds to the action, value = 0 indicates a connection request (32-bit integer)
-[12-16] -> `transaction_id` -> a `transaction_id`, client identifier (32-bit integer)
-*/
-func udpConnPacket(tranID uint32) ([]byte, error) {
-	// el holds the contents of the packet
-	var el = []interface{}{uint64(0x41727101980), uint32(0), uint32(tranID)}
-
-	// building the connection request packet buffer
-	buf := new(bytes.Buffer)
-
-	// writing the data into the buffer
-	for _, v := range el {
-		err := binary.Write(buf, binary.BigEndian, v)
-		if err != nil {
-			output.DevErrorf("buffer write failed for UDP connection request\n")
-			return []byte{}, err
-		}
+	for _, p := range peers {
+		p.Torrent = t
 	}
 
-	return buf.Bytes(), nil
+	// returning the extracted information about peers
+	return peers, nil
 }
 
 /*
-udpAnnouncePacket builds and returns data required to be
-sent in the packet for UDP-announce-request to the tracker
+udpAnnouncePacket builds and returns data required to be sent in the packet for
+UDP-announce-request to the tracker, the connection id, action and transaction
+id (first 16 bytes) are added by `udpRequest`. Over IPv6 the IP address field
+is left 0, as an IPv6 address doesn't fit in it (BEP 15)
 
 Packet structure looks like,
 [0-8] -> `connection_id` -> `connection_id` recieved from UDP-connection-response (64-Bit integer)
 [8-12] -> `action` ->  1, represents announce request (32-Bit integer)
-[12-16] -> `transaction_id` ->  `transaction_id` from UDP-connection-response (32-Bit integer)
+[12-16] -> `transaction_id` ->  a fresh `transaction_id`, for each request (32-Bit integer)
 [16-36] -> `info_hash` -> sha1 hash of encoded (bencode) info_hash property of torr metadata (20-bytes long)
 [36-56] -> `peer_id` -> used as a unique ID for the client, generated by the client at startup (20-bytes long)
-[56-64] -> `downloaded` -> how much has been downloaded (value will be 0, at start) (64-Bit integer)
+[56-64] -> `downloaded` -> how much has been downloaded (since the `started` announce) (64-Bit integer)
 [64-72] -> `left` -> how many bytes are yet to be downloaded (64-Bit integer)
 [72-80] -> `uploaded` -> how much has been uploaded (64-Bit integer)
-[80-84] -> `event` -> 2 (0: none; 1: completed; 2: started; 3: stopped) (32-Bit integer)
+[80-84] -> `event` -> 0: none; 1: completed; 2: started; 3: stopped (32-Bit integer)
 [84-88] -> `IP` -> client's ip address (32-Bit integer)
 [88-92] -> `key` -> for identification (optional) (32-Bit integer)
 [92-96] -> `num_want` -> -1 is default (number of peers that the client would like to receive) (32-Bit integer)
 [96-98] -> `port` -> port that the client is listening on (typically 6881-6889 (32-Bit integer)
 */
-func udpAnnouncePacket(connID uint64, tranID uint32) ([]byte, error) {
+func (t *Torrent) udpAnnouncePacket(event string, ipv6 bool) ([]byte, error) {
+	cfg := t.client.Config
+
+	// the IP address is optional, 0 lets the tracker use the sender's address
+	ip := uint32(0)
+	if ip4 := cfg.IP.To4(); ip4 != nil && !ipv6 {
+		ip = binary.BigEndian.Uint32(ip4)
+	}
+
 	// `el` temporarily holds the data in an array
 	var el = []interface{}{
-		connID,
-		uint32(1),
-		tranID,
-		Torr.InfoHash,
-		PeerID,
-		uint64(0),
-		uint64(Torr.Size),
-		uint64(0),
-		uint32(2),
-		ClientIP,
+		t.InfoHash,
+		[]byte(t.client.PeerID),
+		uint64(atomic.LoadInt64(&t.DownloadedBytes)),
+		uint64(t.Left()),
+		uint64(atomic.LoadInt64(&t.Uploaded)),
+		udpEvents[event],
+		ip,
 		uint32(0),
-		uint32(RequestPeerNum),
-		ClientPort,
+		uint32(cfg.NumWant),
+		cfg.Port,
 	}
 
 	// writing the data to a buffer, to be send in the request
@@ -270,37 +395,111 @@ func udpAnnouncePacket(connID uint64, tranID uint32) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+/*
+parsePeerDicts decodes the non-compact peer list of a HTTP tracker response, a list
+of dictionaries with `ip`, `port` and `peer id` (optional) in each. The `ip` can be an
+IPv4 or IPv6 address, or a hostname, then the first of it's addresses is used. The
+invalid entries, and the hostnames that can't be resolved, are skipped
+*/
+func parsePeerDicts(ctx context.Context, list []interface{}) []*Peer {
+	peers := []*Peer{}
+
+	for _, v := range list {
+		d, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		host, _ := d["ip"].(string)
+		port, _ := d["port"].(int64)
+		if host == "" || port <= 0 || port > 65535 {
+			continue
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil || len(addrs) == 0 {
+				output.DevWarnf("couldn't resolve peer address, %v | %v\n", err, host)
+				continue
+			}
+			ip = addrs[0].IP
+		}
+
+		p := &Peer{IP: ip, Port: uint16(port)}
+		if id, ok := d["peer id"].(string); ok && len(id) == 20 {
+			p.ID = []byte(id)
+		}
+
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
 /*
 GetPeersHTTP sends a HTTP announce request to the tracker
 and gets information about other peers
 */
-func GetPeersHTTP() ([]*Peer, error) {
-	// trkurl is the address for sending the announce request
-	trkurl := Torr.Announce
+func (t *Torrent) GetPeersHTTP(ctx context.Context, tr *url.URL, event string) ([]*Peer, error) {
+	cfg := t.client.Config
+
+	// trkurl is the address for sending the announce request (a copy,
+	// so the query doesn't get written on the tracker url itself)
+	trkurl := *tr
 
 	// to populate the URL query values with required properties,
 	// torrent identifier, client information, the data we want
 	// to download and number of peers we want
 	pr := url.Values{}
 
-	pr.Add("info_hash", string(Torr.InfoHash))      // torrent info_hash, sha1 hash of encoded (bencode) info_hash property of torr metadata
-	pr.Add("peer_id", PeerID)                       // peer_id, unique identifier for each download
-	pr.Add("port", strconv.Itoa(int(ClientPort)))   // post that out client is listening on for sharing data
-	pr.Add("ip", ClientIP.String())                 // ip address of the local machine
-	pr.Add("uploaded", "0")                         // how much data has been uploaded
-	pr.Add("downloaded", "0")                       // how much data has been downloaded
-	pr.Add("left", strconv.Itoa(Torr.Size))         // how much data is left to be downloaded
+	// total bytes uploaded to and downloaded from other peers, so far
+	upl := strconv.FormatInt(atomic.LoadInt64(&t.Uploaded), 10)
+	dnl := strconv.FormatInt(atomic.LoadInt64(&t.DownloadedBytes), 10)
+
+	pr.Add("info_hash", string(t.InfoHash))         // torrent info_hash, sha1 hash of encoded (bencode) info_hash property of torr metadata
+	pr.Add("peer_id", t.client.PeerID)              // peer_id, unique identifier for each download
+	pr.Add("port", strconv.Itoa(int(cfg.Port)))     // post that out client is listening on for sharing data
+	pr.Add("uploaded", upl)                         // how much data has been uploaded
+	pr.Add("downloaded", dnl)                       // how much data has been downloaded
+	pr.Add("left", strconv.FormatInt(t.Left(), 10)) // how much data is left to be downloaded
 	pr.Add("compact", "1")                          // 1
-	pr.Add("event", "started")                      // what event this announce request is for
-	pr.Add("numwant", strconv.Itoa(RequestPeerNum)) //  number of peers we want the server to send back
+	pr.Add("numwant", strconv.Itoa(cfg.NumWant))    //  number of peers we want the server to send back
+
+	// what event this announce request is for, left out for the regular announces
+	if event != EventNone {
+		pr.Add("event", event)
+	}
+
+	// the tracker id, if the tracker has sent us one before
+	st := t.tracker(tr.String())
+	t.mu.Lock()
+	if st.trackerID != "" {
+		pr.Add("trackerid", st.trackerID)
+	}
+	t.mu.Unlock()
+
+	// ip address of the local machine, the tracker sees it anyway (optional), and
+	// our IPv6 address (BEP 7), for the tracker to hand it out to IPv6 peers too
+	if cfg.IP != nil {
+		pr.Add("ip", cfg.IP.String())
+	}
+	if cfg.IPv6 != nil {
+		pr.Add("ipv6", cfg.IPv6.String())
+	}
 
 	trkurl.RawQuery = pr.Encode()
 
 	// sending the announce request to `trkurl`
-	resp, err := http.Get(trkurl.String())
+	req, err := http.NewRequest("GET", trkurl.String(), nil)
 	if err != nil {
 		return []*Peer{}, err
 	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+
+		return []*Peer{}, err
+	}
 	defer resp.Body.Close()
 
 	// checking if request failed
@@ -325,29 +524,38 @@ func GetPeersHTTP() ([]*Peer, error) {
 		output.DevWarnf("%v\n", v)
 	}
 
+	// the time to wait before the next announces (in seconds), and the
+	// tracker id that's to be sent back in them (if it's there)
+	t.mu.Lock()
+	if v, ok := data["interval"].(int64); ok {
+		st.interval = time.Duration(v) * time.Second
+	}
+	if v, ok := data["min interval"].(int64); ok {
+		st.minInterval = time.Duration(v) * time.Second
+	}
+	if v, ok := data["tracker id"].(string); ok {
+		st.trackerID = v
+	}
+	t.mu.Unlock()
+
 	// to hold pointers to peers
 	peers := []*Peer{}
 
-	// reading information about peers
-	if str, ok := data["peers"].(string); ok {
-		d := []byte(str)
-
-		i := 0
-		for {
-			// max number of peers 12
-			if i >= len(d) || i >= RequestPeerNum*6 {
-				break
-			}
-
-			p := Peer{
-				IP:   net.IP(d[i : i+4]),
-				Port: binary.BigEndian.Uint16(d[i+4 : i+6]),
-			}
-
-			peers = append(peers, &p)
+	// reading information about peers, 6 bytes for each peer in `peers` (4-byte IP
+	// address + 2-byte port), and 18 bytes for each IPv6 peer in `peers6` (BEP 7)
+	switch v := data["peers"].(type) {
+	case string:
+		peers = append(peers, parseCompactPeers([]byte(v))...)
+	case []interface{}:
+		// the non-compact form, trackers might ignore `compact=1`
+		peers = append(peers, parsePeerDicts(ctx, v)...)
+	}
+	if str, ok := data["peers6"].(string); ok {
+		peers = append(peers, parseCompactPeers6([]byte(str))...)
+	}
 
-			i += 6
-		}
+	for _, p := range peers {
+		p.Torrent = t
 	}
 
 	return peers, err
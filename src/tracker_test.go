@@ -0,0 +1,110 @@
+package src
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+func TestGetPeersSlowTracker(t *testing.T) {
+	timeout := AnnounceTimeout
+	defer func() { AnnounceTimeout = timeout }()
+	AnnounceTimeout = 500 * time.Millisecond
+
+	// a tracker that never responds, and one that sends back 127.0.0.1:7001
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	live, _ := udpTracker(t, []byte{127, 0, 0, 1, 0x1b, 0x59})
+
+	tr := &Torrent{
+		InfoHash: make([]byte, 20),
+		client:   &Client{Config: Config{Port: 6881, NumWant: 40}, PeerID: GenPeerID()},
+		AnnounceList: [][]*url.URL{
+			{{Scheme: "udp", Host: dead.LocalAddr().String()}},
+			{{Scheme: "udp", Host: live}},
+		},
+	}
+
+	// the peers have to be handed over as soon as the live tracker responds,
+	// not once the dead one is given up on
+	start := time.Now()
+	var handed time.Duration
+	peers, err := tr.GetPeers(context.Background(), EventStarted, func(prs []*Peer) {
+		if hasPeer(prs, 7001) {
+			handed = time.Since(start)
+		}
+	})
+	el := time.Since(start)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasPeer(peers, 7001) {
+		t.Fatalf("peer not found, %v peers", len(peers))
+	}
+	if handed == 0 || handed > AnnounceTimeout/2 {
+		t.Fatalf("peers handed over after %v", handed)
+	}
+	if el < AnnounceTimeout || el > 2*AnnounceTimeout {
+		t.Fatalf("round took %v, capped at %v", el, AnnounceTimeout)
+	}
+}
+
+func TestMagnetAnnounce(t *testing.T) {
+	// an HTTP tracker that records the queries of the announces
+	queries := make(chan url.Values, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write(bencode.Encode(map[string]interface{}{"interval": int64(1800), "peers": ""}))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &Torrent{
+		InfoHash:     make([]byte, 20),
+		client:       &Client{Config: Config{Port: 6881, NumWant: 40}, PeerID: GenPeerID()},
+		AnnounceList: [][]*url.URL{{u}},
+	}
+
+	// the metadata hasn't arrived, we're neither a seeder nor in the swarm yet
+	if _, err := tr.GetPeers(context.Background(), EventNone, nil); err != nil {
+		t.Fatal(err)
+	}
+	q := <-queries
+	if q.Get("left") == "0" || q.Get("left") == "" {
+		t.Fatalf("left=%q before the metadata", q.Get("left"))
+	}
+	if q.Has("event") {
+		t.Fatalf("event=%v before the download started", q.Get("event"))
+	}
+
+	// so there's nothing to leave either
+	tr.AnnounceStopped(context.Background())
+	if len(queries) != 0 {
+		t.Fatalf("stopped sent, event=%v", (<-queries).Get("event"))
+	}
+
+	// once the download starts
+	if _, err := tr.GetPeers(context.Background(), EventStarted, nil); err != nil {
+		t.Fatal(err)
+	}
+	if q := <-queries; q.Get("event") != EventStarted {
+		t.Fatalf("event=%v, want %v", q.Get("event"), EventStarted)
+	}
+	tr.AnnounceStopped(context.Background())
+	if q := <-queries; q.Get("event") != EventStopped {
+		t.Fatalf("event=%v, want %v", q.Get("event"), EventStopped)
+	}
+}
@@ -0,0 +1,221 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+// UDP tracker protocol (BEP 15) actions
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+// udpProtocolID is the magic constant, sent in place of the connection id in the connection request
+const udpProtocolID uint64 = 0x41727101980
+
+// UDPTrackerTimeout is how long to wait for the first response of a UDP tracker, the
+// timeout doubles with every retransmission, 15 * 2 ^ n seconds (BEP 15)
+var UDPTrackerTimeout = 15 * time.Second
+
+/*
+UDPTrackerRetries is the number of retransmissions (`n` goes up to it), before giving up on
+a UDP tracker. BEP 15 goes up to n = 8, but the announces are capped at `AnnounceTimeout`
+(a minute), which only leaves room for a single retransmission (15 + 30 seconds). The
+tracker gets announced to again after `AnnounceRetryInterval` instead, so the rest of
+the retransmissions would never be sent anyway
+*/
+var UDPTrackerRetries = 1
+
+// UDPConnIDLifetime is how long a connection id can be used for, after it has been received
+var UDPConnIDLifetime = time.Minute
+
+// errUDPTimeout is returned when a UDP tracker doesn't respond in time (to a single transmission)
+var errUDPTimeout = errors.New("udp tracker request timed out")
+
+// udpConnIDs caches the connection ids of the UDP trackers (by `host:port`), they
+// are shared by all the torrents, as the id belongs to our address
+var udpConnIDs = struct {
+	sync.Mutex
+	m map[string]udpConnID
+}{m: make(map[string]udpConnID)}
+
+// udpConnID is a connection id, and when it was received
+type udpConnID struct {
+	id uint64
+	at time.Time
+}
+
+/*
+resolveUDPAddr resolves the `host:port` of a UDP tracker, the first of the addresses
+is used (the resolver puts the IPv6 addresses first, if we have IPv6 connectivity)
+*/
+func resolveUDPAddr(ctx context.Context, hostport string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for the tracker, %v", host)
+	}
+
+	pn, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.UDPAddr{IP: ips[0].IP, Port: pn, Zone: ips[0].Zone}, nil
+}
+
+// cachedConnID returns the connection id of the tracker, if there's one that hasn't expired yet
+func cachedConnID(addr string) (uint64, bool) {
+	udpConnIDs.Lock()
+	defer udpConnIDs.Unlock()
+
+	c, ok := udpConnIDs.m[addr]
+	if !ok || time.Since(c.at) >= UDPConnIDLifetime {
+		return 0, false
+	}
+	return c.id, true
+}
+
+// cacheConnID stores the connection id of the tracker, or forgets it (`ok` false)
+func cacheConnID(addr string, id uint64, ok bool) {
+	udpConnIDs.Lock()
+	defer udpConnIDs.Unlock()
+
+	if !ok {
+		delete(udpConnIDs.m, addr)
+		return
+	}
+	udpConnIDs.m[addr] = udpConnID{id: id, at: time.Now()}
+}
+
+/*
+udpRequest sends a request to the UDP tracker at `addr` (`host:port`), and returns the
+response. The connection id is requested first, unless there's a cached one that's less
+than `UDPConnIDLifetime` old. Each transmission gets a fresh transaction id, and if the
+tracker doesn't respond within 15 * 2 ^ n seconds, it's retransmitted, up to n = 1 (see
+`UDPTrackerTimeout` and `UDPTrackerRetries`), or until the context runs out. An error response (action 3) is returned
+as an error, with the tracker's message
+
+`body` is the part of the request after the 16 bytes of connection id, action and
+transaction id, the response is returned as a whole, action and transaction id included
+*/
+func udpRequest(ctx context.Context, addr string, action uint32, body []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+
+	for n := 0; n <= UDPTrackerRetries; n++ {
+		timeout := UDPTrackerTimeout << uint(n)
+
+		// connecting, unless the last connection id is still valid
+		connID, ok := cachedConnID(addr)
+		if !ok {
+			resp, err := udpTransmit(conn, udpProtocolID, udpActionConnect, nil, timeout)
+			if err == errUDPTimeout && ctx.Err() == nil {
+				output.DevInfof("udp connection request timed out, retransmitting (n=%v) | %v\n", n+1, addr)
+				continue
+			}
+			if err != nil {
+				return nil, udpError(ctx, err)
+			}
+			if len(resp) < 16 {
+				return nil, fmt.Errorf("the connection response length is shorter then 16 bytes")
+			}
+
+			connID = binary.BigEndian.Uint64(resp[8:16])
+			cacheConnID(addr, connID, true)
+		}
+
+		resp, err := udpTransmit(conn, connID, action, body, timeout)
+		if err == errUDPTimeout && ctx.Err() == nil {
+			output.DevInfof("udp tracker request timed out, retransmitting (n=%v) | %v\n", n+1, addr)
+			continue
+		}
+		if err != nil {
+			// the tracker might not recognize the connection id anymore
+			cacheConnID(addr, 0, false)
+			return nil, udpError(ctx, err)
+		}
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("udp tracker didn't respond, after %v retransmissions", UDPTrackerRetries)
+}
+
+// udpError returns the context's error, if the request failed because the context got cancelled
+func udpError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+/*
+udpTransmit writes a single request on the connection, with a fresh transaction id,
+and reads datagrams until the response with the same transaction id arrives (the late
+responses to earlier transmissions are skipped), or the timeout runs out
+*/
+func udpTransmit(conn net.Conn, connID uint64, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	tranID := rand.Uint32()
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, connID)
+	binary.Write(buf, binary.BigEndian, action)
+	binary.Write(buf, binary.BigEndian, tranID)
+	buf.Write(body)
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	// large enough for any datagram, so the response never gets truncated
+	resp := make([]byte, 65536)
+
+	for {
+		nr, err := conn.Read(resp)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, errUDPTimeout
+			}
+			return nil, err
+		}
+
+		if nr < 8 || binary.BigEndian.Uint32(resp[4:8]) != tranID {
+			continue
+		}
+
+		switch act := binary.BigEndian.Uint32(resp[0:4]); act {
+		case action:
+			return resp[:nr], nil
+		case udpActionError:
+			return nil, fmt.Errorf("udp tracker error, %s", resp[8:nr])
+		default:
+			return nil, fmt.Errorf("unexpected action in the udp tracker response, %v", act)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package src
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// udpPacket is a request received by `fakeUDPTracker`, and when it arrived
+type udpPacket struct {
+	connID uint64
+	action uint32
+	tranID uint32
+	at     time.Time
+}
+
+/*
+fakeUDPTracker starts a UDP tracker on loopback, each request goes through `handle`
+which returns the action and the body of the response (after the transaction id),
+or false to drop the request. The requests received are recorded, `packets` returns
+them. The connection id handed out is 7
+*/
+func fakeUDPTracker(t *testing.T, handle func(n int, pkt udpPacket) (uint32, []byte, bool)) (string, func() []udpPacket) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var mu sync.Mutex
+	var pkts []udpPacket
+
+	go func() {
+		BE := binary.BigEndian
+		b := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+
+			pkt := udpPacket{BE.Uint64(b[0:8]), BE.Uint32(b[8:12]), BE.Uint32(b[12:16]), time.Now()}
+			mu.Lock()
+			pkts = append(pkts, pkt)
+			i := len(pkts) - 1
+			mu.Unlock()
+
+			action, body, ok := handle(i, pkt)
+			if !ok {
+				continue
+			}
+			resp := make([]byte, 8)
+			BE.PutUint32(resp[0:4], action)
+			BE.PutUint32(resp[4:8], pkt.tranID)
+			conn.WriteToUDP(append(resp, body...), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() []udpPacket {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]udpPacket{}, pkts...)
+	}
+}
+
+// answerUDP answers the connection requests with the connection id 7, and the rest with an empty body
+func answerUDP(n int, pkt udpPacket) (uint32, []byte, bool) {
+	if pkt.action == udpActionConnect {
+		return udpActionConnect, []byte{0, 0, 0, 0, 0, 0, 0, 7}, true
+	}
+	return pkt.action, nil, true
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	timeout, retries := UDPTrackerTimeout, UDPTrackerRetries
+	defer func() { UDPTrackerTimeout, UDPTrackerRetries = timeout, retries }()
+	UDPTrackerTimeout = 100 * time.Millisecond
+	UDPTrackerRetries = 3
+
+	// the first two connection requests get lost
+	addr, packets := fakeUDPTracker(t, func(n int, pkt udpPacket) (uint32, []byte, bool) {
+		if n < 2 {
+			return 0, nil, false
+		}
+		return answerUDP(n, pkt)
+	})
+
+	if _, err := udpRequest(context.Background(), addr, udpActionAnnounce, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pkts := packets()
+	if len(pkts) != 4 {
+		t.Fatalf("%v requests, want 3 connection requests and an announce", len(pkts))
+	}
+
+	// each retransmission waits twice as long as the one before, 15 * 2 ^ n
+	// seconds (scaled down), and gets a fresh transaction id
+	for i := 1; i < 3; i++ {
+		want := UDPTrackerTimeout << uint(i-1)
+		if gap := pkts[i].at.Sub(pkts[i-1].at); gap < want || gap > 2*want {
+			t.Errorf("retransmission %v after %v, want %v", i, gap, want)
+		}
+		if pkts[i].action != udpActionConnect || pkts[i].connID != udpProtocolID {
+			t.Errorf("retransmission %v isn't a connection request", i)
+		}
+		if pkts[i].tranID == pkts[i-1].tranID {
+			t.Errorf("retransmission %v reuses the transaction id", i)
+		}
+	}
+	if pkts[3].action != udpActionAnnounce || pkts[3].connID != 7 {
+		t.Errorf("action %v with connection id %v, want an announce with 7", pkts[3].action, pkts[3].connID)
+	}
+}
+
+func TestUDPRetransmitGiveUp(t *testing.T) {
+	timeout, retries := UDPTrackerTimeout, UDPTrackerRetries
+	defer func() { UDPTrackerTimeout, UDPTrackerRetries = timeout, retries }()
+	UDPTrackerTimeout = 50 * time.Millisecond
+	UDPTrackerRetries = 2
+
+	addr, packets := fakeUDPTracker(t, func(int, udpPacket) (uint32, []byte, bool) { return 0, nil, false })
+
+	// 50 + 100 + 200 milliseconds
+	start := time.Now()
+	_, err := udpRequest(context.Background(), addr, udpActionAnnounce, nil)
+	el := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), "didn't respond") {
+		t.Fatalf("error %v, want the tracker to be given up on", err)
+	}
+	if n := len(packets()); n != UDPTrackerRetries+1 {
+		t.Fatalf("%v transmissions, want %v", n, UDPTrackerRetries+1)
+	}
+	if el < 350*time.Millisecond || el > time.Second {
+		t.Fatalf("given up on after %v", el)
+	}
+}
+
+func TestUDPConnIDReuse(t *testing.T) {
+	lifetime := UDPConnIDLifetime
+	defer func() { UDPConnIDLifetime = lifetime }()
+
+	fail := false
+	var mu sync.Mutex
+	addr, packets := fakeUDPTracker(t, func(n int, pkt udpPacket) (uint32, []byte, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail && pkt.action != udpActionConnect {
+			return udpActionError, []byte("unknown connection id"), true
+		}
+		return answerUDP(n, pkt)
+	})
+
+	// counts the connection requests, and checks that the rest use the id handed out
+	connects := func() int {
+		n := 0
+		for _, pkt := range packets() {
+			if pkt.action == udpActionConnect {
+				n++
+			} else if pkt.connID != 7 {
+				t.Fatalf("request with connection id %v, want 7", pkt.connID)
+			}
+		}
+		return n
+	}
+	request := func() error {
+		_, err := udpRequest(context.Background(), addr, udpActionAnnounce, nil)
+		return err
+	}
+
+	// the id is reused, as long as it hasn't expired
+	for i := 0; i < 3; i++ {
+		if err := request(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := connects(); n != 1 {
+		t.Fatalf("%v connection requests for 3 announces, want 1", n)
+	}
+
+	// an expired one isn't
+	UDPConnIDLifetime = 50 * time.Millisecond
+	time.Sleep(100 * time.Millisecond)
+	if err := request(); err != nil {
+		t.Fatal(err)
+	}
+	if n := connects(); n != 2 {
+		t.Fatalf("%v connection requests after the id expired, want 2", n)
+	}
+	UDPConnIDLifetime = lifetime
+
+	// neither is one that the tracker rejected
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	if err := request(); err == nil || !strings.Contains(err.Error(), "unknown connection id") {
+		t.Fatalf("error %v, want the tracker's", err)
+	}
+	if _, ok := cachedConnID(addr); ok {
+		t.Fatal("the connection id is still cached, after an error")
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if err := request(); err != nil {
+		t.Fatal(err)
+	}
+	if n := connects(); n != 3 {
+		t.Fatalf("%v connection requests after an error, want 3", n)
+	}
+}
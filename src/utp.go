@@ -0,0 +1,1076 @@
+package src
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ritsource/torrent-client/output"
+)
+
+// uTP packet types (BEP 29)
+const (
+	utpData  = 0 // carries the payload
+	utpFin   = 1 // the last packet of the connection
+	utpState = 2 // just an ack, doesn't take a sequence number
+	utpReset = 3 // terminates the connection, no matter the state
+	utpSyn   = 4 // opens a connection
+)
+
+// utpVersion is the only uTP version there is
+const utpVersion = 1
+
+// utpHeaderLen is the length of the header, without the extensions
+const utpHeaderLen = 20
+
+// states of a uTP connection
+const (
+	utpSynSent   = iota // waiting for the `ST_STATE` answering our SYN
+	utpConnected        // both ways open
+	utpFinSent          // closed on our side, the FIN might not be acked yet
+)
+
+// UTPPacketSize is the largest payload of a uTP packet, small enough for the
+// datagrams to fit in the MTU of most links (tunnels included)
+var UTPPacketSize = 1200
+
+// UTPTargetDelay is the queuing delay that LEDBAT aims for, the window shrinks when
+// the delay goes over it (the link is getting busy) and grows when it's under it
+var UTPTargetDelay = 100 * time.Millisecond
+
+// UTPMaxWindowIncrease is the most that the congestion window grows by in a round trip, in bytes
+var UTPMaxWindowIncrease = 3000
+
+// UTPRecvWindow is the most data (in bytes) that we buffer for a connection, before it gets read
+var UTPRecvWindow = 1 << 20
+
+// UTPMaxRetries is the number of times in a row that a packet is sent again, before the
+// connection is given up on. The retransmission timeout doubles each time
+var UTPMaxRetries = 6
+
+// UTPSynRetries is the number of times that a SYN is sent again, a peer that doesn't answer
+// the first few isn't worth waiting for (we can still try TCP)
+var UTPSynRetries = 2
+
+// UTPHeadStart is how long a uTP connection attempt goes on alone, before a TCP one is started too
+var UTPHeadStart = 500 * time.Millisecond
+
+// utpMinRTO is the shortest retransmission timeout
+const utpMinRTO = 500 * time.Millisecond
+
+// utpTick is how often the connections get checked for packets to be sent again
+const utpTick = 100 * time.Millisecond
+
+// utpBacklog is the number of incoming connections, waiting to be accepted
+const utpBacklog = 32
+
+// utpMaxOutOfOrder is how far ahead of the last in-order packet we buffer the packets
+const utpMaxOutOfOrder = 1024
+
+var (
+	errUTPHeader  = errors.New("invalid utp packet")
+	errUTPReset   = errors.New("utp connection reset by peer")
+	errUTPTimeout = errors.New("utp connection timed out")
+)
+
+/*
+utpHeader is the header of a uTP packet, 20 bytes (big endian) followed by the extensions,
+
+	type (4 bits) | version (4 bits) | extension (8 bits) | connection_id (16 bits)
+	timestamp_microseconds (32 bits)
+	timestamp_difference_microseconds (32 bits)
+	wnd_size (32 bits)
+	seq_nr (16 bits) | ack_nr (16 bits)
+
+we don't send any extensions (no selective acks), the ones we receive are skipped
+*/
+type utpHeader struct {
+	typ    uint8
+	id     uint16 // connection id
+	ts     uint32 // when the packet was sent, in microseconds
+	tsDiff uint32 // our clock, minus the timestamp of the last packet we've received
+	wnd    uint32 // bytes that the sender has room for in it's receive buffer
+	seq    uint16
+	ack    uint16 // seq_nr of the last packet that the sender has received in order
+}
+
+// bytes encodes the header, followed by the payload
+func (h *utpHeader) bytes(payload []byte) []byte {
+	b := make([]byte, utpHeaderLen+len(payload))
+	b[0] = h.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(b[2:4], h.id)
+	binary.BigEndian.PutUint32(b[4:8], h.ts)
+	binary.BigEndian.PutUint32(b[8:12], h.tsDiff)
+	binary.BigEndian.PutUint32(b[12:16], h.wnd)
+	binary.BigEndian.PutUint16(b[16:18], h.seq)
+	binary.BigEndian.PutUint16(b[18:20], h.ack)
+	copy(b[utpHeaderLen:], payload)
+	return b
+}
+
+// parseUTP reads the header of a packet, and returns the payload after the extensions
+func parseUTP(b []byte) (*utpHeader, []byte, error) {
+	if len(b) < utpHeaderLen || b[0]&0x0f != utpVersion || b[0]>>4 > utpSyn {
+		return nil, nil, errUTPHeader
+	}
+
+	h := &utpHeader{
+		typ:    b[0] >> 4,
+		id:     binary.BigEndian.Uint16(b[2:4]),
+		ts:     binary.BigEndian.Uint32(b[4:8]),
+		tsDiff: binary.BigEndian.Uint32(b[8:12]),
+		wnd:    binary.BigEndian.Uint32(b[12:16]),
+		seq:    binary.BigEndian.Uint16(b[16:18]),
+		ack:    binary.BigEndian.Uint16(b[18:20]),
+	}
+
+	// the extensions are a linked list, each one starts with the type
+	// of the next one (0 for none) and it's own length
+	pos := utpHeaderLen
+	for ext := b[1]; ext != 0; {
+		if pos+2 > len(b) {
+			return nil, nil, errUTPHeader
+		}
+		ext = b[pos]
+		pos += 2 + int(b[pos+1])
+		if pos > len(b) {
+			return nil, nil, errUTPHeader
+		}
+	}
+
+	return h, b[pos:], nil
+}
+
+// utpNow is the timestamp of the packets, microseconds (the 32 bits wrap around every ~71 minutes)
+func utpNow() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// seqLess compares two sequence numbers, that wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// utpKey identifies a connection on the socket, by the remote address and the
+// connection id of the packets that we receive
+type utpKey struct {
+	addr string
+	id   uint16
+}
+
+/*
+UTP is a uTP socket (BEP 29), reliable and ordered connections over UDP, with LEDBAT
+congestion control so that the transfers back off as soon as the link gets busy (before
+the packets start getting dropped). Any number of connections, both ways, share a single
+UDP socket. The socket can be shared with the DHT too, then the DHT reads the datagrams
+and hands over the ones that aren't KRPC messages (see `Handle`). It implements
+`net.Listener`, and the connections `net.Conn`
+*/
+type UTP struct {
+	conn *net.UDPConn
+	own  bool // if the socket is our own, and not shared with the DHT
+
+	mu     sync.Mutex
+	conns  map[utpKey]*utpConn
+	accept chan *utpConn // incoming connections, nil if we don't accept any
+	closed bool
+	done   chan struct{}
+}
+
+// NewUTP creates a uTP socket over a UDP socket that somebody else reads (the DHT), the
+// datagrams are to be passed to `Handle`. Incoming connections are only accepted if `listen`
+func NewUTP(conn *net.UDPConn, listen bool) *UTP {
+	u := &UTP{
+		conn:  conn,
+		conns: make(map[utpKey]*utpConn),
+		done:  make(chan struct{}),
+	}
+	if listen {
+		u.accept = make(chan *utpConn, utpBacklog)
+	}
+
+	go u.tick()
+	return u
+}
+
+// ListenUTP creates a uTP socket with a UDP socket of it's own, on the given address. `Serve`
+// reads the datagrams from it
+func ListenUTP(addr string, listen bool) (*UTP, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	u := NewUTP(conn, listen)
+	u.own = true
+	return u, nil
+}
+
+// Serve reads the datagrams from the UDP socket (if it's our own), it blocks until the socket is closed
+func (u *UTP) Serve() error {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			u.mu.Lock()
+			closed := u.closed
+			u.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		u.Handle(buf[:n], addr)
+	}
+}
+
+// Accept waits for an incoming connection
+func (u *UTP) Accept() (net.Conn, error) {
+	select {
+	case c := <-u.accept:
+		return c, nil
+	case <-u.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the address of the UDP socket
+func (u *UTP) Addr() net.Addr {
+	return u.conn.LocalAddr()
+}
+
+// Close resets all the connections, and closes the UDP socket if it's our own
+func (u *UTP) Close() error {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return nil
+	}
+	u.closed = true
+	close(u.done)
+	conns := u.conns
+	u.conns = make(map[utpKey]*utpConn)
+	u.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		if c.err == nil {
+			c.send(utpReset, c.seq, nil)
+			c.fail(net.ErrClosed)
+		}
+		c.mu.Unlock()
+	}
+
+	if u.own {
+		return u.conn.Close()
+	}
+	return nil
+}
+
+/*
+Handle takes a datagram that has been received on the UDP socket. A SYN opens a new
+connection (if we accept any), the rest of the packets go to the connection they belong
+to, and the ones that belong to none get a RESET back. The datagram isn't kept after
+Handle returns, the buffer can be reused
+*/
+func (u *UTP) Handle(b []byte, addr *net.UDPAddr) {
+	h, payload, err := parseUTP(b)
+	if err != nil {
+		return
+	}
+
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return
+	}
+
+	var c *utpConn
+	if h.typ == utpSyn {
+		// the peer sends with the id of the SYN + 1, and receives with the id of the SYN
+		key := utpKey{addr.String(), h.id + 1}
+		c = u.conns[key]
+		if c == nil {
+			if u.accept == nil || len(u.accept) == cap(u.accept) {
+				u.mu.Unlock()
+				u.reset(h, addr)
+				return
+			}
+
+			c = u.newConn(addr)
+			c.recvID, c.sendID = h.id+1, h.id
+			c.state = utpConnected
+			c.seq = uint16(rand.Intn(65536))
+			c.ack = h.seq
+			c.lastAck = c.seq - 1
+			u.conns[key] = c
+			u.accept <- c
+
+			output.DevInfof("incoming utp connection | %v\n", addr)
+		}
+	} else {
+		c = u.conns[utpKey{addr.String(), h.id}]
+
+		// a RESET might come with either of the ids, depending on the implementation
+		if c == nil && h.typ == utpReset {
+			for _, cc := range u.conns {
+				if cc.sendID == h.id && cc.raddr.String() == addr.String() {
+					c = cc
+					break
+				}
+			}
+		}
+	}
+	u.mu.Unlock()
+
+	if c == nil {
+		if h.typ != utpReset {
+			u.reset(h, addr)
+		}
+		return
+	}
+
+	if c.handle(h, payload) {
+		u.remove(c)
+	}
+}
+
+/*
+DialContext opens a uTP connection to the address, it sends a SYN (and sends it again
+`UTPSynRetries` times) until it's answered with an `ST_STATE`. The connection ids
+are random, we receive with our id and send with our id + 1
+*/
+func (u *UTP) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := u.newConn(raddr)
+
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	for {
+		id := uint16(rand.Intn(65536))
+		key := utpKey{raddr.String(), id}
+		if _, ok := u.conns[key]; !ok {
+			c.recvID, c.sendID = id, id+1
+			u.conns[key] = c
+			break
+		}
+	}
+	u.mu.Unlock()
+
+	// waking up the wait below, when the context gets cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	c.mu.Lock()
+	c.state = utpSynSent
+	syn := &utpPacket{typ: utpSyn, seq: 1}
+	c.seq = 2
+	c.lastAck = 0
+	c.transmit(syn)
+	c.sent = append(c.sent, syn)
+
+	for c.state == utpSynSent && c.err == nil && ctx.Err() == nil {
+		c.cond.Wait()
+	}
+
+	if c.state == utpConnected && c.err == nil {
+		c.mu.Unlock()
+		return c, nil
+	}
+
+	err = c.err
+	if err == nil {
+		err = ctx.Err()
+	}
+	c.mu.Unlock()
+
+	u.remove(c)
+	return nil, err
+}
+
+// newConn creates a connection with the remote address, the ids and the state are up to the caller
+func (u *UTP) newConn(raddr *net.UDPAddr) *utpConn {
+	c := &utpConn{
+		u:       u,
+		raddr:   raddr,
+		window:  float64(4 * UTPPacketSize),
+		peerWnd: UTPPacketSize,
+		rto:     time.Second,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// remove forgets about a connection, the packets that still come for it get a RESET
+func (u *UTP) remove(c *utpConn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := utpKey{c.raddr.String(), c.recvID}
+	if u.conns[key] == c {
+		delete(u.conns, key)
+	}
+}
+
+// reset answers a packet that belongs to no connection with a RESET
+func (u *UTP) reset(h *utpHeader, addr *net.UDPAddr) {
+	r := &utpHeader{typ: utpReset, id: h.id, ts: utpNow(), seq: uint16(rand.Intn(65536)), ack: h.seq}
+	u.conn.WriteToUDP(r.bytes(nil), addr)
+}
+
+// tick checks the connections for timed out packets every `utpTick`, until the socket is closed
+func (u *UTP) tick() {
+	t := time.NewTicker(utpTick)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-t.C:
+		}
+
+		u.mu.Lock()
+		conns := make([]*utpConn, 0, len(u.conns))
+		for _, c := range u.conns {
+			conns = append(conns, c)
+		}
+		u.mu.Unlock()
+
+		for _, c := range conns {
+			if c.tick() {
+				u.remove(c)
+			}
+		}
+	}
+}
+
+// utpPacket is a packet that takes a sequence number, kept until it's acked (or received in order)
+type utpPacket struct {
+	typ     uint8
+	seq     uint16
+	payload []byte
+	sentAt  time.Time
+	resent  bool // round trip times aren't measured with the packets sent more than once
+}
+
+/*
+utpDelays keeps the base delay of LEDBAT, the lowest one-way delay seen in the last
+two minutes (a minimum for each minute, so that an old one goes away as the route
+changes). The delays include the difference of the clocks, which the base delay
+takes away
+*/
+type utpDelays struct {
+	mins  [2]uint32 // the current minute, and the one before it
+	since time.Time // when the current minute started
+}
+
+// add adds a delay sample
+func (d *utpDelays) add(v uint32) {
+	switch {
+	case d.since.IsZero():
+		d.mins[0], d.mins[1], d.since = v, v, time.Now()
+	case time.Since(d.since) > time.Minute:
+		d.mins[1], d.mins[0], d.since = d.mins[0], v, time.Now()
+	case v < d.mins[0]:
+		d.mins[0] = v
+	}
+}
+
+// base returns the base delay
+func (d *utpDelays) base() uint32 {
+	if d.mins[1] < d.mins[0] {
+		return d.mins[1]
+	}
+	return d.mins[0]
+}
+
+// utpConn is a uTP connection, all of it's state is guarded by `mu`, and `cond` is
+// signalled on every change (data, acks, deadlines and errors)
+type utpConn struct {
+	u      *UTP
+	raddr  *net.UDPAddr
+	recvID uint16 // connection id of the packets we receive
+	sendID uint16 // connection id of the packets we send
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	state  int
+	err    error // why the connection has failed, nil while it's alive
+	closed bool  // if `Close` has been called
+
+	// sending
+	seq      uint16       // seq_nr of the next packet we send
+	sent     []*utpPacket // sent and not acked yet, in order
+	inflight int          // bytes of payload in `sent`
+	window   float64      // congestion window in bytes, by LEDBAT
+	peerWnd  int          // the peer's receive window
+	delays   utpDelays
+	rtt      time.Duration // smoothed round trip time
+	rttVar   time.Duration
+	rto      time.Duration // retransmission timeout
+	timeouts int           // times in a row that the oldest packet has timed out
+	lastAck  uint16        // ack_nr of the last packet from the peer, to count the duplicate acks
+	dupAcks  int
+	recover  uint16 // seq_nr of the last packet sent when a loss was detected
+	lossy    bool   // if the packets up to `recover` are still being recovered
+
+	// receiving
+	ack    uint16                // seq_nr of the last packet we've received in order
+	ooo    map[uint16]*utpPacket // packets that have come out of order
+	rbuf   []byte                // data to be read
+	tsDiff uint32                // measured with the last packet, sent back to the peer
+	fin    bool                  // if the peer's FIN has been received (in order)
+
+	rdeadline time.Time
+	wdeadline time.Time
+}
+
+// Read reads the data received in order, io.EOF after the peer's FIN
+func (c *utpConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.rbuf) == 0 {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.fin:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		if err := c.wait(c.rdeadline); err != nil {
+			return 0, err
+		}
+	}
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	before := c.recvWindow()
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	// the peer might be waiting for room in our receive window
+	if before < 2*UTPPacketSize && c.recvWindow() >= 2*UTPPacketSize {
+		c.sendState()
+	}
+
+	return n, nil
+}
+
+// Write splits the data into packets, and sends them as soon as the congestion window
+// (and the peer's receive window) have room for them. It returns once all the packets
+// have been sent, not when they get acked
+func (c *utpConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for n < len(b) {
+		size := len(b) - n
+		if size > UTPPacketSize {
+			size = UTPPacketSize
+		}
+
+		// a single packet can always be in flight, that keeps the
+		// acks (and the window updates) coming when the window is 0
+		for {
+			switch {
+			case c.closed:
+				return n, net.ErrClosed
+			case c.err != nil:
+				return n, c.err
+			}
+			if c.inflight == 0 || c.inflight+size <= c.sendWindow() {
+				break
+			}
+			if err := c.wait(c.wdeadline); err != nil {
+				return n, err
+			}
+		}
+
+		p := &utpPacket{typ: utpData, seq: c.seq, payload: append([]byte{}, b[n:n+size]...)}
+		c.seq++
+		c.transmit(p)
+		c.sent = append(c.sent, p)
+		c.inflight += size
+		n += size
+	}
+
+	return n, nil
+}
+
+// Close sends a FIN, that gets sent again until it's acked (by `tick`) while Close returns right away
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.cond.Broadcast()
+
+	if c.err == nil && c.state == utpConnected {
+		p := &utpPacket{typ: utpFin, seq: c.seq}
+		c.seq++
+		c.transmit(p)
+		c.sent = append(c.sent, p)
+		c.state = utpFinSent
+	}
+	done := c.finished()
+	c.mu.Unlock()
+
+	if done {
+		c.u.remove(c)
+	}
+	return nil
+}
+
+// LocalAddr returns the address of the UDP socket
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.u.conn.LocalAddr()
+}
+
+// RemoteAddr returns the peer's UDP address
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets both the read and the write deadlines
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rdeadline, c.wdeadline = t, t
+	c.cond.Broadcast()
+	return nil
+}
+
+// SetReadDeadline sets the deadline of `Read`
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rdeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of `Write`
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.wdeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+// wait waits (with `mu` held) for `cond` to be signalled, or the deadline to pass
+func (c *utpConn) wait(deadline time.Time) error {
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.AfterFunc(d, func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+		defer t.Stop()
+	}
+
+	c.cond.Wait()
+	return nil
+}
+
+/*
+handle handles a packet of the connection, it returns true once the connection is
+done with (and can be removed from the socket). The acks are processed for every
+packet type, the data and the FINs get acked with an `ST_STATE` right away
+*/
+func (c *utpConn) handle(h *utpHeader, payload []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if h.ts != 0 {
+		c.tsDiff = utpNow() - h.ts
+	}
+	c.peerWnd = int(h.wnd)
+
+	switch h.typ {
+	case utpReset:
+		c.fail(errUTPReset)
+		return true
+
+	case utpSyn:
+		// our `ST_STATE` got lost, the peer is sending the SYN again
+		c.sendState()
+		return false
+	}
+
+	if c.state == utpSynSent {
+		if h.typ != utpState {
+			return false
+		}
+		// the peer's first packet with data takes the seq_nr of the `ST_STATE`
+		c.state = utpConnected
+		c.ack = h.seq - 1
+		output.DevInfof("utp connection established | %v\n", c.raddr)
+	}
+
+	c.acked(h)
+
+	if h.typ == utpData || h.typ == utpFin {
+		c.received(h, payload)
+		c.sendState()
+	}
+
+	return c.finished()
+}
+
+/*
+acked removes the packets that the peer has acked (all up to ack_nr) from the ones
+in flight, measuring the round trip time and updating the congestion window. Three
+acks in a row for the same packet (without any data) mean that the one after it got
+lost, it's sent again without waiting for the timeout (and the window gets halved).
+Until all the packets that were in flight at the time get acked, each ack that
+leaves some of them out means another loss, so the next one is sent again right
+away too (like TCP's NewReno, as there are no selective acks)
+*/
+func (c *utpConn) acked(h *utpHeader) {
+	now := time.Now()
+
+	n, bytes := 0, 0
+	for n < len(c.sent) && !seqLess(h.ack, c.sent[n].seq) {
+		p := c.sent[n]
+		if !p.resent {
+			c.sample(now.Sub(p.sentAt))
+		}
+		bytes += len(p.payload)
+		n++
+	}
+
+	switch {
+	case n > 0:
+		c.sent = c.sent[n:]
+		c.inflight -= bytes
+		c.timeouts = 0
+		c.dupAcks = 0
+		c.ledbat(bytes, h.tsDiff)
+
+		if c.lossy && len(c.sent) > 0 && seqLess(h.ack, c.recover) {
+			c.sent[0].resent = true
+			c.transmit(c.sent[0])
+		} else {
+			c.lossy = false
+		}
+
+	case h.typ == utpState && len(c.sent) > 0 && h.ack == c.lastAck:
+		c.dupAcks++
+		if c.dupAcks == 3 && !c.lossy {
+			c.window = math.Max(c.window/2, float64(UTPPacketSize))
+			c.lost()
+		}
+	}
+
+	c.lastAck = h.ack
+}
+
+// sample updates the round trip time and the retransmission timeout, the same way as TCP does (RFC 6298)
+func (c *utpConn) sample(rtt time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = rtt, rtt/2
+	} else {
+		delta := c.rtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (rtt - c.rtt) / 8
+	}
+
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < utpMinRTO {
+		c.rto = utpMinRTO
+	}
+}
+
+/*
+ledbat updates the congestion window with the acked bytes and the delay that the peer
+has measured (timestamp_difference). The queuing delay is how much the delay is over
+the base delay, and the window grows in proportion to how far under `UTPTargetDelay`
+it is (at most `UTPMaxWindowIncrease` a round trip), or shrinks as much as it is over it
+*/
+func (c *utpConn) ledbat(bytes int, delay uint32) {
+	if bytes == 0 || delay == 0 {
+		return
+	}
+	c.delays.add(delay)
+
+	target := float64(UTPTargetDelay / time.Microsecond)
+	queuing := float64(delay - c.delays.base())
+	offTarget := (target - queuing) / target
+
+	windowFactor := float64(bytes) / math.Max(c.window, float64(bytes))
+	c.window += float64(UTPMaxWindowIncrease) * offTarget * windowFactor
+
+	if c.window < float64(UTPPacketSize) {
+		c.window = float64(UTPPacketSize)
+	}
+}
+
+// received takes a data packet (or the FIN), the ones that come before the packets
+// missing in between are kept until those arrive
+func (c *utpConn) received(h *utpHeader, payload []byte) {
+	// old, or too far ahead
+	if !seqLess(c.ack, h.seq) || int16(h.seq-c.ack) > utpMaxOutOfOrder {
+		return
+	}
+
+	if h.seq != c.ack+1 {
+		if c.ooo == nil {
+			c.ooo = make(map[uint16]*utpPacket)
+		}
+		c.ooo[h.seq] = &utpPacket{typ: h.typ, seq: h.seq, payload: append([]byte{}, payload...)}
+		return
+	}
+
+	c.deliver(h.typ, payload)
+	c.ack = h.seq
+
+	for {
+		p, ok := c.ooo[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, p.seq)
+		c.deliver(p.typ, p.payload)
+		c.ack = p.seq
+	}
+}
+
+// deliver adds the payload of an in-order packet to the data to be read, nothing comes after the FIN
+func (c *utpConn) deliver(typ uint8, payload []byte) {
+	switch {
+	case c.fin:
+	case typ == utpFin:
+		c.fin = true
+		c.ooo = nil
+	case !c.closed:
+		c.rbuf = append(c.rbuf, payload...)
+	}
+}
+
+/*
+tick sends the oldest packet in flight again if it hasn't been acked within the
+retransmission timeout, the window goes down to a single packet and the timeout
+doubles. The connection fails after `UTPMaxRetries` timeouts in a row (`UTPSynRetries`
+while connecting). It returns true once the connection is done with
+*/
+func (c *utpConn) tick() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.sent) > 0 && time.Since(c.sent[0].sentAt) > c.rto {
+		c.timeouts++
+
+		limit := UTPMaxRetries
+		if c.state == utpSynSent {
+			limit = UTPSynRetries
+		}
+
+		if c.timeouts > limit {
+			c.fail(errUTPTimeout)
+		} else {
+			c.window = float64(UTPPacketSize)
+			c.rto *= 2
+			c.lost()
+		}
+	}
+
+	return c.finished()
+}
+
+// lost sends the oldest packet in flight again, and starts recovering the ones sent after it
+func (c *utpConn) lost() {
+	c.sent[0].resent = true
+	c.transmit(c.sent[0])
+	c.recover = c.sent[len(c.sent)-1].seq
+	c.lossy = true
+}
+
+// finished checks if the connection is done with, it has failed or
+// it has been closed and the FIN (and all the data before it) has been acked
+func (c *utpConn) finished() bool {
+	return c.err != nil || (c.closed && len(c.sent) == 0)
+}
+
+// fail makes the connection fail with the error, Read and Write return it from now on
+func (c *utpConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.sent, c.inflight = nil, 0
+	c.cond.Broadcast()
+}
+
+// sendWindow is the most bytes that can be in flight, the congestion
+// window or the peer's receive window, whichever is smaller
+func (c *utpConn) sendWindow() int {
+	if int(c.window) < c.peerWnd {
+		return int(c.window)
+	}
+	return c.peerWnd
+}
+
+// recvWindow is the room in our receive buffer, advertised to the peer
+func (c *utpConn) recvWindow() int {
+	n := UTPRecvWindow - len(c.rbuf)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// transmit sends (or sends again) a packet that takes a sequence number
+func (c *utpConn) transmit(p *utpPacket) {
+	p.sentAt = time.Now()
+	c.send(p.typ, p.seq, p.payload)
+}
+
+// sendState sends an `ST_STATE`, acking the packets we've received so far
+func (c *utpConn) sendState() {
+	c.send(utpState, c.seq, nil)
+}
+
+// send writes a packet to the UDP socket, with the connection's current ack_nr, window and
+// timestamp difference. The SYN is the only packet sent with our receiving id
+func (c *utpConn) send(typ uint8, seq uint16, payload []byte) {
+	id := c.sendID
+	if typ == utpSyn {
+		id = c.recvID
+	}
+
+	h := &utpHeader{
+		typ:    typ,
+		id:     id,
+		ts:     utpNow(),
+		tsDiff: c.tsDiff,
+		wnd:    uint32(c.recvWindow()),
+		seq:    seq,
+		ack:    c.ack,
+	}
+
+	if _, err := c.u.conn.WriteToUDP(h.bytes(payload), c.raddr); err != nil {
+		output.DevInfof("couldn't send utp packet, %v | %v\n", err, c.raddr)
+	}
+}
+
+/*
+dial connects to the peer over both uTP and TCP. The uTP connection attempt gets a head
+start of `UTPHeadStart` (or until it fails, if that comes first), then a TCP one is started
+alongside it, and the connection that gets established first is used. uTP is preferred as
+it's congestion control backs off when the network gets busy, and plenty of peers are only
+reachable over it, while TCP still gets through to the peers that don't support uTP
+*/
+func (c *Client) dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+
+	if c.UTP == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+
+	go func() {
+		conn, err := c.UTP.DialContext(ctx, addr)
+		results <- result{conn, err}
+	}()
+
+	headStart := time.NewTimer(UTPHeadStart)
+	defer headStart.Stop()
+
+	pending, tcp := 1, false
+	startTCP := func() {
+		tcp = true
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	var err error
+	for pending > 0 {
+		select {
+		case <-headStart.C:
+			if !tcp {
+				startTCP()
+			}
+
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the other attempt gets cancelled, it's connection
+				// is closed in case it got through anyway
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+
+			err = r.err
+			if !tcp {
+				startTCP()
+			}
+		}
+	}
+
+	return nil, err
+}
@@ -0,0 +1,416 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// utpPacketBytes builds a packet, with the extension chain (type of the first one, then
+// the raw bytes of the chain) between the header and the payload
+func utpPacketBytes(h *utpHeader, ext uint8, chain []byte, payload []byte) []byte {
+	b := h.bytes(nil)
+	b[1] = ext
+	return append(append(b, chain...), payload...)
+}
+
+func TestParseUTP(t *testing.T) {
+	h := &utpHeader{typ: utpData, id: 4321, ts: 1000, tsDiff: 20, wnd: 65536, seq: 7, ack: 6}
+
+	tests := []struct {
+		name    string
+		b       []byte
+		payload []byte // nil if the packet has to be rejected
+	}{
+		{"no extensions", h.bytes([]byte("data")), []byte("data")},
+		{"no payload", h.bytes(nil), []byte{}},
+		{"selective ack", utpPacketBytes(h, 1, []byte{0, 4, 1, 2, 3, 4}, []byte("data")), []byte("data")},
+		{"two extensions", utpPacketBytes(h, 1, []byte{2, 4, 1, 2, 3, 4, 0, 1, 9}, []byte("data")), []byte("data")},
+		{"empty extension", utpPacketBytes(h, 2, []byte{0, 0}, []byte("data")), []byte("data")},
+		{"short header", h.bytes(nil)[:utpHeaderLen-1], nil},
+		{"empty", []byte{}, nil},
+		{"wrong version", append([]byte{utpData<<4 | 2}, h.bytes(nil)[1:]...), nil},
+		{"unknown type", append([]byte{5<<4 | utpVersion}, h.bytes(nil)[1:]...), nil},
+		{"extension without it's header", utpPacketBytes(h, 1, []byte{0}, nil), nil},
+		{"extension longer than the packet", utpPacketBytes(h, 1, []byte{0, 8, 1, 2, 3}, nil), nil},
+		{"chain running past the packet", utpPacketBytes(h, 1, []byte{1, 2, 0, 0, 1, 2, 0, 0, 1}, nil), nil},
+		{"garbage chain", utpPacketBytes(h, 0xff, []byte{0xff, 0xff, 0xff}, nil), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, payload, err := parseUTP(tt.b)
+			if tt.payload == nil {
+				if err == nil {
+					t.Fatal("invalid packet parsed")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *h {
+				t.Fatalf("header %+v, want %+v", got, h)
+			}
+			if !bytes.Equal(payload, tt.payload) {
+				t.Fatalf("payload %q, want %q", payload, tt.payload)
+			}
+		})
+	}
+}
+
+// utpPair creates two uTP sockets on loopback, the second one accepts connections. The
+// datagrams that arrive at the second one go through `filter` (if it's not nil), it
+// returns the datagrams to be handed over in their place (to drop or reorder them)
+func utpPair(t *testing.T, filter func(b []byte) [][]byte) (*UTP, *UTP) {
+	a, err := ListenUTP("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ListenUTP("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	go a.Serve()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := b.conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			dgs := [][]byte{buf[:n]}
+			if filter != nil {
+				dgs = filter(append([]byte{}, buf[:n]...))
+			}
+			for _, dg := range dgs {
+				b.Handle(dg, addr)
+			}
+		}
+	}()
+
+	return a, b
+}
+
+// utpConnect connects the two sockets, it returns the dialing and the accepting side
+func utpConnect(t *testing.T, a, b *UTP) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := b.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ca, err := a.DialContext(ctx, b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := <-accepted
+	if cb == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() { ca.Close(); cb.Close() })
+
+	return ca, cb
+}
+
+// utpSend writes the data on one side and closes it, the other side has to read it
+// all (starting after `delay`), followed by io.EOF
+func utpSend(t *testing.T, w, r net.Conn, size int, delay time.Duration) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		w.Close()
+		errc <- err
+	}()
+
+	time.Sleep(delay)
+	r.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("%v bytes read, of %v sent (or the wrong data)", len(got), len(data))
+	}
+}
+
+// utpDataSeq returns the seq_nr of a data packet, and false for the other packets
+func utpDataSeq(b []byte) (uint16, bool) {
+	h, _, err := parseUTP(b)
+	if err != nil || h.typ != utpData {
+		return 0, false
+	}
+	return h.seq, true
+}
+
+func TestUTPTransfer(t *testing.T) {
+	a, b := utpPair(t, nil)
+	ca, cb := utpConnect(t, a, b)
+
+	// both ways on the same connection, the first one takes more than a receive
+	// window, and the reading starts late so the sender has to wait for room in it
+	if _, err := cb.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	hello := make([]byte, 5)
+	if _, err := io.ReadFull(ca, hello); err != nil || string(hello) != "hello" {
+		t.Fatalf("read %q, %v", hello, err)
+	}
+
+	utpSend(t, ca, cb, 2*UTPRecvWindow+1000, 200*time.Millisecond)
+}
+
+func TestUTPLoss(t *testing.T) {
+	// dropping a data packet out of every 10 (each one only the first time it's
+	// sent), the gaps have to be filled by sending them again
+	dropped := make(map[uint16]bool)
+	a, b := utpPair(t, func(dg []byte) [][]byte {
+		if seq, ok := utpDataSeq(dg); ok && seq%10 == 0 && !dropped[seq] {
+			dropped[seq] = true
+			return nil
+		}
+		return [][]byte{dg}
+	})
+	ca, cb := utpConnect(t, a, b)
+
+	utpSend(t, ca, cb, 256*1024, 0)
+	if len(dropped) == 0 {
+		t.Fatal("no packets dropped")
+	}
+}
+
+func TestUTPReorder(t *testing.T) {
+	// holding back a data packet out of every 7, until the one after it has been handed over
+	var held []byte
+	swapped := 0
+	a, b := utpPair(t, func(dg []byte) [][]byte {
+		seq, ok := utpDataSeq(dg)
+		switch {
+		case held != nil:
+			dgs := [][]byte{dg, held}
+			held = nil
+			swapped++
+			return dgs
+		case ok && seq%7 == 0:
+			held = dg
+			return nil
+		}
+		return [][]byte{dg}
+	})
+	ca, cb := utpConnect(t, a, b)
+
+	utpSend(t, ca, cb, 256*1024, 0)
+	if swapped == 0 {
+		t.Fatal("no packets reordered")
+	}
+}
+
+func TestUTPReset(t *testing.T) {
+	t.Run("not accepting", func(t *testing.T) {
+		a, _ := utpPair(t, nil)
+		b, err := ListenUTP("127.0.0.1:0", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		go b.Serve()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if _, err := a.DialContext(ctx, b.Addr().String()); err != errUTPReset {
+			t.Fatalf("dial error %v, want %v", err, errUTPReset)
+		}
+	})
+
+	t.Run("connection closed", func(t *testing.T) {
+		a, b := utpPair(t, nil)
+		ca, _ := utpConnect(t, a, b)
+
+		// closing the socket resets it's connections
+		b.Close()
+
+		ca.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := ca.Read(make([]byte, 1)); err != errUTPReset {
+			t.Fatalf("read error %v, want %v", err, errUTPReset)
+		}
+		if _, err := ca.Write([]byte("data")); err != errUTPReset {
+			t.Fatalf("write error %v, want %v", err, errUTPReset)
+		}
+	})
+
+	t.Run("unknown connection", func(t *testing.T) {
+		_, b := utpPair(t, nil)
+		conn, err := net.DialUDP("udp", nil, b.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		h := &utpHeader{typ: utpData, id: 999, seq: 10}
+		if _, err := conn.Write(h.bytes([]byte("data"))); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 1500)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _, err := parseUTP(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.typ != utpReset || r.id != h.id || r.ack != h.seq {
+			t.Fatalf("answered with %+v, want a RESET", r)
+		}
+	})
+}
+
+func TestLedbat(t *testing.T) {
+	const base = 50000 // microseconds, includes the difference of the clocks
+	target := uint32(UTPTargetDelay / time.Microsecond)
+
+	tests := []struct {
+		name   string
+		delay  uint32 // the delay the peer measured, for an ack of a packet
+		change int    // 1 if the window has to grow, -1 if it has to shrink, 0 if it has to stay
+	}{
+		{"base delay", base, 1},
+		{"under the target", base + target/2, 1},
+		{"on the target", base + target, 0},
+		{"over the target", base + 2*target, -1},
+		{"far over the target", base + 10*target, -1},
+		{"lower base delay", base - 1000, 1},
+	}
+
+	c := &utpConn{window: float64(20 * UTPPacketSize)}
+	for _, tt := range tests {
+		before := c.window
+		c.ledbat(UTPPacketSize, tt.delay)
+
+		switch {
+		case tt.change > 0 && c.window <= before,
+			tt.change < 0 && c.window >= before,
+			tt.change == 0 && c.window != before:
+			t.Fatalf("%v: window %v, from %v", tt.name, c.window, before)
+		}
+	}
+
+	// it doesn't shrink below a single packet, however high the delay
+	for i := 0; i < 1000; i++ {
+		c.ledbat(UTPPacketSize, base+100*target)
+	}
+	if c.window != float64(UTPPacketSize) {
+		t.Fatalf("window %v, want %v", c.window, UTPPacketSize)
+	}
+
+	// a growth of at most `UTPMaxWindowIncrease` in a round trip (a window worth of acks)
+	c = &utpConn{window: float64(10 * UTPPacketSize)}
+	c.ledbat(UTPPacketSize, base)
+	before := c.window
+	for i := 0; i < 10; i++ {
+		c.ledbat(UTPPacketSize, base)
+	}
+	if c.window-before > float64(UTPMaxWindowIncrease) {
+		t.Fatalf("window grew by %v in a round trip", c.window-before)
+	}
+}
+
+func TestDialFallback(t *testing.T) {
+	u, err := ListenUTP("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	go u.Serve()
+	c := &Client{UTP: u}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a peer with TCP only, nothing answers the SYNs on it's port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, err := c.dial(ctx, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := conn.RemoteAddr().Network(); n != "tcp" {
+		t.Fatalf("connected over %v, want tcp", n)
+	}
+
+	// and one with uTP, that's preferred
+	_, b := utpPair(t, nil)
+	go b.Accept()
+
+	conn, err = c.dial(ctx, b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := conn.RemoteAddr().Network(); n != "udp" {
+		t.Fatalf("connected over %v, want udp", n)
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{65535, 0, true},
+		{0, 65535, false},
+		{65000, 100, true},
+	}
+	for _, tt := range tests {
+		if got := seqLess(tt.a, tt.b); got != tt.less {
+			t.Errorf("seqLess(%v, %v) = %v", tt.a, tt.b, got)
+		}
+	}
+
+	// the header encodes the sequence numbers big endian
+	b := (&utpHeader{typ: utpState, seq: 0x0102, ack: 0x0304}).bytes(nil)
+	if binary.BigEndian.Uint16(b[16:18]) != 0x0102 || binary.BigEndian.Uint16(b[18:20]) != 0x0304 {
+		t.Fatalf("header %x", b)
+	}
+}